@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"path"
 	"strings"
 
 	"github.com/aws/aws-lambda-go/events"
@@ -13,9 +14,12 @@ import (
 	"github.com/aws/aws-sdk-go/service/dynamodb"
 	"github.com/step-security/secure-repo/remediation/dependabot"
 	"github.com/step-security/secure-repo/remediation/docker"
+	"github.com/step-security/secure-repo/remediation/manifest"
+	"github.com/step-security/secure-repo/remediation/registry"
 	"github.com/step-security/secure-repo/remediation/secrets"
 	"github.com/step-security/secure-repo/remediation/workflow"
 	"github.com/step-security/secure-repo/remediation/workflow/permissions"
+	"github.com/step-security/secure-repo/remediation/workflow/pin"
 )
 
 type Handler struct {
@@ -34,6 +38,14 @@ func (h Handler) Invoke(ctx context.Context, req []byte) ([]byte, error) {
 		}))
 
 		dynamoDbSvc := dynamodb.New(sess)
+
+		registryAuthConfig, err := registry.LoadAuthConfig(sess)
+		if err != nil {
+			fmt.Printf("unable to load registry credentials: %v\n", err)
+		}
+		keychain := registry.NewKeychain(registryAuthConfig)
+		docker.Keychain = keychain
+		pin.Keychain = keychain
 		var response events.APIGatewayProxyResponse
 
 		if httpRequest.RequestContext.HTTP.Method == "OPTIONS" {
@@ -169,7 +181,118 @@ func (h Handler) Invoke(ctx context.Context, req []byte) ([]byte, error) {
 				dockerFile = httpRequest.Body
 			}
 
-			fixResponse, err := docker.SecureDockerFile(dockerFile)
+			dockerfileConfig := docker.DockerfileConfig{
+				RequireIndex:           queryStringParams["requireIndex"] == "true",
+				AddNonRootUser:         queryStringParams["addNonRootUser"] == "true",
+				SkipArgImages:          queryStringParams["skipArgImages"] == "true",
+				SkipUnresolvableImages: queryStringParams["skipUnresolvableImages"] == "true",
+			}
+			if queryStringParams["verifyImages"] == "true" {
+				dockerfileConfig.Verification = &registry.VerificationPolicy{}
+				if policyJSON := queryStringParams["verificationPolicy"]; policyJSON != "" {
+					dockerfileConfig.Verification, err = registry.ParseVerificationPolicy(policyJSON)
+					if err != nil {
+						response = events.APIGatewayProxyResponse{
+							StatusCode: http.StatusInternalServerError,
+							Body:       err.Error(),
+						}
+						returnValue, _ := json.Marshal(&response)
+						return returnValue, nil
+					}
+				}
+			}
+
+			fixResponse, err := docker.SecureDockerFile(dockerFile, dockerfileConfig)
+			if err != nil {
+				response = events.APIGatewayProxyResponse{
+					StatusCode: http.StatusInternalServerError,
+					Body:       err.Error(),
+				}
+			} else {
+
+				output, _ := json.Marshal(fixResponse)
+				response = events.APIGatewayProxyResponse{
+					StatusCode: http.StatusOK,
+					Body:       string(output),
+				}
+			}
+
+		}
+
+		if strings.Contains(httpRequest.RawPath, "/secure-docker-action") {
+
+			// owner, repo and path of action.yml are required, since the
+			// Dockerfile it references is fetched from the same repo
+			queryStringParams := httpRequest.QueryStringParameters
+			actionYaml, err := workflow.GetGitHubWorkflowContents(queryStringParams)
+			if err != nil {
+				fixResponse := &docker.SecureDockerActionResponse{ActionFetchError: true}
+				output, _ := json.Marshal(fixResponse)
+				response = events.APIGatewayProxyResponse{
+					StatusCode: http.StatusOK,
+					Body:       string(output),
+				}
+				returnValue, _ := json.Marshal(&response)
+				return returnValue, nil
+			}
+
+			getFile := func(relativePath string) (string, error) {
+				fileParams := make(map[string]string)
+				for k, v := range queryStringParams {
+					fileParams[k] = v
+				}
+				fileParams["path"] = path.Join(path.Dir(queryStringParams["path"]), relativePath)
+				return workflow.GetGitHubWorkflowContents(fileParams)
+			}
+
+			fixResponse, err := docker.SecureDockerAction(actionYaml, getFile)
+			if err != nil {
+				response = events.APIGatewayProxyResponse{
+					StatusCode: http.StatusInternalServerError,
+					Body:       err.Error(),
+				}
+			} else {
+
+				output, _ := json.Marshal(fixResponse)
+				response = events.APIGatewayProxyResponse{
+					StatusCode: http.StatusOK,
+					Body:       string(output),
+				}
+			}
+
+		}
+
+		if strings.Contains(httpRequest.RawPath, "/secure-manifest") {
+
+			manifestFile := ""
+			queryStringParams := httpRequest.QueryStringParameters
+			// if owner is set, assuming that repo, path are also set
+			// get the compose file or kubernetes manifest using API
+			if _, ok := queryStringParams["owner"]; ok {
+				manifestFile, err = workflow.GetGitHubWorkflowContents(httpRequest.QueryStringParameters)
+				if err != nil {
+					fixResponse := &manifest.SecureManifestResponse{ManifestFetchError: true}
+					output, _ := json.Marshal(fixResponse)
+					response = events.APIGatewayProxyResponse{
+						StatusCode: http.StatusOK,
+						Body:       string(output),
+					}
+					returnValue, _ := json.Marshal(&response)
+					return returnValue, nil
+				}
+			} else {
+				// if owner is not set, then the file should be sent in the body
+				manifestFile = httpRequest.Body
+			}
+
+			manifestConfig := manifest.ManifestConfig{
+				SkipUnresolvableImages: queryStringParams["skipUnresolvableImages"] == "true",
+			}
+			if exemptedImages := queryStringParams["exemptedImages"]; exemptedImages != "" {
+				manifestConfig.ExemptedImages = strings.Split(exemptedImages, ",")
+			}
+
+			fixResponse, err := manifest.SecureManifest(manifestFile, manifestConfig)
 			if err != nil {
 				response = events.APIGatewayProxyResponse{
 					StatusCode: http.StatusInternalServerError,
@@ -0,0 +1,247 @@
+package docker
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/asottile/dockerfile"
+)
+
+const (
+	RuleRootUser         = "root-user"
+	RuleAddRemoteURL     = "add-remote-url"
+	RuleCurlPipeShell    = "curl-pipe-shell"
+	RuleAptGetUnpinned   = "apt-get-unpinned"
+	RulePipWithoutHashes = "pip-without-hashes"
+	RuleSecretInArgOrEnv = "secret-in-arg-env"
+	RuleArgInFrom        = "arg-in-from"
+)
+
+const (
+	// the nonroot user of distroless images, which does not need an /etc/passwd entry
+	nonRootUser           = "65532:65532"
+	nonRootUserFixComment = "# run as a non-root user"
+)
+
+var (
+	curlPipeShellRegex = regexp.MustCompile(`\b(curl|wget)\b[^|;&]*\|\s*(sudo\s+)?(ba|z|da|k)?sh\b`)
+	secretNameRegex    = regexp.MustCompile(`(?i)(password|passwd|secret|token|api_?key|private_?key|access_?key|credentials)`)
+	shellSeparator     = regexp.MustCompile(`&&|\|\||;|\|`)
+)
+
+// DockerfileFinding is a hardening issue found in a Dockerfile
+type DockerfileFinding struct {
+	Rule    string
+	Line    int
+	Message string
+	// Fixed is set when the finding was fixed in FinalOutput
+	Fixed bool
+}
+
+// checkRules reports hardening issues in cmds. If addNonRootUser is set, a final stage that runs
+// as root gets a non-root USER in lines, which is the Dockerfile split by line.
+func checkRules(cmds []dockerfile.Command, lines []string, addNonRootUser bool) ([]DockerfileFinding, []string) {
+	findings := []DockerfileFinding{}
+
+	// whether the current stage, and each named stage, ends as a non-root user
+	stageNonRoot := make(map[string]bool)
+	currentStage := ""
+	nonRoot := false
+	seenFrom := false
+
+	for _, c := range cmds {
+		switch strings.ToUpper(c.Cmd) {
+		case "FROM":
+			if currentStage != "" {
+				stageNonRoot[currentStage] = nonRoot
+			}
+			seenFrom = true
+			currentStage = ""
+			nonRoot = false
+			if len(c.Value) > 0 {
+				// a stage built from an earlier stage inherits its USER
+				nonRoot = stageNonRoot[strings.ToLower(c.Value[0])]
+			}
+			if len(c.Value) == 3 && strings.EqualFold(c.Value[1], "AS") {
+				currentStage = strings.ToLower(c.Value[2])
+			}
+		case "USER":
+			if len(c.Value) > 0 {
+				nonRoot = !isRootUser(c.Value[0])
+			}
+		case "ADD":
+			if hasFlag(c.Flags, "--checksum") {
+				continue
+			}
+			for _, source := range addSources(c.Value) {
+				if strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") {
+					findings = append(findings, DockerfileFinding{
+						Rule:    RuleAddRemoteURL,
+						Line:    c.StartLine,
+						Message: fmt.Sprintf("ADD downloads %s without verifying its checksum, use ADD --checksum or download and verify it in RUN", source),
+					})
+				}
+			}
+		case "RUN":
+			findings = append(findings, checkRunCommand(strings.Join(c.Value, " "), c.StartLine)...)
+		case "ARG", "ENV":
+			for _, name := range argOrEnvNames(c) {
+				if secretNameRegex.MatchString(name) {
+					findings = append(findings, DockerfileFinding{
+						Rule:    RuleSecretInArgOrEnv,
+						Line:    c.StartLine,
+						Message: fmt.Sprintf("%s %s looks like a secret and is stored in the image history, use RUN --mount=type=secret instead", strings.ToUpper(c.Cmd), name),
+					})
+				}
+			}
+		}
+	}
+
+	if seenFrom && !nonRoot {
+		finding := DockerfileFinding{
+			Rule:    RuleRootUser,
+			Line:    lastLine(lines),
+			Message: "the final stage runs as root, add a USER instruction for a non-root user",
+		}
+		if addNonRootUser {
+			lines = addUser(lines)
+			finding.Fixed = true
+		}
+		findings = append(findings, finding)
+	}
+
+	return findings, lines
+}
+
+func checkRunCommand(command string, line int) []DockerfileFinding {
+	findings := []DockerfileFinding{}
+
+	if curlPipeShellRegex.MatchString(command) {
+		findings = append(findings, DockerfileFinding{
+			Rule:    RuleCurlPipeShell,
+			Line:    line,
+			Message: "a downloaded script is piped to a shell without verification, download it and verify its checksum first",
+		})
+	}
+
+	// the regex also splits on |, which is fine as install commands do not read stdin
+	for _, segment := range shellSeparator.Split(command, -1) {
+		fields := strings.Fields(strings.ReplaceAll(segment, "\\", " "))
+		if len(fields) == 0 {
+			continue
+		}
+		if fields[0] == "sudo" {
+			fields = fields[1:]
+		}
+		if len(fields) < 2 {
+			continue
+		}
+
+		if (fields[0] == "apt-get" || fields[0] == "apt") && contains(fields, "install") {
+			unpinned := []string{}
+			for _, pkg := range fields[indexOf(fields, "install")+1:] {
+				if strings.HasPrefix(pkg, "-") || strings.Contains(pkg, "=") {
+					continue
+				}
+				unpinned = append(unpinned, pkg)
+			}
+			if len(unpinned) > 0 {
+				findings = append(findings, DockerfileFinding{
+					Rule:    RuleAptGetUnpinned,
+					Line:    line,
+					Message: fmt.Sprintf("%s install without pinned versions: %s, use <package>=<version>", fields[0], strings.Join(unpinned, " ")),
+				})
+			}
+		}
+
+		if isPipCommand(fields) && contains(fields, "install") && !contains(fields, "--require-hashes") {
+			findings = append(findings, DockerfileFinding{
+				Rule:    RulePipWithoutHashes,
+				Line:    line,
+				Message: "pip install without --require-hashes, install from a requirements file with hashes",
+			})
+		}
+	}
+
+	return findings
+}
+
+func isPipCommand(fields []string) bool {
+	if strings.HasPrefix(fields[0], "pip") {
+		return true
+	}
+	// python -m pip install
+	return strings.HasPrefix(fields[0], "python") && len(fields) > 2 && fields[1] == "-m" && strings.HasPrefix(fields[2], "pip")
+}
+
+func isRootUser(user string) bool {
+	user = strings.Split(user, ":")[0]
+	return user == "root" || user == "0"
+}
+
+// addSources returns the sources of ADD, the last value is the destination
+func addSources(value []string) []string {
+	if len(value) < 2 {
+		return nil
+	}
+	return value[:len(value)-1]
+}
+
+// argOrEnvNames returns the variable names set by ARG or ENV.
+// ENV also has a legacy "ENV name value" form.
+func argOrEnvNames(c dockerfile.Command) []string {
+	if strings.EqualFold(c.Cmd, "ENV") {
+		names := []string{}
+		// the parser returns ENV as name, value pairs
+		for i := 0; i < len(c.Value); i += 2 {
+			names = append(names, c.Value[i])
+		}
+		return names
+	}
+	names := []string{}
+	for _, arg := range c.Value {
+		name, _, _ := cut(arg, "=")
+		names = append(names, name)
+	}
+	return names
+}
+
+// lastLine returns the 1-based number of the last non-empty line
+func lastLine(lines []string) int {
+	end := len(lines)
+	for end > 0 && strings.TrimSpace(lines[end-1]) == "" {
+		end--
+	}
+	return end
+}
+
+// addUser adds a non-root USER at the end of the final stage
+func addUser(lines []string) []string {
+	// keep the trailing newline at the end
+	end := lastLine(lines)
+	userLines := []string{"", nonRootUserFixComment, "USER " + nonRootUser}
+	return append(append(append([]string{}, lines[:end]...), userLines...), lines[end:]...)
+}
+
+func hasFlag(flags []string, flag string) bool {
+	for _, f := range flags {
+		if f == flag || strings.HasPrefix(f, flag+"=") {
+			return true
+		}
+	}
+	return false
+}
+
+func contains(values []string, value string) bool {
+	return indexOf(values, value) >= 0
+}
+
+func indexOf(values []string, value string) int {
+	for i, v := range values {
+		if v == value {
+			return i
+		}
+	}
+	return -1
+}
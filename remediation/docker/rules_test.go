@@ -0,0 +1,88 @@
+package docker
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDockerfileRules(t *testing.T) {
+	const input = `FROM python@sha256:45b23dee08af5e43a7fea6c4cf9c25ccf269ee113168c19722f87876677c5cb2 AS build
+USER app
+ARG GITHUB_TOKEN
+ARG VERSION=1.0
+ENV API_KEY=abc LOG_LEVEL=info
+ADD https://example.com/tool.tar.gz /tmp/
+ADD --checksum=sha256:24454f830cdb571e2c4ad15481119c43b3cafd48dd869a9b2945d1036d1dc68d https://example.com/verified.tar.gz /tmp/
+RUN curl -fsSL https://example.com/install.sh | sudo bash
+RUN apt-get update && apt-get install -y --no-install-recommends git=1:2.39.2-1.1 curl \
+    ca-certificates
+RUN pip install requests && pip install --require-hashes -r requirements.txt
+RUN python -m pip install flask
+
+FROM build
+RUN ls
+`
+
+	t.Run("findings", func(t *testing.T) {
+		response, err := SecureDockerFile(input)
+		if err != nil {
+			t.Fatalf("Error not expected: %v", err)
+		}
+		if response.IsChanged || response.FinalOutput != input {
+			t.Errorf("findings should not change the Dockerfile")
+		}
+
+		type finding struct {
+			Rule string
+			Line int
+		}
+		got := []finding{}
+		for _, f := range response.Findings {
+			got = append(got, finding{f.Rule, f.Line})
+		}
+		// the final stage inherits USER app from build
+		want := []finding{
+			{RuleSecretInArgOrEnv, 3},
+			{RuleSecretInArgOrEnv, 5},
+			{RuleAddRemoteURL, 6},
+			{RuleCurlPipeShell, 8},
+			{RuleAptGetUnpinned, 9},
+			{RulePipWithoutHashes, 11},
+			{RulePipWithoutHashes, 12},
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("findings = %v, want %v", got, want)
+		}
+		if response.Findings[4].Message != "apt-get install without pinned versions: curl ca-certificates, use <package>=<version>" {
+			t.Errorf("unexpected message %s", response.Findings[4].Message)
+		}
+	})
+
+	t.Run("fix root user", func(t *testing.T) {
+		input := "FROM python@sha256:45b23dee08af5e43a7fea6c4cf9c25ccf269ee113168c19722f87876677c5cb2\nUSER root\nRUN ls\n"
+		want := "FROM python@sha256:45b23dee08af5e43a7fea6c4cf9c25ccf269ee113168c19722f87876677c5cb2\nUSER root\nRUN ls\n\n# run as a non-root user\nUSER 65532:65532\n"
+
+		// the root user is only reported by default, a non-root user may not be able to read the image files
+		response, err := SecureDockerFile(input)
+		if err != nil {
+			t.Fatalf("Error not expected: %v", err)
+		}
+		if len(response.Findings) != 1 || response.Findings[0].Rule != RuleRootUser || response.Findings[0].Line != 3 || response.Findings[0].Fixed {
+			t.Errorf("unexpected findings %v", response.Findings)
+		}
+		if response.IsChanged || response.FinalOutput != input {
+			t.Errorf("USER should not be added by default\n%s", response.FinalOutput)
+		}
+
+		response, err = SecureDockerFile(input, DockerfileConfig{AddNonRootUser: true})
+		if err != nil {
+			t.Fatalf("Error not expected: %v", err)
+		}
+		if len(response.Findings) != 1 || response.Findings[0].Rule != RuleRootUser || !response.Findings[0].Fixed {
+			t.Errorf("unexpected findings %v", response.Findings)
+		}
+		if !response.IsChanged || response.FinalOutput != want {
+			t.Errorf("USER was not added\n%s", response.FinalOutput)
+		}
+	})
+}
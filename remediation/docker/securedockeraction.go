@@ -0,0 +1,68 @@
+package docker
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	metadata "github.com/step-security/secure-repo/remediation/workflow/metadata"
+	"github.com/step-security/secure-repo/remediation/workflow/pin"
+	"gopkg.in/yaml.v3"
+)
+
+type SecureDockerActionResponse struct {
+	OriginalInput string
+	FinalOutput   string
+	IsChanged     bool
+	// DockerfilePath is the Dockerfile referenced by runs.image, relative to action.yml
+	DockerfilePath   string
+	Dockerfile       *SecureDockerfileResponse
+	ActionFetchError bool
+}
+
+// SecureDockerAction hardens a docker action in one call: a docker:// image in runs.image
+// is pinned to a digest, and a Dockerfile referenced by runs.image is secured with SecureDockerFile.
+// getFile returns the contents of a file given its path relative to action.yml.
+func SecureDockerAction(actionYaml string, getFile func(relativePath string) (string, error), opts ...DockerfileConfig) (*SecureDockerActionResponse, error) {
+	action := metadata.Workflow{}
+	err := yaml.Unmarshal([]byte(actionYaml), &action)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse yaml %v", err)
+	}
+
+	response := new(SecureDockerActionResponse)
+	response.OriginalInput = actionYaml
+	response.FinalOutput = actionYaml
+
+	if action.Runs.Using != "docker" || action.Runs.Image == "" {
+		return response, nil
+	}
+
+	if strings.HasPrefix(action.Runs.Image, "docker://") {
+		if len(opts) > 0 && pin.ActionExists(strings.TrimPrefix(action.Runs.Image, "docker://"), opts[0].ExemptedImages) {
+			return response, nil
+		}
+		response.FinalOutput, response.IsChanged, err = pin.PinDocker(actionYaml)
+		if err != nil {
+			return nil, err
+		}
+		return response, nil
+	}
+
+	// runs.image is a Dockerfile relative to action.yml, it must not point outside the action directory
+	response.DockerfilePath = path.Clean(action.Runs.Image)
+	if path.IsAbs(response.DockerfilePath) || response.DockerfilePath == ".." || strings.HasPrefix(response.DockerfilePath, "../") {
+		return nil, fmt.Errorf("Dockerfile %s is outside the action directory", action.Runs.Image)
+	}
+	dockerfile, err := getFile(response.DockerfilePath)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get %s: %v", response.DockerfilePath, err)
+	}
+	response.Dockerfile, err = SecureDockerFile(dockerfile, opts...)
+	if err != nil {
+		return nil, err
+	}
+	response.IsChanged = response.Dockerfile.IsChanged
+
+	return response, nil
+}
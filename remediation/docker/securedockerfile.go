@@ -1,28 +1,89 @@
 package docker
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
 	"net/http"
+	"os"
 	"strings"
 
 	"github.com/asottile/dockerfile"
 	"github.com/google/go-containerregistry/pkg/authn"
 	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
 	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/step-security/secure-repo/remediation/registry"
 	"github.com/step-security/secure-repo/remediation/workflow/pin"
 )
 
 var Tr http.RoundTripper = remote.DefaultTransport
 
+// Keychain resolves registry credentials, see registry.NewKeychain
+var Keychain authn.Keychain = authn.DefaultKeychain
+
 type SecureDockerfileResponse struct {
 	OriginalInput        string
 	FinalOutput          string
 	IsChanged            bool
 	DockerfileFetchError bool
+	// Images has the registry metadata of every image looked up while pinning
+	Images []ImageInfo
+	// Findings are hardening issues other than unpinned images
+	Findings []DockerfileFinding
+	// UnresolvedImages are images that could not be looked up, with the error
+	UnresolvedImages []string
+	// Verifications has the signature and provenance checks of pinned images,
+	// when DockerfileConfig.Verification is set
+	Verifications []registry.VerificationResult
 }
 
 type DockerfileConfig struct {
 	ExemptedImages []string
+	// RequireIndex leaves images that resolve to a single-platform manifest unpinned,
+	// so a Dockerfile is never pinned to one architecture by accident
+	RequireIndex bool
+	// AddNonRootUser fixes the root-user finding by adding USER 65532:65532 to the final stage.
+	// It is off by default, as an image whose runtime files are owned by root breaks as a non-root user.
+	AddNonRootUser bool
+	// SkipArgImages leaves FROM images that depend on build args unpinned and reports them,
+	// so a --build-arg override still selects the image. By default the image the ARG defaults
+	// expand to is pinned, in the ARG default when the ARG holds the whole image reference.
+	SkipArgImages bool
+	// SkipUnresolvableImages leaves images the registry can not resolve unpinned
+	// and reports them in UnresolvedImages, instead of failing the whole file
+	SkipUnresolvableImages bool
+	// Verification, if set, verifies the signatures and provenance of pinned digests
+	Verification *registry.VerificationPolicy
+}
+
+// ImageInfo describes what a pinned digest points to.
+type ImageInfo struct {
+	Image  string
+	Digest string
+	// IsIndex is true when Digest is a multi-platform image index
+	IsIndex bool
+	// Platforms covered by Digest, e.g. linux/amd64 or linux/arm64/v8.
+	// Empty if the platform of a single manifest could not be determined.
+	Platforms []string
+	// Platform is the literal --platform of the FROM instruction, if any
+	Platform string
+	// SkipReason is set when the image was looked up but not pinned
+	SkipReason string
+}
+
+// imageRef is an image referenced by a FROM instruction or a --from flag
+type imageRef struct {
+	// text as written in the Dockerfile
+	text string
+	// image is text with the ARG defaults expanded
+	image    string
+	platform string
+	isFlag   bool
+	// arg is set when the image is a single ARG, e.g. FROM ${BASE_IMAGE},
+	// the digest is then pinned in the ARG default
+	arg string
 }
 
 func SecureDockerFile(inputDockerFile string, opts ...DockerfileConfig) (*SecureDockerfileResponse, error) {
@@ -43,73 +104,407 @@ func SecureDockerFile(inputDockerFile string, opts ...DockerfileConfig) (*Secure
 		exemptedImages = opts[0].ExemptedImages
 	}
 
+	lines := strings.Split(inputDockerFile, "\n")
+	// ARGs declared before the first FROM can be used in FROM instructions
+	args := make(map[string]string)
+	argCmds := make(map[string]dockerfile.Command)
+	seenFrom := false
+	// names of earlier build stages, FROM <stage> is not an image
+	stages := make(map[string]bool)
+	// a stage name is only visible to later FROMs, "FROM node AS node" is an image
+	pendingStage := ""
+	fromFindings := []DockerfileFinding{}
+
 	for _, c := range cmds {
-		if strings.Contains(c.Cmd, "FROM") && strings.Contains(c.Value[0], ":") {
-			// For being fixable
-			// image must have either:
-			// * 1 colon without sha256
-			// * 2 colon with sha256
+		if strings.EqualFold(c.Cmd, "ARG") && !seenFrom {
+			for _, arg := range c.Value {
+				if key, value, ok := cut(arg, "="); ok {
+					args[key] = strings.Trim(value, `"'`)
+					argCmds[key] = c
+				}
+			}
+			continue
+		}
+
+		var refs []imageRef
+		switch {
+		case strings.EqualFold(c.Cmd, "FROM") && len(c.Value) > 0:
+			seenFrom = true
+			if pendingStage != "" {
+				stages[pendingStage] = true
+				pendingStage = ""
+			}
 			temp := c.Value[0]
-			var image string
-			var tag string
-			isPinned := false
+			if len(c.Value) == 3 && strings.EqualFold(c.Value[1], "AS") {
+				pendingStage = strings.ToLower(c.Value[2])
+			}
+			if stages[strings.ToLower(temp)] || strings.EqualFold(temp, "scratch") {
+				continue
+			}
+			image, ok := expandArgs(temp, args)
+			if !ok {
+				message := fmt.Sprintf("FROM %s depends on a build arg without a default and can not be pinned", temp)
+				fromFindings = append(fromFindings, DockerfileFinding{Rule: RuleArgInFrom, Line: c.StartLine, Message: message})
+				continue
+			}
+			if image != temp && len(opts) > 0 && opts[0].SkipArgImages {
+				message := fmt.Sprintf("FROM %s depends on a build arg and is not pinned", temp)
+				fromFindings = append(fromFindings, DockerfileFinding{Rule: RuleArgInFrom, Line: c.StartLine, Message: message})
+				continue
+			}
+			r := imageRef{text: temp, image: image, platform: getPlatformFlag(c.Flags)}
+			if arg, ok := getWholeArg(temp); ok {
+				r.arg = arg
+			}
+			refs = append(refs, r)
+		case strings.EqualFold(c.Cmd, "COPY") || strings.EqualFold(c.Cmd, "RUN"):
+			for _, from := range getFromFlags(c.Flags) {
+				// the current stage can not be used in its own --from
+				if stages[strings.ToLower(from)] || strings.ToLower(from) == pendingStage || isStageIndex(from) || strings.Contains(from, "$") {
+					continue
+				}
+				refs = append(refs, imageRef{text: from, image: from, isFlag: true})
+			}
+		}
 
+		for _, r := range refs {
 			// Check if image is exempted (skip pinning)
-			if len(exemptedImages) > 0 && pin.ActionExists(temp, exemptedImages) {
+			if len(exemptedImages) > 0 && pin.ActionExists(r.image, exemptedImages) {
 				continue
 			}
 
-			if strings.Contains(temp, ":") && !strings.Contains(temp, "sha256") {
-				// case activates if image like: python:3.7
-				split := strings.Split(temp, ":")
-				image = split[0]
-				tag = split[1]
+			if strings.Contains(r.image, "@") {
+				// is already pinned
+				continue
 			}
-			if strings.Count(temp, ":") == 2 && strings.Contains(temp, "sha256") {
 
-				// case activates if image like: python:3.7@sha256:v2
-				t := strings.Split(temp, "@")
-				if len(t[1]) != 71 {
-					tt := strings.Split(t[0], ":")
-					image = tt[0]
-					tag = tt[1]
-				} else {
-					isPinned = true
+			ref, err := name.ParseReference(r.image)
+			var info *ImageInfo
+			if err == nil {
+				info, err = getImageInfo(ref)
+			}
+			if err != nil {
+				if len(opts) > 0 && opts[0].SkipUnresolvableImages {
+					response.UnresolvedImages = append(response.UnresolvedImages, fmt.Sprintf("%s: %v", r.image, err))
+					continue
 				}
+				return nil, err
 			}
-			if strings.Count(temp, ":") == 1 && strings.Contains(temp, "sha256") {
-				// is already pinned
-				isPinned = true
+			info.Image = r.image
+			info.Platform = r.platform
+			if len(opts) > 0 && opts[0].RequireIndex && !info.IsIndex {
+				info.SkipReason = "image is not a multi-platform image index"
+			} else if info.Platform != "" && len(info.Platforms) > 0 && !hasPlatform(info.Platforms, info.Platform) {
+				info.SkipReason = fmt.Sprintf("image is not available for platform %s", info.Platform)
+			}
+			response.Images = append(response.Images, *info)
+			if info.SkipReason != "" {
+				continue
+			}
+
+			if len(opts) > 0 && opts[0].Verification != nil {
+				verification := registry.VerifyImage(ref.Context().Digest(info.Digest), *opts[0].Verification, remote.WithAuthFromKeychain(Keychain), remote.WithTransport(Tr))
+				verification.Image = r.image
+				response.Verifications = append(response.Verifications, verification)
 			}
 
-			if !isPinned {
-				sha, err := getSHA(image, tag)
-				if err != nil {
-					return nil, err
+			if r.arg != "" {
+				// later FROMs of the same ARG expand to the pinned image
+				if pinArgDefault(lines, argCmds[r.arg], r.arg, args[r.arg], info.Digest) {
+					args[r.arg] += "@" + info.Digest
+					response.IsChanged = true
 				}
-				new_cmd := strings.ReplaceAll(c.Original, c.Value[0], fmt.Sprintf("%s:%s@%s", image, tag, sha))
-				response.FinalOutput = strings.ReplaceAll(response.FinalOutput, c.Original, new_cmd)
-				// Revert the extra hash for already pinned docker images
-				response.FinalOutput = strings.ReplaceAll(response.FinalOutput, new_cmd+"@", c.Original+"@")
-				response.IsChanged = true
+				continue
+			}
 
+			// the image is kept as written and only the digest is added,
+			// for an image with build args to the expanded reference, e.g. node:${NODE_VERSION}@<digest>
+			for i := c.StartLine - 1; i < c.EndLine && i < len(lines); i++ {
+				var column int
+				if r.isFlag {
+					column = findFlagColumn(lines[i], r.text)
+				} else {
+					column = findImageColumn(lines[i], r.text)
+				}
+				if column >= 0 {
+					column += len(r.text)
+					lines[i] = lines[i][:column] + "@" + info.Digest + lines[i][column:]
+					response.IsChanged = true
+					break
+				}
 			}
+		}
+	}
 
+	var ruleFindings []DockerfileFinding
+	ruleFindings, lines = checkRules(cmds, lines, len(opts) > 0 && opts[0].AddNonRootUser)
+	response.Findings = append(fromFindings, ruleFindings...)
+	for _, finding := range response.Findings {
+		if finding.Fixed {
+			response.IsChanged = true
 		}
 	}
 
+	response.FinalOutput = strings.Join(lines, "\n")
+
 	return response, nil
 }
-func getSHA(image string, tag string) (string, error) {
 
+func getSHA(image string, tag string) (string, error) {
 	ref, err := name.ParseReference(image, name.WithDefaultTag(tag))
 	if err != nil {
 		return "", err
 	}
-	desc, err := remote.Get(ref, remote.WithAuthFromKeychain(authn.DefaultKeychain), remote.WithTransport(Tr))
-
+	info, err := getImageInfo(ref)
 	if err != nil {
 		return "", err
 	}
-	return desc.Digest.String(), nil
+	return info.Digest, nil
+}
+
+// GetImageDigest returns the digest the registry serves for image, e.g. python:3.7.
+// For multi-platform images this is the digest of the index.
+func GetImageDigest(image string) (string, error) {
+	// an image without a tag resolves to latest, as docker does
+	return getSHA(image, "latest")
+}
+
+// getImageInfo resolves ref to the digest the registry serves for it
+// and lists the platforms that digest covers.
+func getImageInfo(ref name.Reference) (*ImageInfo, error) {
+
+	desc, err := remote.Get(ref, remote.WithAuthFromKeychain(Keychain), remote.WithTransport(Tr))
+
+	if err != nil {
+		return nil, err
+	}
+
+	info := &ImageInfo{Digest: desc.Digest.String()}
+
+	// some registries do not set Content-Type, so fall back to the manifest itself
+	mediaType := desc.MediaType
+	var manifest struct {
+		MediaType types.MediaType   `json:"mediaType"`
+		Manifests []json.RawMessage `json:"manifests"`
+	}
+	if err := json.Unmarshal(desc.Manifest, &manifest); err == nil {
+		if mediaType == "" {
+			mediaType = manifest.MediaType
+		}
+		if mediaType == "" && manifest.Manifests != nil {
+			mediaType = types.OCIImageIndex
+		}
+	}
+
+	if mediaType.IsIndex() {
+		info.IsIndex = true
+		indexManifest, err := v1.ParseIndexManifest(bytes.NewReader(desc.Manifest))
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range indexManifest.Manifests {
+			if m.Platform == nil || m.Platform.OS == "unknown" {
+				// attestation manifests are listed with an unknown platform
+				continue
+			}
+			info.Platforms = append(info.Platforms, platformString(m.Platform.OS, m.Platform.Architecture, m.Platform.Variant))
+		}
+		return info, nil
+	}
+
+	// a single manifest only records its platform in the config blob;
+	// failing to fetch it should not stop the image from being pinned
+	img, err := desc.Image()
+	if err != nil {
+		return info, nil
+	}
+	config, err := img.ConfigFile()
+	if err != nil || config.OS == "" {
+		return info, nil
+	}
+	info.Platforms = []string{platformString(config.OS, config.Architecture, "")}
+	return info, nil
+}
+
+func platformString(os, architecture, variant string) string {
+	platform := os + "/" + architecture
+	if variant != "" {
+		platform += "/" + variant
+	}
+	return platform
+}
+
+// getPlatformFlag returns the value of --platform if it is a literal,
+// build args such as $BUILDPLATFORM are only known at build time.
+func getPlatformFlag(flags []string) string {
+	for _, flag := range flags {
+		if strings.HasPrefix(flag, "--platform=") {
+			platform := strings.TrimPrefix(flag, "--platform=")
+			if strings.Contains(platform, "$") {
+				return ""
+			}
+			return platform
+		}
+	}
+	return ""
+}
+
+// hasPlatform reports whether platform is in platforms, where
+// linux/arm64 matches linux/arm64/v8 as docker does.
+func hasPlatform(platforms []string, platform string) bool {
+	for _, p := range platforms {
+		if p == platform || strings.HasPrefix(p, platform+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// expandArgs substitutes $VAR and ${VAR} using ARG defaults.
+// It returns false if a variable has no default.
+func expandArgs(value string, args map[string]string) (string, bool) {
+	resolved := true
+	expanded := os.Expand(value, func(key string) string {
+		if v, ok := args[key]; ok {
+			return v
+		}
+		resolved = false
+		return ""
+	})
+	return expanded, resolved
+}
+
+// getWholeArg returns the ARG an image consists of, e.g. BASE_IMAGE for $BASE_IMAGE or ${BASE_IMAGE}
+func getWholeArg(image string) (string, bool) {
+	if !strings.HasPrefix(image, "$") {
+		return "", false
+	}
+	arg := strings.TrimPrefix(image, "$")
+	if strings.HasPrefix(arg, "{") && strings.HasSuffix(arg, "}") {
+		arg = arg[1 : len(arg)-1]
+	}
+	if arg == "" {
+		return "", false
+	}
+	for _, c := range arg {
+		if c != '_' && (c < 'a' || c > 'z') && (c < 'A' || c > 'Z') && (c < '0' || c > '9') {
+			return "", false
+		}
+	}
+	return arg, true
+}
+
+// pinArgDefault adds digest to the default value of arg in the ARG instruction cmd,
+// inside the quotes if the value is quoted
+func pinArgDefault(lines []string, cmd dockerfile.Command, arg, value, digest string) bool {
+	for i := cmd.StartLine - 1; i < cmd.EndLine && i < len(lines); i++ {
+		column := findArgColumn(lines[i], arg)
+		if column < 0 {
+			continue
+		}
+		if column < len(lines[i]) && (lines[i][column] == '"' || lines[i][column] == '\'') {
+			column++
+		}
+		column += len(value)
+		if column > len(lines[i]) {
+			return false
+		}
+		lines[i] = lines[i][:column] + "@" + digest + lines[i][column:]
+		return true
+	}
+	return false
+}
+
+// findArgColumn returns the index of the default value of arg on an ARG line
+func findArgColumn(line, arg string) int {
+	offset := 0
+	for {
+		i := strings.Index(line[offset:], arg+"=")
+		if i < 0 {
+			return -1
+		}
+		i += offset
+		if i == 0 || isSpace(line[i-1]) {
+			return i + len(arg) + 1
+		}
+		offset = i + 1
+	}
+}
+
+// getFromFlags returns the images or stages in COPY --from=<ref> and
+// RUN --mount=type=...,from=<ref> flags.
+func getFromFlags(flags []string) []string {
+	var from []string
+	for _, flag := range flags {
+		if strings.HasPrefix(flag, "--from=") {
+			from = append(from, strings.TrimPrefix(flag, "--from="))
+		} else if strings.HasPrefix(flag, "--mount=") {
+			for _, option := range strings.Split(strings.TrimPrefix(flag, "--mount="), ",") {
+				if key, value, ok := cut(option, "="); ok && key == "from" {
+					from = append(from, value)
+				}
+			}
+		}
+	}
+	return from
+}
+
+// isStageIndex reports whether from refers to a build stage by number, e.g. --from=0
+func isStageIndex(from string) bool {
+	if from == "" {
+		return false
+	}
+	for _, c := range from {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// findFlagColumn returns the index of image in a from=<image> flag on line
+func findFlagColumn(line, image string) int {
+	offset := 0
+	for {
+		i := strings.Index(line[offset:], "from="+image)
+		if i < 0 {
+			return -1
+		}
+		i += offset + len("from=")
+		end := i + len(image)
+		if end == len(line) || line[end] == ',' || isSpace(line[end]) {
+			return i
+		}
+		offset = i
+	}
+}
+
+// findImageColumn returns the index of image in a FROM line, where image
+// is a whole word so that e.g. a --platform value is not matched.
+func findImageColumn(line, image string) int {
+	offset := 0
+	for {
+		i := strings.Index(line[offset:], image)
+		if i < 0 {
+			return -1
+		}
+		i += offset
+		end := i + len(image)
+		if (i == 0 || isSpace(line[i-1])) && (end == len(line) || isSpace(line[end])) {
+			return i
+		}
+		offset = i + 1
+	}
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\r'
+}
+
+// cut is strings.Cut, which needs a newer go
+func cut(s, sep string) (before, after string, found bool) {
+	if i := strings.Index(s, sep); i >= 0 {
+		return s[:i], s[i+len(sep):], true
+	}
+	return s, "", false
 }
@@ -3,10 +3,14 @@ package docker
 import (
 	"io/ioutil"
 	"log"
+	"net/http"
 	"path"
+	"reflect"
+	"strings"
 	"testing"
 
 	"github.com/jarcoal/httpmock"
+	"github.com/step-security/secure-repo/remediation/registry"
 )
 
 var resp = httpmock.File("../../testfiles/dockerfiles/response.json").String()
@@ -47,6 +51,13 @@ func TestSecureDockerFile(t *testing.T) {
 	}`))
 	httpmock.RegisterResponder("GET", "https://public.ecr.aws/v2/amazonlinux/amazonlinux/manifests/2023", httpmock.NewStringResponder(200, resp))
 
+	httpmock.RegisterResponder("GET", "https://index.docker.io/v2/library/node/manifests/20", httpmock.NewStringResponder(200, resp))
+	httpmock.RegisterResponder("GET", "https://index.docker.io/v2/library/golang/manifests/1.21", httpmock.NewStringResponder(200, resp))
+	httpmock.RegisterResponder("GET", "https://registry.example.com:5000/v2/",
+		httpmock.NewStringResponder(200, `{
+	}`))
+	httpmock.RegisterResponder("GET", "https://registry.example.com:5000/v2/app/manifests/1.2", httpmock.NewStringResponder(200, resp))
+
 	tests := []struct {
 		fileName        string
 		isChanged       bool
@@ -60,6 +71,8 @@ func TestSecureDockerFile(t *testing.T) {
 		{fileName: "Dockerfile-exempted-wildcard", isChanged: true, exemptedImages: []string{"amazon*", "alpine:*"}, useExemptConfig: true},
 		{fileName: "Dockerfile-imageandtag-exempted", isChanged: true, exemptedImages: []string{"amazonlinux:2"}, useExemptConfig: true},
 		{fileName: "Dockerfile-imageandtag-exempted-2", isChanged: true, exemptedImages: []string{"public.ecr.aws/amazonlinux/amazonlinux:2023"}, useExemptConfig: true},
+		{fileName: "Dockerfile-args-and-stages", isChanged: true, useExemptConfig: false},
+		{fileName: "Dockerfile-copy-from", isChanged: true, useExemptConfig: false},
 	}
 
 	for _, test := range tests {
@@ -150,3 +163,183 @@ func Test_getSHA(t *testing.T) {
 		})
 	}
 }
+
+func TestSecureDockerFileMultiArch(t *testing.T) {
+
+	const inputDirectory = "../../testfiles/dockerfiles/input"
+	const outputDirectory = "../../testfiles/dockerfiles/output"
+
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	saveTr := Tr
+	defer func() { Tr = saveTr }()
+	Tr = httpmock.DefaultTransport
+
+	indexResp := httpmock.File("../../testfiles/dockerfiles/index-response.json").String()
+
+	httpmock.RegisterResponder("GET", "https://index.docker.io/v2/",
+		httpmock.NewStringResponder(200, `{
+	}`))
+	httpmock.RegisterResponder("GET", "https://index.docker.io/v2/library/golang/manifests/1.21", func(req *http.Request) (*http.Response, error) {
+		resp := httpmock.NewStringResponse(200, indexResp)
+		resp.Header.Set("Content-Type", "application/vnd.oci.image.index.v1+json")
+		return resp, nil
+	})
+	httpmock.RegisterResponder("GET", "https://index.docker.io/v2/library/python/manifests/3.7", httpmock.NewStringResponder(200, resp))
+
+	t.Run("platform flags", func(t *testing.T) {
+		input, err := ioutil.ReadFile(path.Join(inputDirectory, "Dockerfile-platform"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		output, err := SecureDockerFile(string(input))
+		if err != nil {
+			t.Fatalf("Error not expected: %s", err)
+		}
+		expectedOutput, err := ioutil.ReadFile(path.Join(outputDirectory, "Dockerfile-platform"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(expectedOutput) != output.FinalOutput {
+			t.Errorf("test failed Dockerfile-platform did not match expected output\n%s", output.FinalOutput)
+		}
+
+		if len(output.Images) != 3 {
+			t.Fatalf("expected 3 images, got %d", len(output.Images))
+		}
+		wantPlatforms := []string{"linux/amd64", "linux/arm64/v8"}
+		for _, image := range output.Images {
+			if !image.IsIndex || !reflect.DeepEqual(image.Platforms, wantPlatforms) {
+				t.Errorf("unexpected image info %+v", image)
+			}
+		}
+		if output.Images[0].Platform != "linux/arm64" || output.Images[0].SkipReason != "" {
+			t.Errorf("linux/arm64 should be pinned %+v", output.Images[0])
+		}
+		if output.Images[1].Platform != "" || output.Images[1].SkipReason != "" {
+			t.Errorf("$BUILDPLATFORM should be ignored %+v", output.Images[1])
+		}
+		if output.Images[2].SkipReason == "" {
+			t.Errorf("linux/s390x should not be pinned %+v", output.Images[2])
+		}
+	})
+
+	t.Run("require index", func(t *testing.T) {
+		input, err := ioutil.ReadFile(path.Join(inputDirectory, "Dockerfile-not-pinned"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		output, err := SecureDockerFile(string(input), DockerfileConfig{RequireIndex: true})
+		if err != nil {
+			t.Fatalf("Error not expected: %s", err)
+		}
+		if output.IsChanged || output.FinalOutput != string(input) {
+			t.Errorf("single-platform manifest should not be pinned\n%s", output.FinalOutput)
+		}
+		if len(output.Images) != 1 || output.Images[0].IsIndex || output.Images[0].SkipReason == "" {
+			t.Errorf("unexpected image info %+v", output.Images)
+		}
+	})
+}
+
+func TestSecureDockerFileSkipUnresolvableImages(t *testing.T) {
+
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	saveTr := Tr
+	defer func() { Tr = saveTr }()
+	Tr = httpmock.DefaultTransport
+
+	httpmock.RegisterResponder("GET", "https://index.docker.io/v2/",
+		httpmock.NewStringResponder(200, `{
+	}`))
+	httpmock.RegisterResponder("GET", "https://index.docker.io/v2/library/python/manifests/3.7", httpmock.NewStringResponder(200, resp))
+	httpmock.RegisterResponder("GET", "https://index.docker.io/v2/private/app/manifests/1.0", httpmock.NewStringResponder(401, `{"errors":[{"code":"UNAUTHORIZED"}]}`))
+
+	input := "FROM private/app:1.0 AS build\nRUN make\n\nFROM python:3.7\nUSER app\n"
+	want := "FROM private/app:1.0 AS build\nRUN make\n\nFROM python:3.7@sha256:5fb6f4b9d73ddeb0e431c938bee25c69157a1e3c880a81ff72c43a8055628de5\nUSER app\n"
+
+	if _, err := SecureDockerFile(input); err == nil {
+		t.Errorf("expected error for unresolvable image")
+	}
+
+	output, err := SecureDockerFile(input, DockerfileConfig{SkipUnresolvableImages: true})
+	if err != nil {
+		t.Fatalf("Error not expected: %s", err)
+	}
+	if output.FinalOutput != want {
+		t.Errorf("resolvable images should still be pinned\n%s", output.FinalOutput)
+	}
+	if len(output.UnresolvedImages) != 1 || !strings.HasPrefix(output.UnresolvedImages[0], "private/app:1.0: ") {
+		t.Errorf("unexpected UnresolvedImages %v", output.UnresolvedImages)
+	}
+
+	// an image reference that does not parse is skipped the same way
+	invalid := "FROM Private/App:1.0\nUSER app\n"
+	if _, err := SecureDockerFile(invalid); err == nil {
+		t.Errorf("expected error for invalid image reference")
+	}
+	output, err = SecureDockerFile(invalid, DockerfileConfig{SkipUnresolvableImages: true})
+	if err != nil {
+		t.Fatalf("Error not expected: %s", err)
+	}
+	if output.IsChanged || len(output.UnresolvedImages) != 1 || !strings.HasPrefix(output.UnresolvedImages[0], "Private/App:1.0: ") {
+		t.Errorf("unexpected output %v, UnresolvedImages %v", output.FinalOutput, output.UnresolvedImages)
+	}
+}
+
+func TestSecureDockerFileArgInFrom(t *testing.T) {
+	input := "ARG NODE_VERSION=20\nARG BASE_IMAGE\nFROM node:${NODE_VERSION} AS build\nRUN npm ci\n\nFROM ${BASE_IMAGE}\nUSER app\n"
+
+	// no registry is called, images that depend on build args are reported instead of pinned
+	output, err := SecureDockerFile(input, DockerfileConfig{SkipArgImages: true})
+	if err != nil {
+		t.Fatalf("Error not expected: %s", err)
+	}
+	if output.IsChanged || output.FinalOutput != input {
+		t.Errorf("expected no change, got\n%s", output.FinalOutput)
+	}
+	want := []DockerfileFinding{
+		{Rule: RuleArgInFrom, Line: 3, Message: "FROM node:${NODE_VERSION} depends on a build arg and is not pinned"},
+		{Rule: RuleArgInFrom, Line: 6, Message: "FROM ${BASE_IMAGE} depends on a build arg without a default and can not be pinned"},
+	}
+	if len(output.Findings) != len(want) {
+		t.Fatalf("got findings %v, want %v", output.Findings, want)
+	}
+	for i := range want {
+		if output.Findings[i] != want[i] {
+			t.Errorf("finding %d = %+v, want %+v", i, output.Findings[i], want[i])
+		}
+	}
+}
+
+func TestSecureDockerFileVerification(t *testing.T) {
+
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	saveTr := Tr
+	defer func() { Tr = saveTr }()
+	Tr = httpmock.DefaultTransport
+
+	httpmock.RegisterResponder("GET", "https://index.docker.io/v2/",
+		httpmock.NewStringResponder(200, `{
+	}`))
+	httpmock.RegisterResponder("GET", "https://index.docker.io/v2/library/python/manifests/3.7", httpmock.NewStringResponder(200, resp))
+	// no .sig tag for the digest
+	httpmock.RegisterNoResponder(httpmock.NewStringResponder(404, `{"errors":[{"code":"MANIFEST_UNKNOWN"}]}`))
+
+	output, err := SecureDockerFile("FROM python:3.7\nUSER app\n", DockerfileConfig{Verification: &registry.VerificationPolicy{}})
+	if err != nil {
+		t.Fatalf("Error not expected: %s", err)
+	}
+	if !output.IsChanged {
+		t.Errorf("unsigned images should still be pinned")
+	}
+	want := "python:3.7@sha256:5fb6f4b9d73ddeb0e431c938bee25c69157a1e3c880a81ff72c43a8055628de5: image is not signed"
+	if len(output.Verifications) != 1 || output.Verifications[0].String() != want {
+		t.Errorf("unexpected Verifications %v", output.Verifications)
+	}
+}
@@ -0,0 +1,149 @@
+package manifest
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/step-security/secure-repo/remediation/docker"
+	metadata "github.com/step-security/secure-repo/remediation/workflow/metadata"
+	"github.com/step-security/secure-repo/remediation/workflow/pin"
+	"gopkg.in/yaml.v3"
+)
+
+type SecureManifestResponse struct {
+	OriginalInput string
+	FinalOutput   string
+	IsChanged     bool
+	// UnresolvedImages are images that could not be looked up, with the error
+	UnresolvedImages   []string
+	ManifestFetchError bool
+}
+
+type ManifestConfig struct {
+	ExemptedImages []string
+	// SkipUnresolvableImages leaves images the registry can not resolve unpinned
+	// and reports them in UnresolvedImages, instead of failing the whole file
+	SkipUnresolvableImages bool
+}
+
+// podSpecPaths is where the pod spec is for each Kubernetes kind
+var podSpecPaths = map[string][]string{
+	"Pod":         {"spec"},
+	"Deployment":  {"spec", "template", "spec"},
+	"StatefulSet": {"spec", "template", "spec"},
+	"DaemonSet":   {"spec", "template", "spec"},
+	"ReplicaSet":  {"spec", "template", "spec"},
+	"Job":         {"spec", "template", "spec"},
+	"CronJob":     {"spec", "jobTemplate", "spec", "template", "spec"},
+}
+
+// SecureManifest pins the images in a docker-compose file (services.*.image) or in
+// Kubernetes manifests (containers and initContainers of workloads) to digests.
+// The tag is appended to the comment on the image line. A file may hold multiple Kubernetes documents.
+func SecureManifest(input string, opts ...ManifestConfig) (*SecureManifestResponse, error) {
+	response := new(SecureManifestResponse)
+	response.OriginalInput = input
+	response.FinalOutput = input
+
+	var exemptedImages []string
+	if len(opts) > 0 {
+		exemptedImages = opts[0].ExemptedImages
+	}
+
+	var imageNodes []*yaml.Node
+	decoder := yaml.NewDecoder(strings.NewReader(input))
+	for {
+		doc := yaml.Node{}
+		err := decoder.Decode(&doc)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse yaml %v", err)
+		}
+		if len(doc.Content) == 0 {
+			continue
+		}
+		imageNodes = append(imageNodes, getImageNodes(doc.Content[0])...)
+	}
+
+	lines := strings.Split(input, "\n")
+	for _, imageNode := range imageNodes {
+		image := imageNode.Value
+		if image == "" || strings.Contains(image, "@") || strings.Contains(image, "$") {
+			// already pinned, or set through variables
+			continue
+		}
+
+		if len(exemptedImages) > 0 && pin.ActionExists(image, exemptedImages) {
+			continue
+		}
+
+		digest, err := docker.GetImageDigest(image)
+		if err != nil {
+			if len(opts) > 0 && opts[0].SkipUnresolvableImages {
+				response.UnresolvedImages = append(response.UnresolvedImages, fmt.Sprintf("%s: %v", image, err))
+				continue
+			}
+			return nil, err
+		}
+
+		repository, tag := pin.SplitImageTag(image)
+		lineNum := imageNode.Line - 1
+		column := imageNode.Column - 1
+		line := lines[lineNum]
+		line = line[:column] + strings.Replace(line[column:], image, repository+"@"+digest, 1)
+		lines[lineNum] = pin.AppendLineComment(line, column, tag)
+		response.IsChanged = true
+	}
+
+	response.FinalOutput = strings.Join(lines, "\n")
+	return response, nil
+}
+
+// getImageNodes returns the image nodes of a compose file or of a Kubernetes workload
+func getImageNodes(root *yaml.Node) []*yaml.Node {
+	var imageNodes []*yaml.Node
+
+	kindNode := metadata.GetMappingValue(root, "kind")
+	if kindNode == nil {
+		// docker-compose
+		servicesNode := metadata.GetMappingValue(root, "services")
+		if servicesNode == nil || servicesNode.Kind != yaml.MappingNode {
+			return nil
+		}
+		for i := 1; i < len(servicesNode.Content); i += 2 {
+			if imageNode := metadata.GetMappingValue(servicesNode.Content[i], "image"); imageNode != nil && imageNode.Kind == yaml.ScalarNode {
+				imageNodes = append(imageNodes, imageNode)
+			}
+		}
+		return imageNodes
+	}
+
+	path, ok := podSpecPaths[kindNode.Value]
+	if !ok {
+		return nil
+	}
+	podSpec := root
+	for _, key := range path {
+		podSpec = metadata.GetMappingValue(podSpec, key)
+		if podSpec == nil {
+			return nil
+		}
+	}
+
+	for _, key := range []string{"initContainers", "containers"} {
+		containersNode := metadata.GetMappingValue(podSpec, key)
+		if containersNode == nil || containersNode.Kind != yaml.SequenceNode {
+			continue
+		}
+		for _, containerNode := range containersNode.Content {
+			if imageNode := metadata.GetMappingValue(containerNode, "image"); imageNode != nil && imageNode.Kind == yaml.ScalarNode {
+				imageNodes = append(imageNodes, imageNode)
+			}
+		}
+	}
+	return imageNodes
+}
@@ -0,0 +1,71 @@
+package manifest
+
+import (
+	"io/ioutil"
+	"path"
+	"testing"
+
+	"github.com/jarcoal/httpmock"
+	"github.com/step-security/secure-repo/remediation/docker"
+)
+
+var resp = httpmock.File("../../testfiles/dockerfiles/response.json").String()
+
+func TestSecureManifest(t *testing.T) {
+
+	const inputDirectory = "../../testfiles/manifests/input"
+	const outputDirectory = "../../testfiles/manifests/output"
+
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	saveTr := docker.Tr
+	defer func() { docker.Tr = saveTr }()
+	docker.Tr = httpmock.DefaultTransport
+
+	httpmock.RegisterResponder("GET", "https://index.docker.io/v2/",
+		httpmock.NewStringResponder(200, `{
+	}`))
+	httpmock.RegisterResponder("GET", "https://registry.example.com:5000/v2/",
+		httpmock.NewStringResponder(200, `{
+	}`))
+
+	httpmock.RegisterResponder("GET", "https://index.docker.io/v2/library/python/manifests/3.7", httpmock.NewStringResponder(200, resp))
+	httpmock.RegisterResponder("GET", "https://index.docker.io/v2/library/python/manifests/latest", httpmock.NewStringResponder(200, resp))
+	httpmock.RegisterResponder("GET", "https://index.docker.io/v2/library/amazonlinux/manifests/2", httpmock.NewStringResponder(200, resp))
+	httpmock.RegisterResponder("GET", "https://registry.example.com:5000/v2/app/manifests/1.2", httpmock.NewStringResponder(200, resp))
+
+	tests := []struct {
+		fileName       string
+		isChanged      bool
+		exemptedImages []string
+	}{
+		{fileName: "docker-compose.yml", isChanged: true, exemptedImages: []string{"amazonlinux:*"}},
+		{fileName: "kubernetes.yml", isChanged: true},
+	}
+
+	for _, test := range tests {
+		input, err := ioutil.ReadFile(path.Join(inputDirectory, test.fileName))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		output, err := SecureManifest(string(input), ManifestConfig{ExemptedImages: test.exemptedImages})
+		if err != nil {
+			t.Fatalf("Error not expected: %s", err)
+		}
+
+		expectedOutput, err := ioutil.ReadFile(path.Join(outputDirectory, test.fileName))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(expectedOutput) != output.FinalOutput {
+			t.Errorf("test failed %s did not match expected output\n%s", test.fileName, output.FinalOutput)
+		}
+
+		if output.IsChanged != test.isChanged {
+			t.Errorf("test failed %s did not match IsChanged, Expected: %v Got: %v", test.fileName, test.isChanged, output.IsChanged)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package registry
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/google/go-containerregistry/pkg/authn"
+)
+
+const githubContainerRegistry = "ghcr.io"
+
+// ecrRegistryRegex matches <account>.dkr.ecr.<region>.amazonaws.com
+var ecrRegistryRegex = regexp.MustCompile(`^[0-9]+\.dkr\.ecr(-fips)?\.([a-z0-9-]+)\.amazonaws\.com(\.cn)?$`)
+
+// BasicAuth is a username and password for a registry. For Google Artifact Registry
+// use username oauth2accesstoken with an access token, or _json_key with a service account key.
+type BasicAuth struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+type AuthConfig struct {
+	// Registries maps a registry host, e.g. us-docker.pkg.dev, to its credentials
+	Registries map[string]BasicAuth `json:"registries"`
+	// GitHubToken is used for ghcr.io
+	GitHubToken string `json:"-"`
+	// AWSSession is used to get tokens for private ECR registries
+	AWSSession *session.Session `json:"-"`
+}
+
+// LoadAuthConfig reads static registry credentials from the REGISTRY_CREDENTIALS
+// environment variable (JSON of AuthConfig) and the GitHub token from SECURE_REPO_PAT or PAT.
+func LoadAuthConfig(sess *session.Session) (AuthConfig, error) {
+	config := AuthConfig{}
+	if credentials := os.Getenv("REGISTRY_CREDENTIALS"); credentials != "" {
+		if err := json.Unmarshal([]byte(credentials), &config); err != nil {
+			return config, fmt.Errorf("unable to parse REGISTRY_CREDENTIALS: %v", err)
+		}
+	}
+
+	config.GitHubToken = os.Getenv("SECURE_REPO_PAT")
+	if config.GitHubToken == "" {
+		config.GitHubToken = os.Getenv("PAT")
+	}
+	config.AWSSession = sess
+	return config, nil
+}
+
+// NewKeychain returns a keychain that resolves credentials from config,
+// and falls back to authn.DefaultKeychain (~/.docker/config.json) for other registries.
+func NewKeychain(config AuthConfig) authn.Keychain {
+	k := &keychain{config: config, ecrTokens: make(map[string]*authn.AuthConfig)}
+	if config.AWSSession != nil {
+		k.getECRToken = func(region string) (string, error) {
+			svc := ecr.New(config.AWSSession, aws.NewConfig().WithRegion(region))
+			output, err := svc.GetAuthorizationToken(&ecr.GetAuthorizationTokenInput{})
+			if err != nil {
+				return "", err
+			}
+			if len(output.AuthorizationData) == 0 {
+				return "", fmt.Errorf("no ECR authorization data for region %s", region)
+			}
+			return aws.StringValue(output.AuthorizationData[0].AuthorizationToken), nil
+		}
+	}
+	return k
+}
+
+type keychain struct {
+	config AuthConfig
+	// getECRToken returns the base64 encoded user:password token for region
+	getECRToken func(region string) (string, error)
+
+	mu        sync.Mutex
+	ecrTokens map[string]*authn.AuthConfig
+}
+
+func (k *keychain) Resolve(target authn.Resource) (authn.Authenticator, error) {
+	registry := target.RegistryStr()
+
+	if auth, ok := k.config.Registries[registry]; ok {
+		return authn.FromConfig(authn.AuthConfig{Username: auth.Username, Password: auth.Password}), nil
+	}
+
+	if registry == githubContainerRegistry && k.config.GitHubToken != "" {
+		// ghcr.io exchanges the PAT for a bearer token, the username is not checked
+		return authn.FromConfig(authn.AuthConfig{Username: "x-access-token", Password: k.config.GitHubToken}), nil
+	}
+
+	if matches := ecrRegistryRegex.FindStringSubmatch(registry); matches != nil && k.getECRToken != nil {
+		auth, err := k.resolveECR(matches[2])
+		if err != nil {
+			return nil, err
+		}
+		return authn.FromConfig(*auth), nil
+	}
+
+	return authn.DefaultKeychain.Resolve(target)
+}
+
+func (k *keychain) resolveECR(region string) (*authn.AuthConfig, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	// tokens are valid for 12 hours, longer than a lambda invocation
+	if auth, ok := k.ecrTokens[region]; ok {
+		return auth, nil
+	}
+
+	token, err := k.getECRToken(region)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get ECR token for %s: %v", region, err)
+	}
+	decoded, err := base64.StdEncoding.DecodeString(token)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode ECR token: %v", err)
+	}
+	userAndPassword := strings.SplitN(string(decoded), ":", 2)
+	if len(userAndPassword) != 2 {
+		return nil, fmt.Errorf("unexpected ECR token format")
+	}
+
+	auth := &authn.AuthConfig{Username: userAndPassword[0], Password: userAndPassword[1]}
+	k.ecrTokens[region] = auth
+	return auth, nil
+}
@@ -0,0 +1,70 @@
+package registry
+
+import (
+	"encoding/base64"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+)
+
+func TestKeychain(t *testing.T) {
+	calls := 0
+	k := NewKeychain(AuthConfig{
+		Registries:  map[string]BasicAuth{"us-docker.pkg.dev": {Username: "oauth2accesstoken", Password: "gar-token"}},
+		GitHubToken: "ghp_token",
+	}).(*keychain)
+	k.getECRToken = func(region string) (string, error) {
+		calls++
+		if region != "us-west-2" {
+			t.Errorf("unexpected region %s", region)
+		}
+		return base64.StdEncoding.EncodeToString([]byte("AWS:ecr-password")), nil
+	}
+
+	tests := []struct {
+		image    string
+		username string
+		password string
+	}{
+		{image: "us-docker.pkg.dev/project/repo/app:1.0", username: "oauth2accesstoken", password: "gar-token"},
+		{image: "ghcr.io/step-security/app:1.0", username: "x-access-token", password: "ghp_token"},
+		{image: "123456789012.dkr.ecr.us-west-2.amazonaws.com/app:1.0", username: "AWS", password: "ecr-password"},
+		{image: "123456789012.dkr.ecr.us-west-2.amazonaws.com/other:1.0", username: "AWS", password: "ecr-password"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.image, func(t *testing.T) {
+			ref, err := name.ParseReference(tt.image)
+			if err != nil {
+				t.Fatal(err)
+			}
+			authenticator, err := k.Resolve(ref.Context())
+			if err != nil {
+				t.Fatalf("Error not expected: %v", err)
+			}
+			auth, err := authenticator.Authorization()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if auth.Username != tt.username || auth.Password != tt.password {
+				t.Errorf("got %s:%s, want %s:%s", auth.Username, auth.Password, tt.username, tt.password)
+			}
+		})
+	}
+
+	if calls != 1 {
+		t.Errorf("ECR token should be cached, got %d calls", calls)
+	}
+
+	// other registries fall back to the default keychain
+	ref, _ := name.ParseReference("python:3.7")
+	authenticator, err := k.Resolve(ref.Context())
+	if err != nil {
+		t.Fatalf("Error not expected: %v", err)
+	}
+	if authenticator != authn.Anonymous {
+		if auth, _ := authenticator.Authorization(); auth.Username != "" || auth.Password != "" {
+			t.Errorf("unexpected credentials for docker.io")
+		}
+	}
+}
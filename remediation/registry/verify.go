@@ -0,0 +1,542 @@
+package registry
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+	"github.com/secure-systems-lab/go-securesystemslib/dsse"
+	"github.com/sigstore/sigstore-go/pkg/bundle"
+	"github.com/sigstore/sigstore-go/pkg/root"
+	"github.com/sigstore/sigstore-go/pkg/tlog"
+	"github.com/sigstore/sigstore-go/pkg/tuf"
+	"github.com/sigstore/sigstore-go/pkg/verify"
+	"github.com/sigstore/sigstore/pkg/cryptoutils"
+	"github.com/sigstore/sigstore/pkg/signature"
+)
+
+// annotations cosign sets on the layers of .sig and .att images
+const (
+	signatureAnnotation   = "dev.cosignproject.cosign/signature"
+	certificateAnnotation = "dev.sigstore.cosign/certificate"
+	bundleAnnotation      = "dev.sigstore.cosign/bundle"
+)
+
+// Identity is a trusted signer, either keyless (a Fulcio certificate issued
+// for an OIDC identity) or a public key.
+type Identity struct {
+	// Name is reported for images signed by this identity, e.g. "Docker Official Images"
+	Name string `json:"name"`
+	// Issuer and SubjectRegExp match the certificate of keyless signatures. For GitHub Actions
+	// the issuer is https://token.actions.githubusercontent.com and the subject is the workflow,
+	// e.g. ^https://github\.com/step-security/.*/\.github/workflows/release\.yml@.*$
+	Issuer        string `json:"issuer"`
+	SubjectRegExp string `json:"subjectRegExp"`
+	// PublicKey is a PEM encoded public key for images signed with a key
+	PublicKey string `json:"publicKey"`
+}
+
+type VerificationPolicy struct {
+	Identities []Identity `json:"identities"`
+	// RequireProvenance requires a SLSA provenance attestation signed by one of the identities
+	RequireProvenance bool `json:"requireProvenance"`
+	// BuilderIDRegExp must match the builder id of the provenance, if set
+	BuilderIDRegExp string `json:"builderIdRegExp"`
+	// TrustedMaterial holds the Fulcio certificate authorities and the certificate transparency
+	// and Rekor logs keyless signatures are verified against. It defaults to the trusted root
+	// of the Sigstore public good instance, loaded and kept up to date through TUF.
+	TrustedMaterial root.TrustedMaterial `json:"-"`
+}
+
+// ParseVerificationPolicy parses a policy in JSON, e.g. from a query string parameter
+func ParseVerificationPolicy(policyJSON string) (*VerificationPolicy, error) {
+	policy := VerificationPolicy{}
+	if err := json.Unmarshal([]byte(policyJSON), &policy); err != nil {
+		return nil, fmt.Errorf("unable to parse verification policy: %v", err)
+	}
+	return &policy, nil
+}
+
+var (
+	sigstoreTrustedRoot     root.TrustedMaterial
+	sigstoreTrustedRootLock sync.Mutex
+)
+
+// loadSigstoreTrustedRoot returns the trusted root of the Sigstore public good instance. It is
+// fetched through TUF on first use, kept in memory as the file system of Lambda is read only,
+// and refreshed daily. Tests replace it to run without the network.
+var loadSigstoreTrustedRoot = func() (root.TrustedMaterial, error) {
+	sigstoreTrustedRootLock.Lock()
+	defer sigstoreTrustedRootLock.Unlock()
+	if sigstoreTrustedRoot == nil {
+		trustedRoot, err := root.NewLiveTrustedRoot(tuf.DefaultOptions().WithDisableLocalCache())
+		if err != nil {
+			return nil, err
+		}
+		sigstoreTrustedRoot = trustedRoot
+	}
+	return sigstoreTrustedRoot, nil
+}
+
+// VerificationResult is the outcome of verifying one image digest
+type VerificationResult struct {
+	Image    string
+	Digest   string
+	Verified bool
+	// SignedBy is the name of the identity that signed the image
+	SignedBy string
+	// Builder is the builder id of the verified provenance
+	Builder string
+	// Problems explains why the image is not verified, e.g. it is unsigned
+	Problems []string
+}
+
+func (r VerificationResult) String() string {
+	if r.Verified {
+		return fmt.Sprintf("%s@%s: signed by %s", r.Image, r.Digest, r.SignedBy)
+	}
+	return fmt.Sprintf("%s@%s: %s", r.Image, r.Digest, strings.Join(r.Problems, ", "))
+}
+
+// attachment is a signature or attestation layer of a cosign .sig or .att image
+type attachment struct {
+	payload     []byte
+	annotations map[string]string
+}
+
+type simpleSigning struct {
+	Critical struct {
+		Image struct {
+			DockerManifestDigest string `json:"docker-manifest-digest"`
+		} `json:"image"`
+	} `json:"critical"`
+}
+
+// rekorBundle is the transparency log entry cosign attaches to keyless signatures
+type rekorBundle struct {
+	SignedEntryTimestamp []byte
+	Payload              rekorPayload
+}
+
+// rekorPayload is what the SignedEntryTimestamp is made over
+type rekorPayload struct {
+	Body           string `json:"body"`
+	IntegratedTime int64  `json:"integratedTime"`
+	LogID          string `json:"logID"`
+	LogIndex       int64  `json:"logIndex"`
+}
+
+type inTotoStatement struct {
+	PredicateType string `json:"predicateType"`
+	Predicate     struct {
+		// SLSA v0.2
+		Builder struct {
+			ID string `json:"id"`
+		} `json:"builder"`
+		// SLSA v1
+		RunDetails struct {
+			Builder struct {
+				ID string `json:"id"`
+			} `json:"builder"`
+		} `json:"runDetails"`
+	} `json:"predicate"`
+}
+
+// VerifyImage checks the cosign signatures and SLSA provenance attestations of ref against policy.
+// They are found through the cosign tag scheme, sha256-<hex>.sig and sha256-<hex>.att;
+// the OCI referrers API is not supported yet.
+func VerifyImage(ref name.Digest, policy VerificationPolicy, options ...remote.Option) VerificationResult {
+	result := VerificationResult{Image: ref.Context().Name(), Digest: ref.DigestStr()}
+
+	verifier, err := newSignatureVerifier(policy)
+	if err != nil {
+		result.Problems = append(result.Problems, err.Error())
+		return result
+	}
+
+	signatures, err := getAttachments(ref, ".sig", options...)
+	if err != nil {
+		result.Problems = append(result.Problems, fmt.Sprintf("unable to get signatures: %v", err))
+	} else if len(signatures) == 0 {
+		result.Problems = append(result.Problems, "image is not signed")
+	} else {
+		for _, s := range signatures {
+			var payload simpleSigning
+			if err := json.Unmarshal(s.payload, &payload); err != nil || payload.Critical.Image.DockerManifestDigest != ref.DigestStr() {
+				continue
+			}
+			sig, err := base64.StdEncoding.DecodeString(s.annotations[signatureAnnotation])
+			if err != nil {
+				continue
+			}
+			digest := sha256Sum(s.payload)
+			content := bundle.NewMessageSignature(digest, "SHA2_256", sig)
+			signedPayload := s.payload
+			artifact := func() verify.ArtifactPolicyOption {
+				return verify.WithArtifact(bytes.NewReader(signedPayload))
+			}
+			if identity, err := verifier.match(s.annotations, content, artifact); err == nil {
+				result.SignedBy = identity
+				break
+			}
+		}
+		if result.SignedBy == "" && verifier.trustedRootErr != nil {
+			result.Problems = append(result.Problems, verifier.trustedRootErr.Error())
+		} else if result.SignedBy == "" {
+			result.Problems = append(result.Problems, "no signature matches the configured identities")
+		}
+	}
+
+	if policy.RequireProvenance || policy.BuilderIDRegExp != "" {
+		builder, err := verifyProvenance(ref, policy, verifier, options...)
+		if err != nil {
+			result.Problems = append(result.Problems, err.Error())
+		}
+		result.Builder = builder
+	}
+
+	result.Verified = len(result.Problems) == 0
+	return result
+}
+
+func verifyProvenance(ref name.Digest, policy VerificationPolicy, verifier *signatureVerifier, options ...remote.Option) (string, error) {
+	attestations, err := getAttachments(ref, ".att", options...)
+	if err != nil {
+		return "", fmt.Errorf("unable to get attestations: %v", err)
+	}
+	if len(attestations) == 0 {
+		return "", fmt.Errorf("image has no provenance")
+	}
+
+	var builderIDRegExp *regexp.Regexp
+	if policy.BuilderIDRegExp != "" {
+		builderIDRegExp, err = regexp.Compile(policy.BuilderIDRegExp)
+		if err != nil {
+			return "", fmt.Errorf("invalid builder id regexp: %v", err)
+		}
+	}
+
+	imageDigest, err := hex.DecodeString(strings.TrimPrefix(ref.DigestStr(), "sha256:"))
+	if err != nil {
+		return "", err
+	}
+	// the statement must be about the image, so the policy checks its subjects against the digest
+	artifact := func() verify.ArtifactPolicyOption {
+		return verify.WithArtifactDigest("sha256", imageDigest)
+	}
+	for _, attestation := range attestations {
+		var envelope dsse.Envelope
+		if err := json.Unmarshal(attestation.payload, &envelope); err != nil || len(envelope.Signatures) == 0 {
+			continue
+		}
+		if _, err := verifier.match(attestation.annotations, &bundle.Envelope{Envelope: &envelope}, artifact); err != nil {
+			continue
+		}
+
+		statementBytes, err := base64.StdEncoding.DecodeString(envelope.Payload)
+		if err != nil {
+			continue
+		}
+		var statement inTotoStatement
+		if err := json.Unmarshal(statementBytes, &statement); err != nil || !strings.HasPrefix(statement.PredicateType, "https://slsa.dev/provenance/") {
+			continue
+		}
+
+		builder := statement.Predicate.Builder.ID
+		if builder == "" {
+			builder = statement.Predicate.RunDetails.Builder.ID
+		}
+		if builderIDRegExp != nil && !builderIDRegExp.MatchString(builder) {
+			return builder, fmt.Errorf("provenance builder %s does not match %s", builder, policy.BuilderIDRegExp)
+		}
+		return builder, nil
+	}
+
+	return "", fmt.Errorf("no provenance signed by the configured identities")
+}
+
+// getAttachments returns the layers of the cosign image tagged sha256-<hex><suffix>,
+// or nothing if there is no such tag.
+func getAttachments(ref name.Digest, suffix string, options ...remote.Option) ([]attachment, error) {
+	tag := ref.Context().Tag(strings.Replace(ref.DigestStr(), ":", "-", 1) + suffix)
+	img, err := remote.Image(tag, options...)
+	if err != nil {
+		var transportErr *transport.Error
+		if errors.As(err, &transportErr) && transportErr.StatusCode == http.StatusNotFound {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	manifest, err := img.Manifest()
+	if err != nil {
+		return nil, err
+	}
+	layers, err := img.Layers()
+	if err != nil {
+		return nil, err
+	}
+
+	attachments := []attachment{}
+	for i, layer := range layers {
+		reader, err := layer.Compressed()
+		if err != nil {
+			return nil, err
+		}
+		payload, err := ioutil.ReadAll(reader)
+		reader.Close()
+		if err != nil {
+			return nil, err
+		}
+		attachments = append(attachments, attachment{payload: payload, annotations: manifest.Layers[i].Annotations})
+	}
+	return attachments, nil
+}
+
+// signatureVerifier verifies cosign signatures and attestations against the identities of a policy
+// with sigstore-go. Keyless signatures need a certificate from a trusted Fulcio, an SCT from a
+// trusted certificate transparency log and an entry in a trusted Rekor log made while the
+// certificate was valid. Key signatures need only the signature.
+type signatureVerifier struct {
+	identities      []Identity
+	trustedMaterial root.TrustedMaterial
+	keyless         *verify.Verifier
+	keyed           *verify.Verifier
+	hasKeyless      bool
+	// trustedRootErr is why keyless signatures could not be verified
+	trustedRootErr error
+}
+
+func newSignatureVerifier(policy VerificationPolicy) (*signatureVerifier, error) {
+	v := &signatureVerifier{identities: policy.Identities, trustedMaterial: policy.TrustedMaterial}
+	keys := make(map[string]*root.ExpiringKey)
+	for i, identity := range policy.Identities {
+		if identity.Issuer != "" && identity.SubjectRegExp != "" {
+			v.hasKeyless = true
+		}
+		if identity.PublicKey == "" {
+			continue
+		}
+		publicKey, err := cryptoutils.UnmarshalPEMToPublicKey([]byte(identity.PublicKey))
+		if err != nil {
+			return nil, fmt.Errorf("invalid public key of %s: %v", identity.Name, err)
+		}
+		keyVerifier, err := signature.LoadVerifier(publicKey, crypto.SHA256)
+		if err != nil {
+			return nil, fmt.Errorf("invalid public key of %s: %v", identity.Name, err)
+		}
+		keys[keyHint(i)] = root.NewExpiringKey(keyVerifier, time.Time{}, time.Time{})
+	}
+	if len(keys) > 0 {
+		var err error
+		v.keyed, err = verify.NewVerifier(root.NewTrustedPublicKeyMaterialFromMapping(keys), verify.WithNoObserverTimestamps())
+		if err != nil {
+			return nil, err
+		}
+	}
+	return v, nil
+}
+
+// keylessVerifier returns the verifier of keyless signatures. The Sigstore trusted root is loaded
+// on first use, so images without keyless signatures are verified without fetching it.
+func (v *signatureVerifier) keylessVerifier() (*verify.Verifier, error) {
+	if v.keyless != nil || v.trustedRootErr != nil {
+		return v.keyless, v.trustedRootErr
+	}
+	trustedMaterial := v.trustedMaterial
+	if trustedMaterial == nil {
+		var err error
+		trustedMaterial, err = loadSigstoreTrustedRoot()
+		if err != nil {
+			v.trustedRootErr = fmt.Errorf("unable to load the Sigstore trusted root: %v", err)
+			return nil, v.trustedRootErr
+		}
+	}
+	keyless, err := verify.NewVerifier(trustedMaterial, verify.WithSignedCertificateTimestamps(1), verify.WithTransparencyLog(1), verify.WithIntegratedTimestamps(1))
+	if err != nil {
+		return nil, err
+	}
+	v.keyless = keyless
+	return v.keyless, nil
+}
+
+// match verifies the signature content of a cosign layer and returns the name of the identity
+// that made it. artifact returns the policy option for what must have been signed.
+func (v *signatureVerifier) match(annotations map[string]string, content verify.SignatureContent, artifact func() verify.ArtifactPolicyOption) (string, error) {
+	if certPEM := annotations[certificateAnnotation]; certPEM != "" {
+		if !v.hasKeyless {
+			return "", fmt.Errorf("no keyless identities are configured")
+		}
+		keyless, err := v.keylessVerifier()
+		if err != nil {
+			return "", err
+		}
+		entity, err := newKeylessEntity(certPEM, annotations[bundleAnnotation], content)
+		if err != nil {
+			return "", err
+		}
+		for _, identity := range v.identities {
+			if identity.Issuer == "" || identity.SubjectRegExp == "" {
+				continue
+			}
+			certificateIdentity, err := verify.NewShortCertificateIdentity(identity.Issuer, "", "", identity.SubjectRegExp)
+			if err != nil {
+				continue
+			}
+			if _, err := keyless.Verify(entity, verify.NewPolicy(artifact(), verify.WithCertificateIdentity(certificateIdentity))); err == nil {
+				return identity.Name, nil
+			}
+		}
+		return "", fmt.Errorf("certificate identity does not match")
+	}
+
+	if v.keyed == nil {
+		return "", fmt.Errorf("no public keys are configured")
+	}
+	for i, identity := range v.identities {
+		if identity.PublicKey == "" {
+			continue
+		}
+		entity := &cosignEntity{verificationContent: publicKeyContent{hint: keyHint(i)}, signatureContent: content}
+		if _, err := v.keyed.Verify(entity, verify.NewPolicy(artifact(), verify.WithKey())); err == nil {
+			return identity.Name, nil
+		}
+	}
+	return "", fmt.Errorf("signature does not match")
+}
+
+// newKeylessEntity builds the entity of a keyless signature from its certificate and the Rekor
+// bundle cosign attaches. sigstore-go verifies the signed entry timestamp, that the entry is a
+// hashedrekord, dsse or intoto entry for this signature, certificate and payload, and that it
+// was logged while the certificate was valid.
+func newKeylessEntity(certPEM, bundleJSON string, content verify.SignatureContent) (*cosignEntity, error) {
+	certs, err := cryptoutils.UnmarshalCertificatesFromPEM([]byte(certPEM))
+	if err != nil || len(certs) == 0 {
+		return nil, fmt.Errorf("invalid certificate")
+	}
+	if bundleJSON == "" {
+		return nil, fmt.Errorf("signature has no transparency log entry")
+	}
+	var rekor rekorBundle
+	if err := json.Unmarshal([]byte(bundleJSON), &rekor); err != nil {
+		return nil, fmt.Errorf("invalid transparency log entry: %v", err)
+	}
+	body, err := base64.StdEncoding.DecodeString(rekor.Payload.Body)
+	if err != nil {
+		return nil, fmt.Errorf("invalid transparency log entry: %v", err)
+	}
+	logID, err := hex.DecodeString(rekor.Payload.LogID)
+	if err != nil {
+		return nil, fmt.Errorf("invalid transparency log entry: %v", err)
+	}
+	entry, err := tlog.NewEntry(body, rekor.Payload.IntegratedTime, rekor.Payload.LogIndex, logID, rekor.SignedEntryTimestamp, nil)
+	if err != nil {
+		return nil, fmt.Errorf("invalid transparency log entry: %v", err)
+	}
+	return &cosignEntity{
+		verificationContent: bundle.NewCertificate(certs[0]),
+		signatureContent:    content,
+		tlogEntries:         []*tlog.Entry{entry},
+	}, nil
+}
+
+// cosignEntity is a signature or attestation stored in cosign's annotations, which predate
+// Sigstore bundles, as the signed entity sigstore-go verifies
+type cosignEntity struct {
+	verificationContent verify.VerificationContent
+	signatureContent    verify.SignatureContent
+	tlogEntries         []*tlog.Entry
+}
+
+func (e *cosignEntity) HasInclusionPromise() bool {
+	return len(e.tlogEntries) > 0
+}
+
+func (e *cosignEntity) HasInclusionProof() bool {
+	return false
+}
+
+func (e *cosignEntity) VerificationContent() (verify.VerificationContent, error) {
+	return e.verificationContent, nil
+}
+
+func (e *cosignEntity) SignatureContent() (verify.SignatureContent, error) {
+	return e.signatureContent, nil
+}
+
+func (e *cosignEntity) Timestamps() ([][]byte, error) {
+	return nil, nil
+}
+
+func (e *cosignEntity) TlogEntries() ([]*tlog.Entry, error) {
+	return e.tlogEntries, nil
+}
+
+// Version is that of the first bundles, which hold the same material as cosign's annotations
+func (e *cosignEntity) Version() (string, error) {
+	return "v0.1", nil
+}
+
+// publicKeyContent points sigstore-go to the public key of an identity in the trusted material
+type publicKeyContent struct {
+	hint string
+}
+
+func (k publicKeyContent) Hint() string {
+	return k.hint
+}
+
+func (k publicKeyContent) CompareKey(key interface{}, trustedMaterial root.TrustedMaterial) bool {
+	keyVerifier, err := trustedMaterial.PublicKeyVerifier(k.hint)
+	if err != nil {
+		return false
+	}
+	publicKey, err := keyVerifier.PublicKey()
+	if err != nil {
+		return false
+	}
+	equaler, ok := key.(interface{ Equal(crypto.PublicKey) bool })
+	return ok && equaler.Equal(publicKey)
+}
+
+func (k publicKeyContent) ValidAtTime(t time.Time, trustedMaterial root.TrustedMaterial) bool {
+	keyVerifier, err := trustedMaterial.PublicKeyVerifier(k.hint)
+	return err == nil && keyVerifier.ValidAtTime(t)
+}
+
+func (k publicKeyContent) Certificate() *x509.Certificate {
+	return nil
+}
+
+func (k publicKeyContent) Intermediates() []*x509.Certificate {
+	return nil
+}
+
+func (k publicKeyContent) PublicKey() verify.PublicKeyProvider {
+	return k
+}
+
+// keyHint identifies the public key of the i-th identity of a policy
+func keyHint(i int) string {
+	return fmt.Sprintf("identity-%d", i)
+}
+
+func sha256Sum(payload []byte) []byte {
+	digest := sha256.Sum256(payload)
+	return digest[:]
+}
@@ -0,0 +1,463 @@
+package registry
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/jarcoal/httpmock"
+	"github.com/secure-systems-lab/go-securesystemslib/dsse"
+	"github.com/sigstore/rekor/pkg/types"
+	"github.com/sigstore/sigstore-go/pkg/root"
+	"github.com/sigstore/sigstore/pkg/cryptoutils"
+)
+
+const (
+	githubIssuer    = "https://token.actions.githubusercontent.com"
+	workflowSubject = "https://github.com/step-security/app/.github/workflows/release.yml@refs/tags/v1.0.0"
+	slsaBuilder     = "https://github.com/slsa-framework/slsa-github-generator/.github/workflows/generator_container_slsa3.yml@refs/tags/v1.9.0"
+)
+
+var (
+	// the Fulcio certificate extension holding the OIDC issuer
+	fulcioIssuerV2OID = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 57264, 1, 8}
+	// the certificate transparency SCTs embedded in a certificate, RFC 6962
+	sctListOID = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 11129, 2, 4, 2}
+)
+
+func TestVerifyImage(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	const host = "registry.example.com"
+	httpmock.RegisterResponder("GET", "https://"+host+"/v2/",
+		httpmock.NewStringResponder(200, `{
+	}`))
+	httpmock.RegisterNoResponder(httpmock.NewStringResponder(404, `{"errors":[{"code":"MANIFEST_UNKNOWN"}]}`))
+
+	// the Sigstore trusted root is not fetched in tests
+	loadTrustedRoot := loadSigstoreTrustedRoot
+	defer func() { loadSigstoreTrustedRoot = loadTrustedRoot }()
+	loadSigstoreTrustedRoot = func() (root.TrustedMaterial, error) {
+		return nil, fmt.Errorf("tuf-repo-cdn.sigstore.dev is unreachable")
+	}
+
+	// a CA standing in for Fulcio, with its certificate transparency and Rekor logs
+	caKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	caCert := certificateAuthority(t, caKey)
+	ctKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	rekorKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	trustedMaterial := trustedRoot(t, caCert, ctKey, rekorKey)
+	otherKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	otherTrustedMaterial := trustedRoot(t, certificateAuthority(t, otherKey), ctKey, rekorKey)
+	trust := func(policy VerificationPolicy) VerificationPolicy {
+		if policy.TrustedMaterial == nil {
+			policy.TrustedMaterial = trustedMaterial
+		}
+		return policy
+	}
+
+	// keyless certificates for a release workflow
+	leafKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	leafPEM := keylessCertificate(t, leafKey, caCert, caKey, ctKey)
+	noSCTPEM := keylessCertificate(t, leafKey, caCert, caKey, nil)
+	selfSignedPEM := keylessCertificate(t, leafKey, nil, nil, ctKey)
+	selfSigned, _ := cryptoutils.UnmarshalCertificatesFromPEM([]byte(selfSignedPEM))
+
+	// a key for images signed with cosign sign --key
+	signingKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	publicKeyDER, _ := x509.MarshalPKIXPublicKey(&signingKey.PublicKey)
+	publicKeyPEM := string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicKeyDER}))
+
+	keylessDigest := imageDigest(t, host+"/step-security/app:1.0")
+	pushSignature(t, keylessDigest, leafKey, map[string]string{certificateAnnotation: leafPEM}, rekorKey, nil)
+	pushProvenance(t, keylessDigest, leafKey, map[string]string{certificateAnnotation: leafPEM}, rekorKey, slsaBuilder)
+
+	selfSignedDigest := imageDigest(t, host+"/step-security/app:self-signed")
+	pushSignature(t, selfSignedDigest, leafKey, map[string]string{certificateAnnotation: selfSignedPEM}, rekorKey, nil)
+
+	noSCTDigest := imageDigest(t, host+"/step-security/app:no-sct")
+	pushSignature(t, noSCTDigest, leafKey, map[string]string{certificateAnnotation: noSCTPEM}, rekorKey, nil)
+
+	noTlogDigest := imageDigest(t, host+"/step-security/app:no-tlog")
+	pushSignature(t, noTlogDigest, leafKey, map[string]string{certificateAnnotation: leafPEM}, nil, nil)
+
+	otherPayloadDigest := imageDigest(t, host+"/step-security/app:other-payload")
+	pushSignature(t, otherPayloadDigest, leafKey, map[string]string{certificateAnnotation: leafPEM}, rekorKey, []byte("other payload"))
+
+	// a Rekor entry of a kind that does not tie the entry to the signed payload
+	rekordDigest := imageDigest(t, host+"/step-security/app:rekord")
+	rekordAnnotations := map[string]string{certificateAnnotation: leafPEM}
+	pushSignature(t, rekordDigest, leafKey, rekordAnnotations, nil, nil)
+	rekordAnnotations[bundleAnnotation] = rekorEntry(t, rekorKey, fmt.Sprintf(`{"apiVersion":"0.0.1","kind":"rekord","spec":{"data":{"hash":{"algorithm":"sha256","value":"%x"}},"signature":{"content":%q,"format":"x509","publicKey":{"content":%q}}}}`,
+		sha256.Sum256([]byte("other payload")), rekordAnnotations[signatureAnnotation], base64.StdEncoding.EncodeToString([]byte(leafPEM))))
+	pushSignature(t, rekordDigest, leafKey, rekordAnnotations, nil, nil)
+
+	keyDigest := imageDigest(t, host+"/library/python:3.7")
+	pushSignature(t, keyDigest, signingKey, map[string]string{}, nil, nil)
+
+	unsignedDigest := imageDigest(t, host+"/library/unsigned:1.0")
+
+	identities := []Identity{
+		{Name: "release workflow", Issuer: githubIssuer, SubjectRegExp: `^https://github\.com/step-security/.*/\.github/workflows/release\.yml@.*$`},
+		{Name: "Docker Official Images", PublicKey: publicKeyPEM},
+	}
+
+	tests := []struct {
+		name     string
+		ref      name.Digest
+		policy   VerificationPolicy
+		verified bool
+		signedBy string
+		builder  string
+		problem  string
+	}{
+		{
+			name:     "keyless signature and provenance",
+			ref:      keylessDigest,
+			policy:   trust(VerificationPolicy{Identities: identities, RequireProvenance: true, BuilderIDRegExp: `^https://github\.com/slsa-framework/slsa-github-generator/`}),
+			verified: true, signedBy: "release workflow", builder: slsaBuilder,
+		},
+		{
+			name:     "builder mismatch",
+			ref:      keylessDigest,
+			policy:   trust(VerificationPolicy{Identities: identities, BuilderIDRegExp: `^https://github\.com/step-security/`}),
+			signedBy: "release workflow", builder: slsaBuilder, problem: "does not match",
+		},
+		{
+			name:    "identity mismatch",
+			ref:     keylessDigest,
+			policy:  trust(VerificationPolicy{Identities: []Identity{{Name: "other", Issuer: githubIssuer, SubjectRegExp: `^https://github\.com/other/`}}}),
+			problem: "no signature matches the configured identities",
+		},
+		{
+			name:    "untrusted certificate authority",
+			ref:     keylessDigest,
+			policy:  VerificationPolicy{Identities: identities, TrustedMaterial: otherTrustedMaterial},
+			problem: "no signature matches the configured identities",
+		},
+		{
+			name:    "Sigstore trusted root unavailable",
+			ref:     keylessDigest,
+			policy:  VerificationPolicy{Identities: identities},
+			problem: "unable to load the Sigstore trusted root: tuf-repo-cdn.sigstore.dev is unreachable",
+		},
+		{
+			name:    "self-signed keyless certificate",
+			ref:     selfSignedDigest,
+			policy:  trust(VerificationPolicy{Identities: identities}),
+			problem: "no signature matches the configured identities",
+		},
+		{
+			name:    "keyless certificate trusted as a root",
+			ref:     selfSignedDigest,
+			policy:  VerificationPolicy{Identities: identities, TrustedMaterial: trustedRoot(t, selfSigned[0], ctKey, rekorKey)},
+			problem: "no signature matches the configured identities",
+		},
+		{
+			name:    "certificate without SCT",
+			ref:     noSCTDigest,
+			policy:  trust(VerificationPolicy{Identities: identities}),
+			problem: "no signature matches the configured identities",
+		},
+		{
+			name:    "signature without transparency log entry",
+			ref:     noTlogDigest,
+			policy:  trust(VerificationPolicy{Identities: identities}),
+			problem: "no signature matches the configured identities",
+		},
+		{
+			name:    "transparency log entry for another payload",
+			ref:     otherPayloadDigest,
+			policy:  trust(VerificationPolicy{Identities: identities}),
+			problem: "no signature matches the configured identities",
+		},
+		{
+			name:    "unsupported transparency log entry kind",
+			ref:     rekordDigest,
+			policy:  trust(VerificationPolicy{Identities: identities}),
+			problem: "no signature matches the configured identities",
+		},
+		{
+			name:     "key signature",
+			ref:      keyDigest,
+			policy:   VerificationPolicy{Identities: identities[1:]},
+			verified: true, signedBy: "Docker Official Images",
+		},
+		{
+			name:    "missing provenance",
+			ref:     keyDigest,
+			policy:  VerificationPolicy{Identities: identities[1:], RequireProvenance: true},
+			problem: "image has no provenance", signedBy: "Docker Official Images",
+		},
+		{
+			name:    "unsigned",
+			ref:     unsignedDigest,
+			policy:  VerificationPolicy{Identities: identities},
+			problem: "image is not signed",
+		},
+		{
+			name:    "invalid public key",
+			ref:     keyDigest,
+			policy:  VerificationPolicy{Identities: []Identity{{Name: "broken", PublicKey: "not a key"}}},
+			problem: "invalid public key of broken",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := VerifyImage(tt.ref, tt.policy, remote.WithTransport(httpmock.DefaultTransport))
+			if result.Verified != tt.verified || result.SignedBy != tt.signedBy || result.Builder != tt.builder {
+				t.Errorf("unexpected result %+v", result)
+			}
+			if tt.problem != "" && !strings.Contains(strings.Join(result.Problems, ", "), tt.problem) {
+				t.Errorf("expected problem %q, got %v", tt.problem, result.Problems)
+			}
+		})
+	}
+}
+
+// certificateAuthority returns a self-signed CA certificate for key
+func certificateAuthority(t *testing.T, key *ecdsa.PrivateKey) *x509.Certificate {
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "fulcio"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return cert
+}
+
+// trustedRoot trusts ca as Fulcio with the certificate transparency log of ctKey and the Rekor log of rekorKey
+func trustedRoot(t *testing.T, ca *x509.Certificate, ctKey, rekorKey *ecdsa.PrivateKey) root.TrustedMaterial {
+	transparencyLog := func(key *ecdsa.PrivateKey) map[string]*root.TransparencyLog {
+		der, _ := x509.MarshalPKIXPublicKey(&key.PublicKey)
+		logID := sha256.Sum256(der)
+		return map[string]*root.TransparencyLog{
+			hex.EncodeToString(logID[:]): {
+				ID:                  logID[:],
+				HashFunc:            crypto.SHA256,
+				PublicKey:           &key.PublicKey,
+				SignatureHashFunc:   crypto.SHA256,
+				ValidityPeriodStart: time.Now().Add(-time.Hour),
+			},
+		}
+	}
+	trustedRoot, err := root.NewTrustedRoot(root.TrustedRootMediaType01,
+		[]root.CertificateAuthority{&root.FulcioCertificateAuthority{Root: ca}},
+		transparencyLog(ctKey), nil, transparencyLog(rekorKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return trustedRoot
+}
+
+// pushImage returns a digest for image, the image itself is never fetched
+func imageDigest(t *testing.T, image string) name.Digest {
+	ref, err := name.ParseReference(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ref.Context().Digest(fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(image))))
+}
+
+// pushAttachment serves a cosign .sig or .att image with one layer holding payload
+func pushAttachment(t *testing.T, ref name.Digest, suffix string, payload []byte, mediaType string, annotations map[string]string) {
+	repository := fmt.Sprintf("https://%s/v2/%s", ref.Context().RegistryStr(), ref.Context().RepositoryStr())
+	config := []byte("{}")
+	configDigest := fmt.Sprintf("sha256:%x", sha256.Sum256(config))
+	layerDigest := fmt.Sprintf("sha256:%x", sha256.Sum256(payload))
+
+	manifest, _ := json.Marshal(map[string]interface{}{
+		"schemaVersion": 2,
+		"mediaType":     "application/vnd.oci.image.manifest.v1+json",
+		"config":        map[string]interface{}{"mediaType": "application/vnd.oci.image.config.v1+json", "size": len(config), "digest": configDigest},
+		"layers": []map[string]interface{}{
+			{"mediaType": mediaType, "size": len(payload), "digest": layerDigest, "annotations": annotations},
+		},
+	})
+
+	tag := strings.Replace(ref.DigestStr(), ":", "-", 1) + suffix
+	httpmock.RegisterResponder("GET", repository+"/manifests/"+tag, func(req *http.Request) (*http.Response, error) {
+		resp := httpmock.NewBytesResponse(200, manifest)
+		resp.Header.Set("Content-Type", "application/vnd.oci.image.manifest.v1+json")
+		return resp, nil
+	})
+	httpmock.RegisterResponder("GET", repository+"/blobs/"+configDigest, httpmock.NewBytesResponder(200, config))
+	httpmock.RegisterResponder("GET", repository+"/blobs/"+layerDigest, httpmock.NewBytesResponder(200, payload))
+}
+
+// pushSignature signs the simple signing payload of ref with key. Unless rekorKey is nil the signature
+// is logged as a hashedrekord entry, for loggedPayload instead of the signed payload if it is set.
+func pushSignature(t *testing.T, ref name.Digest, key *ecdsa.PrivateKey, annotations map[string]string, rekorKey *ecdsa.PrivateKey, loggedPayload []byte) {
+	payload := []byte(fmt.Sprintf(`{"critical":{"identity":{"docker-reference":%q},"image":{"docker-manifest-digest":%q},"type":"cosign container image signature"},"optional":null}`,
+		ref.Context().Name(), ref.DigestStr()))
+	digest := sha256.Sum256(payload)
+	sig, err := ecdsa.SignASN1(rand.Reader, key, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	annotations[signatureAnnotation] = base64.StdEncoding.EncodeToString(sig)
+	if rekorKey != nil {
+		if loggedPayload != nil {
+			digest = sha256.Sum256(loggedPayload)
+		}
+		body := fmt.Sprintf(`{"apiVersion":"0.0.1","kind":"hashedrekord","spec":{"data":{"hash":{"algorithm":"sha256","value":"%x"}},"signature":{"content":%q,"publicKey":{"content":%q}}}}`,
+			digest, annotations[signatureAnnotation], base64.StdEncoding.EncodeToString([]byte(annotations[certificateAnnotation])))
+		annotations[bundleAnnotation] = rekorEntry(t, rekorKey, body)
+	}
+	pushAttachment(t, ref, ".sig", payload, "application/vnd.dev.cosign.simplesigning.v1+json", annotations)
+}
+
+func pushProvenance(t *testing.T, ref name.Digest, key *ecdsa.PrivateKey, annotations map[string]string, rekorKey *ecdsa.PrivateKey, builder string) {
+	hash, _ := v1.NewHash(ref.DigestStr())
+	statement := []byte(fmt.Sprintf(`{"_type":"https://in-toto.io/Statement/v0.1","predicateType":"https://slsa.dev/provenance/v0.2","subject":[{"name":%q,"digest":{"sha256":%q}}],"predicate":{"builder":{"id":%q}}}`,
+		ref.Context().Name(), hash.Hex, builder))
+	const payloadType = "application/vnd.in-toto+json"
+	digest := sha256.Sum256(dsse.PAE(payloadType, statement))
+	sig, err := ecdsa.SignASN1(rand.Reader, key, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	envelope, _ := json.Marshal(map[string]interface{}{
+		"payloadType": payloadType,
+		"payload":     base64.StdEncoding.EncodeToString(statement),
+		"signatures":  []map[string]string{{"sig": base64.StdEncoding.EncodeToString(sig)}},
+	})
+	annotations[signatureAnnotation] = ""
+	if rekorKey != nil {
+		// logged as an intoto entry like cosign attest does
+		entry, err := types.NewProposedEntry(context.Background(), "intoto", "0.0.2", types.ArtifactProperties{
+			ArtifactBytes:  envelope,
+			PublicKeyBytes: [][]byte{[]byte(annotations[certificateAnnotation])},
+			PKIFormat:      "x509",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		entryImpl, err := types.CreateVersionedEntry(entry)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := types.CanonicalizeEntry(context.Background(), entryImpl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		annotations[bundleAnnotation] = rekorEntry(t, rekorKey, string(body))
+	}
+	pushAttachment(t, ref, ".att", envelope, "application/vnd.dsse.envelope.v1+json", annotations)
+}
+
+// keylessCertificate issues a certificate like Fulcio does for a release workflow, with an
+// SCT from ctKey unless it is nil. Without ca the certificate is self-signed.
+func keylessCertificate(t *testing.T, key *ecdsa.PrivateKey, ca *x509.Certificate, caKey *ecdsa.PrivateKey, ctKey *ecdsa.PrivateKey) string {
+	subject, _ := url.Parse(workflowSubject)
+	issuer, _ := asn1.Marshal(githubIssuer)
+	template := &x509.Certificate{
+		SerialNumber:    big.NewInt(2),
+		NotBefore:       time.Now().Add(-time.Minute),
+		NotAfter:        time.Now().Add(10 * time.Minute),
+		URIs:            []*url.URL{subject},
+		ExtKeyUsage:     []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+		KeyUsage:        x509.KeyUsageDigitalSignature,
+		ExtraExtensions: []pkix.Extension{{Id: fulcioIssuerV2OID, Value: issuer}},
+	}
+	if ca == nil {
+		ca, caKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ctKey != nil {
+		precert, _ := x509.ParseCertificate(der)
+		issuerKeyHash := sha256.Sum256(ca.RawSubjectPublicKeyInfo)
+		if len(ca.RawSubjectPublicKeyInfo) == 0 {
+			// self-signed, the template has no raw fields
+			spki, _ := x509.MarshalPKIXPublicKey(&key.PublicKey)
+			issuerKeyHash = sha256.Sum256(spki)
+		}
+		timestamp := make([]byte, 8)
+		binary.BigEndian.PutUint64(timestamp, uint64(time.Now().UnixNano()/int64(time.Millisecond)))
+		tbs := precert.RawTBSCertificate
+
+		signed := append([]byte{0, 0}, timestamp...)
+		signed = append(signed, 0, 1)
+		signed = append(signed, issuerKeyHash[:]...)
+		signed = append(signed, byte(len(tbs)>>16), byte(len(tbs)>>8), byte(len(tbs)))
+		signed = append(signed, tbs...)
+		signed = append(signed, 0, 0)
+		digest := sha256.Sum256(signed)
+		sig, err := ecdsa.SignASN1(rand.Reader, ctKey, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ctKeyDER, _ := x509.MarshalPKIXPublicKey(&ctKey.PublicKey)
+		logID := sha256.Sum256(ctKeyDER)
+		sct := append([]byte{0}, logID[:]...)
+		sct = append(sct, timestamp...)
+		sct = append(sct, 0, 0, 4, 3, byte(len(sig)>>8), byte(len(sig)))
+		sct = append(sct, sig...)
+		list := append([]byte{byte(len(sct) >> 8), byte(len(sct))}, sct...)
+		list = append([]byte{byte(len(list) >> 8), byte(len(list))}, list...)
+		value, _ := asn1.Marshal(list)
+
+		template.ExtraExtensions = append(template.ExtraExtensions, pkix.Extension{Id: sctListOID, Value: value})
+		der, err = x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+}
+
+// rekorEntry returns the bundle annotation for an entry with body, logged by rekorKey
+func rekorEntry(t *testing.T, rekorKey *ecdsa.PrivateKey, body string) string {
+	rekorKeyDER, _ := x509.MarshalPKIXPublicKey(&rekorKey.PublicKey)
+	logID := sha256.Sum256(rekorKeyDER)
+	payload := rekorPayload{
+		Body:           base64.StdEncoding.EncodeToString([]byte(body)),
+		IntegratedTime: time.Now().Unix(),
+		LogID:          fmt.Sprintf("%x", logID),
+		LogIndex:       1,
+	}
+	canonical, _ := json.Marshal(payload)
+	digest := sha256.Sum256(canonical)
+	set, err := ecdsa.SignASN1(rand.Reader, rekorKey, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	bundle, _ := json.Marshal(rekorBundle{SignedEntryTimestamp: set, Payload: payload})
+	return string(bundle)
+}
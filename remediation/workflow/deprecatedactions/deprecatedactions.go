@@ -0,0 +1,366 @@
+package deprecatedactions
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+
+	metadata "github.com/step-security/secure-repo/remediation/workflow/metadata"
+	"github.com/step-security/secure-repo/remediation/workflow/pin"
+	"gopkg.in/yaml.v3"
+)
+
+// versionCommentRegex matches the version comment of a pinned action, e.g. # v1.1.4
+var versionCommentRegex = regexp.MustCompile(`^\s*#\s*v?[0-9]`)
+
+// outputReferenceRegex matches a step output reference, e.g. steps.release.outputs.upload_url
+var outputReferenceRegex = regexp.MustCompile(`steps\.[A-Za-z0-9_-]+\.outputs\.[A-Za-z0-9_-]+`)
+
+// Deprecation is the action-deprecation.yml of a deprecated action in the knowledge base
+type Deprecation struct {
+	Name             string `yaml:"name"`
+	Reason           string `yaml:"reason"`
+	Successor        string `yaml:"successor"`
+	SuccessorVersion string `yaml:"successor-version"`
+	// Inputs maps inputs of the deprecated action to inputs of the successor
+	Inputs map[string]string `yaml:"inputs"`
+	// RemovedInputs are inputs the successor does not need
+	RemovedInputs []string `yaml:"removed-inputs"`
+	// Outputs maps outputs of the deprecated action to outputs of the successor
+	Outputs map[string]string `yaml:"outputs"`
+}
+
+// DeprecatedStep is a step that uses a deprecated action
+type DeprecatedStep struct {
+	JobName   string
+	Action    string
+	Successor string
+	Reason    string
+	// Problems are the inputs and outputs of the step without a known translation.
+	// The step is only replaced if there are none.
+	Problems []string
+}
+
+// Replaced reports whether the step was rewritten to use the successor
+func (s DeprecatedStep) Replaced() bool {
+	return len(s.Problems) == 0
+}
+
+func (s DeprecatedStep) String() string {
+	if s.Replaced() {
+		return fmt.Sprintf("%s: %s -> %s (%s)", s.JobName, s.Action, s.Successor, s.Reason)
+	}
+	return fmt.Sprintf("%s: %s -> %s not replaced: %s", s.JobName, s.Action, s.Successor, strings.Join(s.Problems, "; "))
+}
+
+type ReplaceDeprecatedActionsResponse struct {
+	FinalOutput string
+	IsChanged   bool
+	// Steps are the steps using deprecated actions, replaced or not
+	Steps []DeprecatedStep
+}
+
+// lineEdit replaces lines [start, end] with replacement, all 0-based
+type lineEdit struct {
+	start       int
+	end         int
+	replacement []string
+}
+
+// GetDeprecation returns the deprecation of action (owner/repo or owner/repo/path, without a ref)
+// from the knowledge base, or nil if it is not deprecated
+func GetDeprecation(action string) (*Deprecation, error) {
+	kbFolder := os.Getenv("DeprecatedActionsKBFolder")
+	if kbFolder == "" {
+		kbFolder = "../../knowledge-base/deprecated-actions"
+	}
+
+	input, err := ioutil.ReadFile(path.Join(kbFolder, strings.ToLower(action), "action-deprecation.yml"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	deprecation := Deprecation{}
+	if err := yaml.Unmarshal(input, &deprecation); err != nil {
+		return nil, fmt.Errorf("unable to parse deprecation of %s: %v", action, err)
+	}
+	return &deprecation, nil
+}
+
+// ReplaceDeprecatedActions replaces steps using deprecated actions with their successor from the
+// knowledge base, renaming with: inputs and step output references by the deprecation's mappings.
+// Steps with an input or output that has no known translation are reported and left as is.
+func ReplaceDeprecatedActions(inputYaml string) (*ReplaceDeprecatedActionsResponse, error) {
+	response := &ReplaceDeprecatedActionsResponse{FinalOutput: inputYaml}
+
+	t := yaml.Node{}
+	if err := yaml.Unmarshal([]byte(inputYaml), &t); err != nil {
+		return nil, fmt.Errorf("unable to parse yaml: %v", err)
+	}
+	if len(t.Content) == 0 {
+		return response, nil
+	}
+	root := t.Content[0]
+
+	type jobSteps struct {
+		jobName string
+		steps   *yaml.Node
+	}
+	var allSteps []jobSteps
+	if jobsNode := metadata.GetMappingValue(root, "jobs"); jobsNode != nil && jobsNode.Kind == yaml.MappingNode {
+		for i := 0; i+1 < len(jobsNode.Content); i += 2 {
+			allSteps = append(allSteps, jobSteps{jobsNode.Content[i].Value, metadata.GetMappingValue(jobsNode.Content[i+1], "steps")})
+		}
+	}
+	// For composite actions
+	allSteps = append(allSteps, jobSteps{"composite", metadata.GetMappingValue(metadata.GetMappingValue(root, "runs"), "steps")})
+
+	inputLines := strings.Split(inputYaml, "\n")
+	var edits []lineEdit
+	outputRenames := map[string]string{}
+
+	for _, js := range allSteps {
+		if js.steps == nil || js.steps.Kind != yaml.SequenceNode {
+			continue
+		}
+		for _, stepNode := range js.steps.Content {
+			usesNode := metadata.GetMappingValue(stepNode, "uses")
+			if usesNode == nil || usesNode.Kind != yaml.ScalarNode {
+				continue
+			}
+			action := strings.Split(usesNode.Value, "@")[0]
+			if strings.HasPrefix(action, "./") || strings.HasPrefix(action, "docker://") {
+				continue
+			}
+			deprecation, err := GetDeprecation(action)
+			if err != nil {
+				return nil, err
+			}
+			if deprecation == nil || deprecation.Successor == "" {
+				continue
+			}
+
+			successor := deprecation.Successor + "@" + deprecation.SuccessorVersion
+			step := DeprecatedStep{
+				JobName:   js.jobName,
+				Action:    usesNode.Value,
+				Successor: successor,
+				Reason:    deprecation.Reason,
+			}
+			stepEdits, stepRenames := translateStep(inputYaml, inputLines, stepNode, deprecation, &step)
+			newUses, version := successor, ""
+			if step.Replaced() && isPinnedToSHA(usesNode.Value) {
+				// keep the step pinned, to the commit of the successor's tag
+				commitSHA, semanticVersion, err := pin.ResolveActionSHA(deprecation.Successor, deprecation.SuccessorVersion)
+				if err != nil {
+					step.Problems = append(step.Problems, fmt.Sprintf("unable to pin %s: %v", successor, err))
+				} else {
+					newUses, version = deprecation.Successor+"@"+commitSHA, semanticVersion
+				}
+			}
+			response.Steps = append(response.Steps, step)
+			if !step.Replaced() {
+				continue
+			}
+
+			line := usesNode.Line - 1
+			edits = append(edits, lineEdit{start: line, end: line, replacement: []string{replaceUsesValue(inputLines[line], usesNode.Column-1, usesNode.Style, newUses, version)}})
+			edits = append(edits, stepEdits...)
+			for reference, renamed := range stepRenames {
+				outputRenames[reference] = renamed
+			}
+		}
+	}
+
+	if len(edits) == 0 {
+		return response, nil
+	}
+
+	// apply edits bottom up so line numbers of the remaining edits stay valid
+	sort.Slice(edits, func(i, j int) bool {
+		return edits[i].start > edits[j].start
+	})
+	for _, edit := range edits {
+		lines := append([]string{}, inputLines[:edit.start]...)
+		lines = append(lines, edit.replacement...)
+		inputLines = append(lines, inputLines[edit.end+1:]...)
+	}
+	output := strings.Join(inputLines, "\n")
+
+	// a single pass, so a renamed output is not renamed again
+	output = outputReferenceRegex.ReplaceAllStringFunc(output, func(reference string) string {
+		if renamed, ok := outputRenames[reference]; ok {
+			return renamed
+		}
+		return reference
+	})
+
+	response.FinalOutput = output
+	response.IsChanged = true
+	return response, nil
+}
+
+// translateStep works out the edits to the with: inputs of a step and the renames of
+// references to its outputs. Inputs and outputs it can not translate are added to step.Problems.
+func translateStep(inputYaml string, inputLines []string, stepNode *yaml.Node, deprecation *Deprecation, step *DeprecatedStep) ([]lineEdit, map[string]string) {
+	var edits []lineEdit
+	renames := map[string]string{}
+
+	withNode := metadata.GetMappingValue(stepNode, "with")
+	if withNode != nil && withNode.Kind == yaml.MappingNode {
+		if withNode.Style&yaml.FlowStyle != 0 {
+			step.Problems = append(step.Problems, "with: in flow style is not supported")
+			return nil, nil
+		}
+		removed := 0
+		for i := 0; i+1 < len(withNode.Content); i += 2 {
+			keyNode := withNode.Content[i]
+			if newName, ok := lookup(deprecation.Inputs, keyNode.Value); ok {
+				if newName != keyNode.Value {
+					edits = append(edits, renameKey(inputLines, keyNode, newName))
+				}
+			} else if containsFold(deprecation.RemovedInputs, keyNode.Value) {
+				edits = append(edits, removeKey(inputLines, keyNode))
+				removed++
+			} else {
+				step.Problems = append(step.Problems, fmt.Sprintf("input %s has no known translation to %s", keyNode.Value, deprecation.Successor))
+			}
+		}
+		if removed > 0 && removed == len(withNode.Content)/2 {
+			// nothing is left, remove with: as a whole
+			withKey, _ := metadata.GetMappingEntry(stepNode, "with")
+			edits = []lineEdit{removeKey(inputLines, withKey)}
+		}
+	}
+
+	idNode := metadata.GetMappingValue(stepNode, "id")
+	if idNode != nil && idNode.Value != "" {
+		outputRegex := regexp.MustCompile(`steps\.` + regexp.QuoteMeta(idNode.Value) + `\.outputs\.([A-Za-z0-9_-]+)`)
+		seen := map[string]bool{}
+		for _, match := range outputRegex.FindAllStringSubmatch(inputYaml, -1) {
+			output := match[1]
+			if seen[output] {
+				continue
+			}
+			seen[output] = true
+			newName, ok := lookup(deprecation.Outputs, output)
+			if !ok {
+				step.Problems = append(step.Problems, fmt.Sprintf("output %s has no known translation to %s", output, deprecation.Successor))
+				continue
+			}
+			if newName != output {
+				renames[fmt.Sprintf("steps.%s.outputs.%s", idNode.Value, output)] = fmt.Sprintf("steps.%s.outputs.%s", idNode.Value, newName)
+			}
+		}
+	}
+	return edits, renames
+}
+
+// renameKey replaces the key of a block mapping entry, keeping its quotes
+func renameKey(inputLines []string, keyNode *yaml.Node, newName string) lineEdit {
+	line := keyNode.Line - 1
+	column := keyNode.Column - 1
+	oldLine := inputLines[line]
+	length := len(keyNode.Value)
+	quote := ""
+	switch keyNode.Style {
+	case yaml.DoubleQuotedStyle:
+		quote = `"`
+		length += 2
+	case yaml.SingleQuotedStyle:
+		quote = "'"
+		length += 2
+	}
+	if column+length > len(oldLine) {
+		length = len(oldLine) - column
+	}
+	newLine := oldLine[:column] + quote + newName + quote + oldLine[column+length:]
+	return lineEdit{start: line, end: line, replacement: []string{newLine}}
+}
+
+// removeKey removes the lines of a block mapping entry: the key line and the lines
+// indented further, which hold its value
+func removeKey(inputLines []string, keyNode *yaml.Node) lineEdit {
+	start := keyNode.Line - 1
+	end := start
+	for i := start + 1; i < len(inputLines); i++ {
+		trimmed := strings.TrimSpace(inputLines[i])
+		if trimmed == "" {
+			continue
+		}
+		if len(inputLines[i])-len(strings.TrimLeft(inputLines[i], " ")) <= keyNode.Column-1 {
+			break
+		}
+		end = i
+	}
+	return lineEdit{start: start, end: end}
+}
+
+// replaceUsesValue replaces the uses: value of line starting at valueColumn, keeping its
+// quotes and a trailing comment. A version at the start of the comment describes the old action.
+// It is replaced by version when newUses is pinned to a SHA, and dropped otherwise.
+func replaceUsesValue(line string, valueColumn int, style yaml.Style, newUses, version string) string {
+	if valueColumn > len(line) {
+		valueColumn = len(line)
+	}
+	prefix, rest := line[:valueColumn], line[valueColumn:]
+	comment := ""
+	if idx := strings.Index(rest, " #"); idx >= 0 {
+		value := strings.TrimRight(rest[:idx], " \t")
+		comment = rest[len(value):]
+	}
+	quote := ""
+	switch style {
+	case yaml.DoubleQuotedStyle:
+		quote = `"`
+	case yaml.SingleQuotedStyle:
+		quote = "'"
+	}
+
+	if version != "" {
+		return pin.ReplaceLineComment(prefix+quote+newUses+quote+comment, valueColumn, version)
+	}
+	if versionCommentRegex.MatchString(comment) {
+		text := strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(comment), "#"))
+		comment = ""
+		if text = strings.TrimSpace(strings.TrimPrefix(text, pin.LeadingVersion(text))); text != "" {
+			comment = " # " + text
+		}
+	}
+	return strings.TrimRight(prefix+quote+newUses+quote+comment, " \t")
+}
+
+// isPinnedToSHA reports whether uses refers to a full length commit SHA
+func isPinnedToSHA(uses string) bool {
+	parts := strings.SplitN(uses, "@", 2)
+	return len(parts) == 2 && len(parts[1]) == 40 && pin.IsAllHex(parts[1])
+}
+
+// lookup finds name in a mapping of input or output names, which are not case sensitive
+func lookup(mapping map[string]string, name string) (string, bool) {
+	if newName, ok := mapping[name]; ok {
+		return newName, true
+	}
+	for key, newName := range mapping {
+		if strings.EqualFold(key, name) {
+			return newName, true
+		}
+	}
+	return "", false
+}
+
+func containsFold(values []string, value string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,166 @@
+package deprecatedactions
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/jarcoal/httpmock"
+	"gopkg.in/yaml.v3"
+)
+
+const kbFolder = "../../../knowledge-base/deprecated-actions"
+
+const actionsKBFolder = "../../../knowledge-base/actions"
+
+func TestDeprecatedActionsKnowledgeBase(t *testing.T) {
+	lintIssues := []string{}
+
+	err := filepath.Walk(kbFolder, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			lintIssues = append(lintIssues, fmt.Sprintf("Error reading %s: %v", filePath, err))
+			return nil
+		}
+		if !strings.HasSuffix(info.Name(), "yml") && !strings.HasSuffix(info.Name(), "yaml") {
+			return nil
+		}
+		if strings.ToLower(filePath) != filePath {
+			lintIssues = append(lintIssues, fmt.Sprintf("File path should be lowercase, not %s", filePath))
+			return nil
+		}
+		if info.Name() != "action-deprecation.yml" {
+			lintIssues = append(lintIssues, fmt.Sprintf("File must be named action-deprecation.yml, not %s at %s", info.Name(), filePath))
+			return nil
+		}
+
+		input, err := ioutil.ReadFile(filePath)
+		if err != nil {
+			lintIssues = append(lintIssues, fmt.Sprintf("Unable to read action-deprecation.yml at %s", filePath))
+			return nil
+		}
+		deprecation := Deprecation{}
+		if err := yaml.Unmarshal(input, &deprecation); err != nil {
+			lintIssues = append(lintIssues, fmt.Sprintf("Unable to unmarshall action-deprecation.yml at %s", filePath))
+			return nil
+		}
+
+		if deprecation.Name == "" || deprecation.Reason == "" {
+			lintIssues = append(lintIssues, fmt.Sprintf("Name and reason must not be empty in action-deprecation.yml at %s", filePath))
+		}
+		if deprecation.Successor == "" || deprecation.SuccessorVersion == "" {
+			lintIssues = append(lintIssues, fmt.Sprintf("Successor and successor-version must not be empty in action-deprecation.yml at %s", filePath))
+		} else if _, err := os.Stat(path.Join(actionsKBFolder, strings.ToLower(deprecation.Successor), "action-security.yml")); err != nil {
+			lintIssues = append(lintIssues, fmt.Sprintf("Successor %s has no action-security.yml in the actions knowledge base, for action-deprecation.yml at %s", deprecation.Successor, filePath))
+		}
+		if !versionTagRegex.MatchString(deprecation.SuccessorVersion) {
+			lintIssues = append(lintIssues, fmt.Sprintf("successor-version must be a release tag, not %s in action-deprecation.yml at %s", deprecation.SuccessorVersion, filePath))
+		}
+		for _, input := range deprecation.RemovedInputs {
+			if _, ok := deprecation.Inputs[input]; ok {
+				lintIssues = append(lintIssues, fmt.Sprintf("Input %s is both mapped and removed in action-deprecation.yml at %s", input, filePath))
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("error walking knowledge base: %v", err)
+	}
+	for _, issue := range lintIssues {
+		t.Error(issue)
+	}
+}
+
+// versionTagRegex matches a release tag, e.g. v2 or v1.10.1
+var versionTagRegex = regexp.MustCompile(`^v[0-9]+(\.[0-9]+){0,2}$`)
+
+func TestGetDeprecation(t *testing.T) {
+	os.Setenv("DeprecatedActionsKBFolder", kbFolder)
+	defer os.Unsetenv("DeprecatedActionsKBFolder")
+
+	deprecation, err := GetDeprecation("Actions/Create-Release")
+	if err != nil {
+		t.Fatalf("GetDeprecation() error = %v", err)
+	}
+	if deprecation == nil || deprecation.Successor != "softprops/action-gh-release" || deprecation.Inputs["release_name"] != "name" {
+		t.Errorf("GetDeprecation() = %v", deprecation)
+	}
+
+	deprecation, err = GetDeprecation("actions/checkout")
+	if err != nil || deprecation != nil {
+		t.Errorf("GetDeprecation() of an action that is not deprecated = %v, %v", deprecation, err)
+	}
+}
+
+func TestReplaceDeprecatedActions(t *testing.T) {
+	const inputDirectory = "../../../testfiles/deprecatedActions/input"
+	const outputDirectory = "../../../testfiles/deprecatedActions/output"
+
+	os.Setenv("DeprecatedActionsKBFolder", kbFolder)
+	defer os.Unsetenv("DeprecatedActionsKBFolder")
+
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	// the SHA pinned step is pinned to the commit of the successor's tag
+	httpmock.RegisterResponder("GET", "https://api.github.com/repos/actions-rust-lang/setup-rust-toolchain/commits/v1",
+		httpmock.NewStringResponder(200, `aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa`))
+	httpmock.RegisterResponder("GET", "https://api.github.com/repos/actions-rust-lang/setup-rust-toolchain/git/matching-refs/tags/v1.",
+		httpmock.NewStringResponder(200, `[{"ref":"refs/tags/v1.10.0","object":{"sha":"0000000000000000000000000000000000000000","type":"commit"}},{"ref":"refs/tags/v1.10.1","object":{"sha":"aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa","type":"commit"}}]`))
+
+	input, err := ioutil.ReadFile(path.Join(inputDirectory, "release.yml"))
+	if err != nil {
+		t.Fatalf("error reading input file: %v", err)
+	}
+	expectedOutput, err := ioutil.ReadFile(path.Join(outputDirectory, "release.yml"))
+	if err != nil {
+		t.Fatalf("error reading expected output file: %v", err)
+	}
+
+	response, err := ReplaceDeprecatedActions(string(input))
+	if err != nil {
+		t.Fatalf("ReplaceDeprecatedActions() error = %v", err)
+	}
+	if response.FinalOutput != string(expectedOutput) {
+		t.Errorf("ReplaceDeprecatedActions() = %v, want %v", response.FinalOutput, string(expectedOutput))
+	}
+	if !response.IsChanged {
+		t.Error("ReplaceDeprecatedActions() expected IsChanged = true")
+	}
+
+	var got []string
+	for _, step := range response.Steps {
+		got = append(got, step.String())
+	}
+	want := []string{
+		"release: actions-rs/toolchain@16499b5e05bf2e26879000db0c1d13f7e13fa3af -> actions-rust-lang/setup-rust-toolchain@v1 (archived and no longer maintained)",
+		"release: actions/create-release@v1 -> softprops/action-gh-release@v2 (archived and no longer maintained)",
+		"release: actions/upload-release-asset@v1 -> softprops/action-gh-release@v2 not replaced: " +
+			"input upload_url has no known translation to softprops/action-gh-release; " +
+			"input asset_path has no known translation to softprops/action-gh-release; " +
+			"input asset_name has no known translation to softprops/action-gh-release; " +
+			"input asset_content_type has no known translation to softprops/action-gh-release",
+		"audit: actions-rs/toolchain@v1 -> actions-rust-lang/setup-rust-toolchain@v1 (archived and no longer maintained)",
+		"audit: actions-rs/audit-check@v1 -> rustsec/audit-check@v2 (archived and no longer maintained)",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("ReplaceDeprecatedActions() steps =\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+
+	// an output without a translation leaves the step as is
+	withOutput := "jobs:\n  build:\n    steps:\n      - id: toolchain\n        uses: actions-rs/toolchain@v1\n        with:\n          toolchain: stable\n      - run: echo ${{ steps.toolchain.outputs.rustc }}\n"
+	response, err = ReplaceDeprecatedActions(withOutput)
+	if err != nil {
+		t.Fatalf("ReplaceDeprecatedActions() error = %v", err)
+	}
+	if response.IsChanged || response.FinalOutput != withOutput {
+		t.Errorf("ReplaceDeprecatedActions() expected no change, got %s", response.FinalOutput)
+	}
+	if len(response.Steps) != 1 || response.Steps[0].Problems[0] != "output rustc has no known translation to actions-rust-lang/setup-rust-toolchain" {
+		t.Errorf("ReplaceDeprecatedActions() steps = %v", response.Steps)
+	}
+}
@@ -3,11 +3,13 @@ package hardenrunner
 import (
 	"fmt"
 	"log"
+	"sort"
 	"strings"
 
 	metadata "github.com/step-security/secure-repo/remediation/workflow/metadata"
 	"github.com/step-security/secure-repo/remediation/workflow/permissions"
 	"github.com/step-security/secure-repo/remediation/workflow/pin"
+	"github.com/step-security/secure-repo/remediation/workflow/runson"
 	"gopkg.in/yaml.v3"
 )
 
@@ -22,53 +24,25 @@ type HardenRunnerConfig struct {
 	Subtractive      bool     `json:"subtractive"`
 	SkipHardenRunner bool     `json:"skipHardenRunner"`
 	RunnerLabels     []string `json:"runnerLabels"`
+	// CompositeActionInput, if set, adds harden-runner to composite actions,
+	// guarded by an input with this name that callers set to 'true'
+	CompositeActionInput string `json:"compositeActionInput"`
+	// BlockEgress sets egress-policy: block with the endpoints from the knowledge base
+	// for jobs where every action has endpoint data. Other jobs get Config.
+	BlockEgress bool `json:"blockEgress"`
+	// Telemetry is the egress harden-runner observed in audit mode. Jobs in it get
+	// egress-policy: block with exactly the observed endpoints, and an existing
+	// audit step is converted in place.
+	Telemetry *EgressTelemetry `json:"telemetry"`
+	// Rules select a different config for some jobs, e.g. block for release jobs.
+	// Jobs no rule matches get Config.
+	Rules []PolicyRule `json:"rules"`
 }
 
-// getJobRunsOnLabels extracts the runs-on labels from a job's yaml.Node.
-// Handles scalar (runs-on: ubuntu-latest), sequence (runs-on: [self-hosted, linux]),
-// and mapping with labels key (runs-on: {labels: [self-hosted, linux]}) formats.
-func getJobRunsOnLabels(jobNode *yaml.Node) []string {
-	for i := 0; i < len(jobNode.Content); i += 2 {
-		keyNode := jobNode.Content[i]
-		if keyNode.Value == "runs-on" && i+1 < len(jobNode.Content) {
-			return extractLabels(jobNode.Content[i+1])
-		}
-	}
-	return nil
-}
-
-// extractLabels extracts labels from a yaml.Node that can be a scalar, sequence, or mapping with a "labels" key.
-func extractLabels(node *yaml.Node) []string {
-	switch node.Kind {
-	case yaml.ScalarNode:
-		return []string{node.Value}
-	case yaml.SequenceNode:
-		var labels []string
-		for _, item := range node.Content {
-			labels = append(labels, item.Value)
-		}
-		return labels
-	case yaml.MappingNode:
-		for j := 0; j < len(node.Content); j += 2 {
-			if node.Content[j].Value == "labels" && j+1 < len(node.Content) {
-				return extractLabels(node.Content[j+1])
-			}
-		}
-	}
-	return nil
-}
-
-// shouldSkipJob returns true if none of the job's runs-on labels match the allowed labels.
-func shouldSkipJob(jobLabels []string, allowedLabels []string) bool {
-	for _, jl := range jobLabels {
-		for _, al := range allowedLabels {
-			// TODO CHECK CASE INSENSITIVE MATCHING
-			if jl == al {
-				return false
-			}
-		}
-	}
-	return true
+// shouldSkipJob returns true if none of the job's runs-on labels, or its runner group,
+// match the allowed labels. Matrix expressions are expanded, see runson.Resolve.
+func shouldSkipJob(jobNode *yaml.Node, allowedLabels []string) bool {
+	return !runson.Resolve(jobNode).Matches(allowedLabels)
 }
 
 // getActionFromConfig parses the "uses:" line from the Config yaml string.
@@ -126,6 +100,13 @@ func leadingWhitespace(s string) string {
 }
 
 func AddAction(inputYaml string, hardenRunnerConfig HardenRunnerConfig, pinActions, pinToImmutable bool, skipContainerJobs bool) (string, bool, error) {
+	out, updated, _, err := AddActionWithReport(inputYaml, hardenRunnerConfig, pinActions, pinToImmutable, skipContainerJobs)
+	return out, updated, err
+}
+
+// AddActionWithReport is AddAction that also reports which of hardenRunnerConfig.Rules
+// selected the config of each job. The report is empty if there are no rules.
+func AddActionWithReport(inputYaml string, hardenRunnerConfig HardenRunnerConfig, pinActions, pinToImmutable bool, skipContainerJobs bool) (string, bool, []JobPolicy, error) {
 	if hardenRunnerConfig.Config == "" {
 		hardenRunnerConfig.Config = DefaultHardenRunnerConfig
 	}
@@ -133,7 +114,7 @@ func AddAction(inputYaml string, hardenRunnerConfig HardenRunnerConfig, pinActio
 	updated := false
 	err := yaml.Unmarshal([]byte(inputYaml), &workflow)
 	if err != nil {
-		return inputYaml, updated, fmt.Errorf("unable to parse yaml %v", err)
+		return inputYaml, updated, nil, fmt.Errorf("unable to parse yaml %v", err)
 	}
 
 	// Extract the action path from the config to detect custom actions already present.
@@ -142,9 +123,11 @@ func AddAction(inputYaml string, hardenRunnerConfig HardenRunnerConfig, pinActio
 
 	// Build a map of jobName → yaml.Node for runs-on label lookup
 	jobNodeMap := map[string]*yaml.Node{}
-	if hardenRunnerConfig.SkipHardenRunner && len(hardenRunnerConfig.RunnerLabels) > 0 {
+	var events []string
+	if (hardenRunnerConfig.SkipHardenRunner && len(hardenRunnerConfig.RunnerLabels) > 0) || len(hardenRunnerConfig.Rules) > 0 {
 		t := yaml.Node{}
 		if err := yaml.Unmarshal([]byte(inputYaml), &t); err == nil {
+			events = getWorkflowEvents(&t)
 			jobsNode := permissions.IterateNode(&t, "jobs", "!!map", 0)
 			if jobsNode != nil {
 				for i := 0; i < len(jobsNode.Content); i += 2 {
@@ -155,9 +138,31 @@ func AddAction(inputYaml string, hardenRunnerConfig HardenRunnerConfig, pinActio
 	}
 
 	out := inputYaml
+	var policies []JobPolicy
+	// actions of rule configs, pinned along with the default config's action
+	ruleActions := map[string]bool{}
 
+	if workflow.Runs.Using == "composite" && hardenRunnerConfig.CompositeActionInput != "" {
+		alreadyPresent := false
+		for _, step := range workflow.Runs.Steps {
+			if len(step.Uses) > 0 && (strings.HasPrefix(step.Uses, HardenRunnerActionPath) || strings.HasPrefix(step.Uses, configActionPath)) {
+				alreadyPresent = true
+				break
+			}
+		}
+		if !alreadyPresent {
+			out, updated, err = addCompositeAction(out, hardenRunnerConfig, hardenRunnerConfig.CompositeActionInput)
+			if err != nil {
+				return out, updated, nil, err
+			}
+		}
+	}
+
+	// Jobs of a reusable workflow (on: workflow_call) run on their own runners, so each
+	// gets its own harden-runner step like any other job; hardening the calling job
+	// does not cover them. The calling job itself has no steps and is skipped.
 	for jobName, job := range workflow.Jobs {
-		// Skip adding action for reusable jobs
+		// Skip adding action for jobs calling reusable workflows, they can't have steps
 		if metadata.IsCallingReusableWorkflow(job) {
 			continue
 		}
@@ -168,33 +173,68 @@ func AddAction(inputYaml string, hardenRunnerConfig HardenRunnerConfig, pinActio
 		// Skip jobs whose runs-on label doesn't match the allowed labels
 		if hardenRunnerConfig.SkipHardenRunner && len(hardenRunnerConfig.RunnerLabels) > 0 {
 			if jn, ok := jobNodeMap[jobName]; ok {
-				if shouldSkipJob(getJobRunsOnLabels(jn), hardenRunnerConfig.RunnerLabels) {
+				if shouldSkipJob(jn, hardenRunnerConfig.RunnerLabels) {
 					continue
 				}
 			}
 		}
+		jobConfig := hardenRunnerConfig
+		jobAction, jobActionPath := configAction, configActionPath
+		if len(hardenRunnerConfig.Rules) > 0 {
+			rule, matched := selectPolicyRule(hardenRunnerConfig.Rules, workflow, events, jobName, job, jobNodeMap[jobName])
+			policies = append(policies, JobPolicy{JobName: jobName, Rule: rule.Name})
+			if matched && rule.Config != "" {
+				jobConfig.Config = rule.Config
+				// the rule's config is used as written
+				jobConfig.BlockEgress = false
+				jobAction = getActionFromConfig(jobConfig)
+				jobActionPath = strings.Split(jobAction, "@")[0]
+				ruleActions[jobAction] = true
+			}
+		}
+
 		alreadyPresent := false
 		for _, step := range job.Steps {
-			if len(step.Uses) > 0 && (strings.HasPrefix(step.Uses, HardenRunnerActionPath) || strings.HasPrefix(step.Uses, configActionPath)) {
+			if len(step.Uses) > 0 && (strings.HasPrefix(step.Uses, HardenRunnerActionPath) || strings.HasPrefix(step.Uses, jobActionPath)) {
 				alreadyPresent = true
 				break
 			}
 		}
 
-		if !alreadyPresent {
+		if jobConfig.BlockEgress {
+			if blockConfig, ok := getBlockEgressConfig(job, jobAction); ok {
+				jobConfig.Config = blockConfig
+			}
+		}
+
+		endpoints, hasTelemetry := getTelemetryEndpoints(hardenRunnerConfig.Telemetry, jobName)
+		if hasTelemetry {
+			jobConfig.Config = getTelemetryConfig(endpoints, jobAction)
+		}
+
+		if alreadyPresent && hasTelemetry {
+			var changed bool
+			out, changed, err = applyTelemetry(out, jobName, endpoints, jobActionPath)
+			if err != nil {
+				return out, updated, nil, err
+			}
+			if changed {
+				updated = true
+			}
+		} else if !alreadyPresent {
 			var changed bool
-			out, changed, err = addAction(out, jobName, hardenRunnerConfig)
+			out, changed, err = addAction(out, jobName, jobConfig)
 			if err != nil {
-				return out, updated, err
+				return out, updated, nil, err
 			}
 			if changed {
 				updated = true
 			}
 		} else if hardenRunnerConfig.Subtractive {
 			var changed bool
-			out, changed, err = updateHardenRunnerConfig(out, jobName, hardenRunnerConfig)
+			out, changed, err = updateHardenRunnerConfig(out, jobName, jobConfig)
 			if err != nil {
-				return out, updated, err
+				return out, updated, nil, err
 			}
 			if changed {
 				updated = true
@@ -203,15 +243,23 @@ func AddAction(inputYaml string, hardenRunnerConfig HardenRunnerConfig, pinActio
 	}
 
 	if updated && pinActions {
-		action := getActionFromConfig(hardenRunnerConfig)
-		pinnedOut, _, pinErr := pin.PinActionWithPatFallback(action, out, nil, pinToImmutable, nil)
-		if pinErr != nil {
-			// Non-fatal: keep the unpinned harden-runner step rather than dropping
-			// the addition entirely (matches previous net behavior, where this
-			// error was discarded by the caller).
-			log.Printf("unable to pin harden runner action, keeping unpinned: %v", pinErr)
-		} else {
-			out = pinnedOut
+		actions := []string{getActionFromConfig(hardenRunnerConfig)}
+		for action := range ruleActions {
+			if action != actions[0] {
+				actions = append(actions, action)
+			}
+		}
+		sort.Strings(actions[1:])
+		for _, action := range actions {
+			pinnedOut, _, pinErr := pin.PinActionWithPatFallback(action, out, nil, pinToImmutable, nil)
+			if pinErr != nil {
+				// Non-fatal: keep the unpinned harden-runner step rather than dropping
+				// the addition entirely (matches previous net behavior, where this
+				// error was discarded by the caller).
+				log.Printf("unable to pin harden runner action, keeping unpinned: %v", pinErr)
+			} else {
+				out = pinnedOut
+			}
 		}
 	}
 
@@ -219,7 +267,8 @@ func AddAction(inputYaml string, hardenRunnerConfig HardenRunnerConfig, pinActio
 		updated = false
 	}
 
-	return out, updated, nil
+	sort.Slice(policies, func(i, j int) bool { return policies[i].JobName < policies[j].JobName })
+	return out, updated, policies, nil
 }
 
 func hardenRunnerConfigMatches(inputLines []string, hrStartLine, hrEndLine int, spaces, config, existingTagOrSHA string) bool {
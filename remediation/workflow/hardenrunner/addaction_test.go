@@ -2,6 +2,7 @@ package hardenrunner
 
 import (
 	"io/ioutil"
+	"os"
 	"path"
 	"strings"
 	"testing"
@@ -32,6 +33,8 @@ func TestAddAction(t *testing.T) {
 		{name: "reusable job", args: args{inputYaml: "reusablejob.yml"}, want: "reusablejob.yml", wantErr: false, wantUpdated: false},
 		{name: "job name in input", args: args{inputYaml: "jobNameInInput.yml"}, want: "jobNameInInput.yml", wantErr: false, wantUpdated: true},
 		{name: "anchored and aliased steps", args: args{inputYaml: "anchored-steps.yml"}, want: "anchored-steps.yml", wantErr: false, wantUpdated: true},
+		{name: "reusable workflow", args: args{inputYaml: "reusableworkflow.yml"}, want: "reusableworkflow.yml", wantErr: false, wantUpdated: true},
+		{name: "composite action without input option", args: args{inputYaml: "compositeaction.yml"}, want: "../input/compositeaction.yml", wantErr: false, wantUpdated: false},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -49,7 +52,7 @@ func TestAddAction(t *testing.T) {
 				t.Errorf("AddAction() error = %v, wantErr %v", err, tt.wantErr)
 				return
 			}
-			output, err := ioutil.ReadFile(path.Join(outputDirectory, tt.args.inputYaml))
+			output, err := ioutil.ReadFile(path.Join(outputDirectory, tt.want))
 			if err != nil {
 				t.Fatalf("error reading test file")
 			}
@@ -60,6 +63,53 @@ func TestAddAction(t *testing.T) {
 	}
 }
 
+func TestAddActionCompositeAction(t *testing.T) {
+	const inputDirectory = "../../../testfiles/addaction/input"
+	const outputDirectory = "../../../testfiles/addaction/output"
+
+	tests := []struct {
+		name        string
+		inputFile   string
+		config      string
+		wantUpdated bool
+	}{
+		{name: "inputs added", inputFile: "compositeaction.yml", config: defaultTestConfig, wantUpdated: true},
+		{name: "existing inputs", inputFile: "compositeActionWithInputs.yml", config: defaultTestConfig, wantUpdated: true},
+		{name: "config starting with a blank line", inputFile: "compositeaction.yml", config: "\n" + defaultTestConfig, wantUpdated: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			input, err := ioutil.ReadFile(path.Join(inputDirectory, tt.inputFile))
+			if err != nil {
+				t.Fatalf("error reading input file: %v", err)
+			}
+			output, err := ioutil.ReadFile(path.Join(outputDirectory, tt.inputFile))
+			if err != nil {
+				t.Fatalf("error reading output file: %v", err)
+			}
+
+			config := HardenRunnerConfig{Config: tt.config, CompositeActionInput: "harden-runner"}
+			got, gotUpdated, err := AddAction(string(input), config, false, false, false)
+			if err != nil {
+				t.Fatalf("AddAction() error = %v", err)
+			}
+			if gotUpdated != tt.wantUpdated {
+				t.Errorf("AddAction() updated = %v, wantUpdated %v", gotUpdated, tt.wantUpdated)
+			}
+			if got != string(output) {
+				t.Errorf("AddAction() = %v, want %v", got, string(output))
+			}
+
+			// running again must not add a second step or input
+			again, againUpdated, err := AddAction(got, config, false, false, false)
+			if err != nil || againUpdated || again != got {
+				t.Errorf("AddAction() is not idempotent for composite actions\n%s", again)
+			}
+		})
+	}
+}
+
 func TestCustomActionConfig(t *testing.T) {
 	const inputDirectory = "../../../testfiles/addaction/input"
 	const outputDirectory = "../../../testfiles/addaction/output"
@@ -415,6 +465,16 @@ func TestRunnerLabelFiltering(t *testing.T) {
 			wantUpdated: false,
 			unchanged:   true,
 		},
+		{
+			name:      "matrix expression, runner group and label case",
+			inputFile: "labelMatrix.yml",
+			config: HardenRunnerConfig{
+				SkipHardenRunner: true,
+				RunnerLabels:     []string{"ubuntu-latest", "Large-Runners"},
+			},
+			wantUpdated: true,
+			outputFile:  "labelMatrix.yml",
+		},
 		{
 			name:      "mapping with group only no labels key",
 			inputFile: "labelMappingNoLabels.yml",
@@ -834,3 +894,188 @@ func TestAddActionInvalidYamlReturnsInput(t *testing.T) {
 		t.Errorf("AddAction() on invalid yaml returned %q, want the input unchanged", out)
 	}
 }
+
+func TestAddActionBlockEgress(t *testing.T) {
+	const inputDirectory = "../../../testfiles/addaction/input"
+	const outputDirectory = "../../../testfiles/addaction/output"
+	os.Setenv("KBFolder", "../../../knowledge-base/actions")
+
+	input, err := ioutil.ReadFile(path.Join(inputDirectory, "blockEgress.yml"))
+	if err != nil {
+		t.Fatalf("error reading test file: %v", err)
+	}
+	// build gets a block policy, local-action and cache fall back to audit since
+	// local actions and actions/cache have no endpoints in the knowledge base
+	config := HardenRunnerConfig{BlockEgress: true}
+	got, gotUpdated, err := AddAction(string(input), config, false, false, false)
+	if err != nil {
+		t.Fatalf("AddAction() error = %v", err)
+	}
+	if !gotUpdated {
+		t.Error("AddAction() expected updated = true")
+	}
+	expected, err := ioutil.ReadFile(path.Join(outputDirectory, "blockEgress.yml"))
+	if err != nil {
+		t.Fatalf("error reading output file: %v", err)
+	}
+	if got != string(expected) {
+		t.Errorf("AddAction() with block egress mismatch\nGot:\n%s\nWant:\n%s", got, string(expected))
+	}
+
+	// running again in subtractive mode leaves the generated policies unchanged
+	config.Subtractive = true
+	again, gotUpdated, err := AddAction(got, config, false, false, false)
+	if err != nil {
+		t.Fatalf("AddAction() error = %v", err)
+	}
+	if gotUpdated || again != got {
+		t.Errorf("AddAction() with block egress is not idempotent\nGot:\n%s", again)
+	}
+}
+
+func TestAddActionTelemetry(t *testing.T) {
+	const inputDirectory = "../../../testfiles/addaction/input"
+	const outputDirectory = "../../../testfiles/addaction/output"
+
+	content, err := ioutil.ReadFile(path.Join(inputDirectory, "telemetry.json"))
+	if err != nil {
+		t.Fatalf("error reading telemetry file: %v", err)
+	}
+	telemetry, err := ParseEgressTelemetry(content)
+	if err != nil {
+		t.Fatalf("ParseEgressTelemetry() error = %v", err)
+	}
+
+	input, err := ioutil.ReadFile(path.Join(inputDirectory, "telemetry.yml"))
+	if err != nil {
+		t.Fatalf("error reading test file: %v", err)
+	}
+	// build and release have their audit steps converted in place, test gets a
+	// new block step, and lint has no telemetry so it stays in audit mode
+	config := HardenRunnerConfig{Telemetry: telemetry}
+	got, gotUpdated, err := AddAction(string(input), config, false, false, false)
+	if err != nil {
+		t.Fatalf("AddAction() error = %v", err)
+	}
+	if !gotUpdated {
+		t.Error("AddAction() expected updated = true")
+	}
+	expected, err := ioutil.ReadFile(path.Join(outputDirectory, "telemetry.yml"))
+	if err != nil {
+		t.Fatalf("error reading output file: %v", err)
+	}
+	if got != string(expected) {
+		t.Errorf("AddAction() with telemetry mismatch\nGot:\n%s\nWant:\n%s", got, string(expected))
+	}
+
+	again, gotUpdated, err := AddAction(got, config, false, false, false)
+	if err != nil {
+		t.Fatalf("AddAction() error = %v", err)
+	}
+	if gotUpdated || again != got {
+		t.Errorf("AddAction() with telemetry is not idempotent\nGot:\n%s", again)
+	}
+}
+
+func TestParseEgressTelemetryYAML(t *testing.T) {
+	telemetry, err := ParseEgressTelemetry([]byte("jobs:\n  build:\n    - domain: GitHub.com\n      process: git\n    - domain: github.com\n      port: 443\n      process: git\n"))
+	if err != nil {
+		t.Fatalf("ParseEgressTelemetry() error = %v", err)
+	}
+	endpoints, ok := getTelemetryEndpoints(telemetry, "build")
+	if !ok {
+		t.Fatal("getTelemetryEndpoints() expected telemetry for build")
+	}
+	if len(endpoints) != 1 || endpoints[0].endpoint != "github.com:443" || strings.Join(endpoints[0].reasons, ",") != "git" {
+		t.Errorf("getTelemetryEndpoints() = %+v, want github.com:443 called by git", endpoints[0])
+	}
+	if _, ok := getTelemetryEndpoints(telemetry, "test"); ok {
+		t.Error("getTelemetryEndpoints() expected no telemetry for test")
+	}
+
+	if _, err := ParseEgressTelemetry([]byte("jobs: [")); err == nil {
+		t.Error("ParseEgressTelemetry() expected error for invalid input")
+	}
+}
+
+func TestGetWorkflowEvents(t *testing.T) {
+	tests := []struct {
+		name   string
+		input  string
+		events []string
+	}{
+		{name: "scalar form", input: "on: push", events: []string{"push"}},
+		{name: "sequence form", input: "on: [push, workflow_call]", events: []string{"push", "workflow_call"}},
+		{name: "mapping form", input: "on:\n  workflow_call:\n    inputs: {}\n  pull_request:\n", events: []string{"workflow_call", "pull_request"}},
+		{name: "missing", input: "name: test", events: nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := yaml.Node{}
+			if err := yaml.Unmarshal([]byte(tt.input), &root); err != nil {
+				t.Fatalf("unexpected parse error: %v", err)
+			}
+			if events := getWorkflowEvents(&root); strings.Join(events, ",") != strings.Join(tt.events, ",") {
+				t.Errorf("getWorkflowEvents() = %v, want %v", events, tt.events)
+			}
+		})
+	}
+}
+
+func TestAddActionPolicyRules(t *testing.T) {
+	const inputDirectory = "../../../testfiles/addaction/input"
+	const outputDirectory = "../../../testfiles/addaction/output"
+
+	const blockConfig = "- name: Harden the runner (Block outbound calls)\n  uses: step-security/harden-runner@v2\n  with:\n    egress-policy: block\n    disable-sudo: true\n    allowed-endpoints: >\n      github.com:443"
+	const sudoConfig = "- name: Harden the runner (Audit all outbound calls)\n  uses: step-security/harden-runner@v2\n  with:\n    egress-policy: audit\n    disable-sudo: true"
+	const customConfig = "- name: Custom runner hardening\n  uses: my-org/custom-runner@v1"
+
+	config := HardenRunnerConfig{
+		Rules: []PolicyRule{
+			{Name: "release-jobs", JobName: "release-*", Config: blockConfig},
+			{Name: "production", Environment: "production", Config: blockConfig},
+			{Name: "nightly", Event: "schedule", Config: customConfig},
+			{Name: "writers", WritePermissions: true, Config: sudoConfig},
+			{Name: "self-hosted", RunnerLabel: "self-hosted", Event: "release", Config: customConfig},
+		},
+	}
+
+	input, err := ioutil.ReadFile(path.Join(inputDirectory, "policyRules.yml"))
+	if err != nil {
+		t.Fatalf("error reading test file: %v", err)
+	}
+	got, gotUpdated, policies, err := AddActionWithReport(string(input), config, false, false, false)
+	if err != nil {
+		t.Fatalf("AddActionWithReport() error = %v", err)
+	}
+	if !gotUpdated {
+		t.Error("AddActionWithReport() expected updated = true")
+	}
+	expected, err := ioutil.ReadFile(path.Join(outputDirectory, "policyRules.yml"))
+	if err != nil {
+		t.Fatalf("error reading output file: %v", err)
+	}
+	if got != string(expected) {
+		t.Errorf("AddActionWithReport() with rules mismatch\nGot:\n%s\nWant:\n%s", got, string(expected))
+	}
+
+	var report []string
+	for _, policy := range policies {
+		report = append(report, policy.String())
+	}
+	want := []string{"deploy: production", "lint: default", "publish: writers", "release-build: release-jobs", "test: self-hosted"}
+	if strings.Join(report, "\n") != strings.Join(want, "\n") {
+		t.Errorf("AddActionWithReport() report = %v, want %v", report, want)
+	}
+
+	// subtractive mode keeps each job on the config its rule selected
+	config.Subtractive = true
+	again, gotUpdated, _, err := AddActionWithReport(got, config, false, false, false)
+	if err != nil {
+		t.Fatalf("AddActionWithReport() error = %v", err)
+	}
+	if gotUpdated || again != got {
+		t.Errorf("AddActionWithReport() with rules is not idempotent\nGot:\n%s", again)
+	}
+}
@@ -0,0 +1,105 @@
+package hardenrunner
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	metadata "github.com/step-security/secure-repo/remediation/workflow/metadata"
+	"gopkg.in/yaml.v3"
+)
+
+// insertion is a block of lines to insert before a line (0-based) of the input
+type insertion struct {
+	line  int
+	lines []string
+}
+
+// addCompositeAction adds the harden-runner step at the top of runs.steps of a composite action.
+// A composite action can not tell if it is the first step of the calling job, which harden-runner
+// needs to be, so the step only runs when the caller sets the input named inputName to 'true'.
+// The input is added to the action's inputs, defaulting to 'false'.
+func addCompositeAction(inputYaml string, hardenRunnerConfig HardenRunnerConfig, inputName string) (string, bool, error) {
+	t := yaml.Node{}
+	err := yaml.Unmarshal([]byte(inputYaml), &t)
+	if err != nil {
+		return inputYaml, false, fmt.Errorf("unable to parse yaml %v", err)
+	}
+	if len(t.Content) == 0 || t.Content[0].Kind != yaml.MappingNode {
+		return inputYaml, false, nil
+	}
+	root := t.Content[0]
+
+	runsKey, runsNode := metadata.GetMappingEntry(root, "runs")
+	if runsNode == nil {
+		return inputYaml, false, nil
+	}
+	_, stepsNode := metadata.GetMappingEntry(runsNode, "steps")
+	if stepsNode == nil || stepsNode.Kind != yaml.SequenceNode || stepsNode.Style == yaml.FlowStyle || len(stepsNode.Content) == 0 {
+		return inputYaml, false, nil
+	}
+
+	inputLines := strings.Split(inputYaml, "\n")
+	var insertions []insertion
+
+	// the guarded harden-runner step, before the first step
+	insertLine := stepsNode.Content[0].Line - 1
+	spaces := leadingWhitespace(inputLines[insertLine])
+	var stepLines []string
+	for _, line := range strings.Split(hardenRunnerConfig.Config, "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		stepLines = append(stepLines, spaces+line)
+		if len(stepLines) == 1 {
+			// step keys are indented past the "- " of the first line
+			stepLines = append(stepLines, spaces+"  "+fmt.Sprintf("if: inputs.%s == 'true'", inputName))
+		}
+	}
+	stepLines = append(stepLines, "")
+	insertions = append(insertions, insertion{line: insertLine, lines: stepLines})
+
+	// the input that enables it
+	inputsKey, inputsNode := metadata.GetMappingEntry(root, "inputs")
+	if inputsNode == nil {
+		keySpaces := leadingWhitespace(inputLines[runsKey.Line-1])
+		insertions = append(insertions, insertion{
+			line:  runsKey.Line - 1,
+			lines: append([]string{keySpaces + "inputs:"}, compositeInputLines(keySpaces+"  ", inputName)...),
+		})
+	} else if _, existing := metadata.GetMappingEntry(inputsNode, inputName); existing == nil {
+		if inputsNode.Kind != yaml.MappingNode || inputsNode.Style == yaml.FlowStyle || len(inputsNode.Content) == 0 {
+			// e.g. inputs: {}, which can not be edited by inserting lines
+			return inputYaml, false, nil
+		}
+		firstInputLine := inputsNode.Content[0].Line - 1
+		if inputsNode.Content[0].Line == inputsKey.Line {
+			return inputYaml, false, nil
+		}
+		insertions = append(insertions, insertion{
+			line:  firstInputLine,
+			lines: compositeInputLines(leadingWhitespace(inputLines[firstInputLine]), inputName),
+		})
+	}
+
+	// insert from the bottom up so earlier line numbers stay valid
+	sort.Slice(insertions, func(i, j int) bool { return insertions[i].line > insertions[j].line })
+	for _, ins := range insertions {
+		var output []string
+		output = append(output, inputLines[:ins.line]...)
+		output = append(output, ins.lines...)
+		output = append(output, inputLines[ins.line:]...)
+		inputLines = output
+	}
+
+	return strings.Join(inputLines, "\n"), true, nil
+}
+
+func compositeInputLines(spaces, inputName string) []string {
+	return []string{
+		spaces + inputName + ":",
+		spaces + "  description: \"Set to 'true' to harden the runner, when this action is the first step of the job\"",
+		spaces + "  required: false",
+		spaces + "  default: 'false'",
+	}
+}
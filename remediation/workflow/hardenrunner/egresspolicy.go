@@ -0,0 +1,135 @@
+package hardenrunner
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	metadata "github.com/step-security/secure-repo/remediation/workflow/metadata"
+)
+
+const HardenRunnerBlockActionName = "Harden the runner (Block outbound calls)"
+
+// toolchainEndpoints are endpoints the toolchains installed by setup actions use
+// in later run steps, e.g. npm install after actions/setup-node. The knowledge base
+// only lists what the setup action itself downloads.
+var toolchainEndpoints = map[string][]metadata.AllowedEndpoint{
+	"actions/setup-node": {
+		{FQDN: "registry.npmjs.org", Port: 443, Reason: "to install npm packages"},
+	},
+	"actions/setup-go": {
+		{FQDN: "proxy.golang.org", Port: 443, Reason: "to download Go modules"},
+		{FQDN: "sum.golang.org", Port: 443, Reason: "to verify Go modules"},
+	},
+	"actions/setup-python": {
+		{FQDN: "pypi.org", Port: 443, Reason: "to install pip packages"},
+		{FQDN: "files.pythonhosted.org", Port: 443, Reason: "to install pip packages"},
+	},
+	"actions/setup-java": {
+		{FQDN: "repo.maven.apache.org", Port: 443, Reason: "to download Maven dependencies"},
+		{FQDN: "services.gradle.org", Port: 443, Reason: "to download Gradle"},
+		{FQDN: "plugins.gradle.org", Port: 443, Reason: "to download Gradle plugins"},
+	},
+	"actions/setup-dotnet": {
+		{FQDN: "api.nuget.org", Port: 443, Reason: "to install NuGet packages"},
+	},
+	"ruby/setup-ruby": {
+		{FQDN: "rubygems.org", Port: 443, Reason: "to install gems"},
+		{FQDN: "index.rubygems.org", Port: 443, Reason: "to install gems"},
+	},
+}
+
+// endpointReason is an allowed endpoint and why the job needs it
+type endpointReason struct {
+	endpoint string
+	reasons  []string
+}
+
+// getBlockEgressConfig returns a harden-runner step with egress-policy: block and the
+// endpoints the job's actions need, from the knowledge base. It returns false if any
+// action has no endpoint data, since blocking would then break the job.
+func getBlockEgressConfig(job metadata.Job, action string) (string, bool) {
+	endpoints := make(map[string]*endpointReason)
+	addEndpoint := func(e metadata.AllowedEndpoint, actionKey string) {
+		port := e.Port
+		if port == 0 {
+			port = 443
+		}
+		key := fmt.Sprintf("%s:%d", e.FQDN, port)
+		reason := fmt.Sprintf("%s (%s)", strings.TrimSpace(e.Reason), actionKey)
+		if existing, ok := endpoints[key]; ok {
+			existing.reasons = append(existing.reasons, reason)
+			return
+		}
+		endpoints[key] = &endpointReason{endpoint: key, reasons: []string{reason}}
+	}
+
+	for _, step := range job.Steps {
+		if len(step.Uses) == 0 {
+			continue
+		}
+		actionKey := strings.Split(step.Uses, "@")[0]
+		if strings.HasPrefix(actionKey, HardenRunnerActionPath) || strings.HasPrefix(actionKey, strings.Split(action, "@")[0]) {
+			continue
+		}
+		if !strings.Contains(step.Uses, "@") || strings.HasPrefix(step.Uses, "docker://") {
+			// local and docker actions are not in the knowledge base
+			return "", false
+		}
+
+		actionMetadata, err := metadata.GetActionKnowledgeBase(actionKey)
+		if err != nil || len(actionMetadata.AllowedEndpoints) == 0 {
+			return "", false
+		}
+		for _, e := range actionMetadata.AllowedEndpoints {
+			addEndpoint(e, actionKey)
+		}
+		for _, e := range toolchainEndpoints[strings.ToLower(actionKey)] {
+			addEndpoint(e, actionKey)
+		}
+	}
+
+	if len(endpoints) == 0 {
+		return "", false
+	}
+
+	lines := []string{
+		"- name: " + HardenRunnerBlockActionName,
+		"  uses: " + action,
+		"  with:",
+	}
+	for _, line := range blockPolicyLines(sortEndpoints(endpoints)) {
+		lines = append(lines, "    "+line)
+	}
+
+	return strings.Join(lines, "\n"), true
+}
+
+func sortEndpoints(endpoints map[string]*endpointReason) []*endpointReason {
+	sorted := make([]*endpointReason, 0, len(endpoints))
+	for _, e := range endpoints {
+		sorted = append(sorted, e)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].endpoint < sorted[j].endpoint })
+	return sorted
+}
+
+// blockPolicyLines returns the with: entries of a block policy for endpoints, unindented.
+// Reasons are written as comments above allowed-endpoints, since comments
+// inside the folded scalar would become endpoints.
+func blockPolicyLines(endpoints []*endpointReason) []string {
+	lines := []string{"egress-policy: block"}
+	if len(endpoints) == 0 {
+		return lines
+	}
+	for _, e := range endpoints {
+		if len(e.reasons) > 0 {
+			lines = append(lines, fmt.Sprintf("# %s - %s", e.endpoint, strings.Join(e.reasons, ", ")))
+		}
+	}
+	lines = append(lines, "allowed-endpoints: >")
+	for _, e := range endpoints {
+		lines = append(lines, "  "+e.endpoint)
+	}
+	return lines
+}
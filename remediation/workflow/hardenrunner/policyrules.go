@@ -0,0 +1,142 @@
+package hardenrunner
+
+import (
+	"fmt"
+	"path"
+
+	metadata "github.com/step-security/secure-repo/remediation/workflow/metadata"
+	"gopkg.in/yaml.v3"
+)
+
+// PolicyRule selects the harden-runner config for the jobs it matches. Every criterion
+// that is set must match; rules are checked in order and the first match wins.
+type PolicyRule struct {
+	// Name identifies the rule in the report
+	Name string `json:"name"`
+	// JobName is a glob matched against the job id, e.g. release-*
+	JobName string `json:"jobName"`
+	// RunnerLabel matches if it is one of the job's runs-on labels
+	RunnerLabel string `json:"runnerLabel"`
+	// Event matches if the workflow is triggered by it, e.g. release
+	Event string `json:"event"`
+	// Environment matches the job's environment name
+	Environment string `json:"environment"`
+	// WritePermissions matches jobs whose GITHUB_TOKEN has any write permission
+	WritePermissions bool `json:"writePermissions"`
+	// Config is the harden-runner step for matching jobs, in the format of HardenRunnerConfig.Config
+	Config string `json:"config"`
+}
+
+// JobPolicy records which rule selected the config of a job
+type JobPolicy struct {
+	JobName string
+	// Rule is the name of the matching rule, empty if the default config was used
+	Rule string
+}
+
+func (p JobPolicy) String() string {
+	if p.Rule == "" {
+		return fmt.Sprintf("%s: default", p.JobName)
+	}
+	return fmt.Sprintf("%s: %s", p.JobName, p.Rule)
+}
+
+// selectPolicyRule returns the first rule that matches the job. events are the
+// events that trigger the workflow, see getWorkflowEvents.
+func selectPolicyRule(rules []PolicyRule, workflow metadata.Workflow, events []string, jobName string, job metadata.Job, jobNode *yaml.Node) (PolicyRule, bool) {
+	for _, rule := range rules {
+		if ruleMatches(rule, workflow, events, jobName, job, jobNode) {
+			return rule, true
+		}
+	}
+	return PolicyRule{}, false
+}
+
+func ruleMatches(rule PolicyRule, workflow metadata.Workflow, events []string, jobName string, job metadata.Job, jobNode *yaml.Node) bool {
+	if rule.JobName != "" {
+		if matched, err := path.Match(rule.JobName, jobName); err != nil || !matched {
+			return false
+		}
+	}
+	if rule.RunnerLabel != "" {
+		if jobNode == nil || shouldSkipJob(jobNode, []string{rule.RunnerLabel}) {
+			return false
+		}
+	}
+	if rule.Event != "" && !containsString(events, rule.Event) {
+		return false
+	}
+	if rule.Environment != "" && getJobEnvironment(jobNode) != rule.Environment {
+		return false
+	}
+	if rule.WritePermissions && !hasWritePermissions(workflow, job) {
+		return false
+	}
+	return true
+}
+
+// getWorkflowEvents returns the events that trigger a workflow, from any of the
+// scalar (on: push), sequence (on: [push, pull_request]) or mapping forms
+func getWorkflowEvents(root *yaml.Node) []string {
+	if root.Kind == yaml.DocumentNode && len(root.Content) > 0 {
+		root = root.Content[0]
+	}
+	onNode := metadata.GetMappingValue(root, "on")
+	if onNode == nil {
+		return nil
+	}
+	var events []string
+	switch onNode.Kind {
+	case yaml.ScalarNode:
+		if onNode.Value != "" {
+			events = []string{onNode.Value}
+		}
+	case yaml.SequenceNode:
+		for _, eventNode := range onNode.Content {
+			events = append(events, eventNode.Value)
+		}
+	case yaml.MappingNode:
+		for i := 0; i < len(onNode.Content); i += 2 {
+			events = append(events, onNode.Content[i].Value)
+		}
+	}
+	return events
+}
+
+// getJobEnvironment returns the environment name of a job, in either the
+// environment: production or environment: {name: production} form
+func getJobEnvironment(jobNode *yaml.Node) string {
+	if jobNode == nil {
+		return ""
+	}
+	_, environmentNode := metadata.GetMappingEntry(jobNode, "environment")
+	if environmentNode == nil {
+		return ""
+	}
+	if environmentNode.Kind == yaml.MappingNode {
+		_, environmentNode = metadata.GetMappingEntry(environmentNode, "name")
+		if environmentNode == nil {
+			return ""
+		}
+	}
+	return environmentNode.Value
+}
+
+// hasWritePermissions reports whether the job's token can write. Job permissions
+// override the workflow's; if neither sets them the repository default applies,
+// which can not be known from the workflow, so it does not match.
+func hasWritePermissions(workflow metadata.Workflow, job metadata.Job) bool {
+	permissions := workflow.Permissions
+	if job.Permissions.IsSet {
+		permissions = job.Permissions
+	}
+	if permissions.WriteAll {
+		return true
+	}
+	for _, access := range permissions.Scopes {
+		if access == "write" {
+			return true
+		}
+	}
+	return false
+}
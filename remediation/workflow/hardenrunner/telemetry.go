@@ -0,0 +1,188 @@
+package hardenrunner
+
+import (
+	"fmt"
+	"strings"
+
+	metadata "github.com/step-security/secure-repo/remediation/workflow/metadata"
+	"gopkg.in/yaml.v3"
+)
+
+// ObservedCall is an outbound call harden-runner recorded in audit mode
+type ObservedCall struct {
+	Domain  string `json:"domain" yaml:"domain"`
+	Port    int    `json:"port" yaml:"port"`
+	Process string `json:"process" yaml:"process"`
+}
+
+// EgressTelemetry is the outbound calls observed for each job, keyed by job id, e.g.
+//
+//	jobs:
+//	  build:
+//	    - domain: registry.npmjs.org
+//	      port: 443
+//	      process: node
+type EgressTelemetry struct {
+	Jobs map[string][]ObservedCall `json:"jobs" yaml:"jobs"`
+}
+
+// ParseEgressTelemetry parses telemetry in JSON or YAML
+func ParseEgressTelemetry(content []byte) (*EgressTelemetry, error) {
+	telemetry := &EgressTelemetry{}
+	// JSON is valid YAML
+	if err := yaml.Unmarshal(content, telemetry); err != nil {
+		return nil, fmt.Errorf("unable to parse egress telemetry %v", err)
+	}
+	return telemetry, nil
+}
+
+// getTelemetryEndpoints returns the observed endpoints of a job, with the processes
+// that called them as reasons. It returns false if there is no telemetry for the job.
+func getTelemetryEndpoints(telemetry *EgressTelemetry, jobName string) ([]*endpointReason, bool) {
+	if telemetry == nil {
+		return nil, false
+	}
+	calls, ok := telemetry.Jobs[jobName]
+	if !ok {
+		return nil, false
+	}
+
+	endpoints := make(map[string]*endpointReason)
+	for _, call := range calls {
+		if call.Domain == "" {
+			continue
+		}
+		port := call.Port
+		if port == 0 {
+			port = 443
+		}
+		key := fmt.Sprintf("%s:%d", strings.ToLower(call.Domain), port)
+		e, ok := endpoints[key]
+		if !ok {
+			e = &endpointReason{endpoint: key}
+			endpoints[key] = e
+		}
+		if call.Process != "" && !containsString(e.reasons, call.Process) {
+			e.reasons = append(e.reasons, call.Process)
+		}
+	}
+	return sortEndpoints(endpoints), true
+}
+
+// getTelemetryConfig returns a harden-runner step that blocks everything but the observed endpoints
+func getTelemetryConfig(endpoints []*endpointReason, action string) string {
+	lines := []string{
+		"- name: " + HardenRunnerBlockActionName,
+		"  uses: " + action,
+		"  with:",
+	}
+	for _, line := range blockPolicyLines(endpoints) {
+		lines = append(lines, "    "+line)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// applyTelemetry converts the job's existing harden-runner step to egress-policy: block
+// with the observed endpoints. egress-policy and allowed-endpoints are replaced; other
+// with: keys such as disable-sudo are kept as written.
+func applyTelemetry(inputYaml, jobName string, endpoints []*endpointReason, configActionPath string) (string, bool, error) {
+	hrStartLine, hrEndLine, _, _, _, err := getHardenRunnerStepLines(inputYaml, jobName, configActionPath)
+	if err != nil {
+		return inputYaml, false, err
+	}
+	if hrStartLine < 0 {
+		return inputYaml, false, nil
+	}
+
+	t := yaml.Node{}
+	if err := yaml.Unmarshal([]byte(inputYaml), &t); err != nil {
+		return inputYaml, false, fmt.Errorf("unable to parse yaml %v", err)
+	}
+	stepsNode := getJobStepsNode(&t, jobName)
+	var stepNode *yaml.Node
+	for _, s := range stepsNode.Content {
+		if s.Line-1 == hrStartLine {
+			stepNode = s
+			break
+		}
+	}
+	if stepNode == nil || stepNode.Kind != yaml.MappingNode || stepNode.Style == yaml.FlowStyle {
+		return inputYaml, false, nil
+	}
+
+	inputLines := strings.Split(inputYaml, "\n")
+	// the step ends before the blank lines that separate it from the next one
+	stepEnd := hrEndLine
+	for stepEnd > hrStartLine+1 && strings.TrimSpace(inputLines[stepEnd-1]) == "" {
+		stepEnd--
+	}
+	keySpaces := strings.Repeat(" ", stepNode.Content[0].Column-1)
+
+	var output []string
+	withKey, withNode := metadata.GetMappingEntry(stepNode, "with")
+	if withNode == nil {
+		output = append(output, inputLines[:stepEnd]...)
+		output = append(output, keySpaces+"with:")
+		for _, line := range blockPolicyLines(endpoints) {
+			output = append(output, keySpaces+"  "+line)
+		}
+		output = append(output, inputLines[stepEnd:]...)
+		return strings.Join(output, "\n"), true, nil
+	}
+	if withNode.Kind != yaml.MappingNode || withNode.Style == yaml.FlowStyle || len(withNode.Content) == 0 || withNode.Content[0].Line == withKey.Line {
+		// e.g. with: {egress-policy: audit}, which can not be edited by lines
+		return inputYaml, false, nil
+	}
+
+	// the with: block ends at the next key of the step
+	withEnd := stepEnd
+	for i := 0; i+1 < len(stepNode.Content); i += 2 {
+		if stepNode.Content[i].Line > withKey.Line && stepNode.Content[i].Line-1 < withEnd {
+			withEnd = stepNode.Content[i].Line - 1
+		}
+	}
+	for withEnd > withKey.Line && strings.TrimSpace(inputLines[withEnd-1]) == "" {
+		withEnd--
+	}
+
+	withSpaces := leadingWhitespace(inputLines[withNode.Content[0].Line-1])
+	var withLines []string
+	for _, line := range blockPolicyLines(endpoints) {
+		withLines = append(withLines, withSpaces+line)
+	}
+	for i := 0; i+1 < len(withNode.Content); i += 2 {
+		key := withNode.Content[i].Value
+		if key == "egress-policy" || key == "allowed-endpoints" {
+			continue
+		}
+		start := withNode.Content[i].Line - 1
+		end := withEnd
+		if i+2 < len(withNode.Content) {
+			end = withNode.Content[i+2].Line - 1
+		}
+		withLines = append(withLines, inputLines[start:end]...)
+	}
+
+	stepLines := inputLines[hrStartLine:withKey.Line]
+	if _, name := metadata.GetMappingEntry(stepNode, "name"); name != nil && name.Value == HardenRunnerActionName && name.Line < withKey.Line {
+		nameLine := name.Line - 1 - hrStartLine
+		stepLines = append([]string{}, stepLines...)
+		stepLines[nameLine] = strings.Replace(stepLines[nameLine], HardenRunnerActionName, HardenRunnerBlockActionName, 1)
+	}
+
+	output = append(output, inputLines[:hrStartLine]...)
+	output = append(output, stepLines...)
+	output = append(output, withLines...)
+	output = append(output, inputLines[withEnd:]...)
+	out := strings.Join(output, "\n")
+	return out, out != inputYaml, nil
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,152 @@
+package maintainedactions
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/step-security/secure-repo/remediation/workflow/pin"
+)
+
+//go:embed maintainedActions.json
+var embeddedCatalog []byte
+
+// catalogClient downloads catalogs passed as a URL
+var catalogClient = &http.Client{Timeout: 30 * time.Second}
+
+// Catalog is the list of maintained actions, looked up by the action they are forked from
+type Catalog struct {
+	Actions []Action
+	// byOriginal maps the lower case original action to its index in Actions
+	byOriginal map[string]int
+}
+
+// CatalogPolicy limits which catalog entries ReplaceActions uses
+type CatalogPolicy struct {
+	// MinScore skips catalog entries with a lower score. Replacements passed as a map
+	// and not in the catalog have no score and are not checked.
+	MinScore int `json:"minScore"`
+	// Allow limits replacements to original actions matching one of these patterns, e.g. tj-actions/*
+	Allow []string `json:"allow"`
+	// Deny never replaces original actions matching one of these patterns
+	Deny []string `json:"deny"`
+}
+
+// ActionReplacement is a step ReplaceActions replaced, with the catalog entry of the new action
+type ActionReplacement struct {
+	JobName        string
+	OriginalAction string
+	NewAction      string
+	Description    string
+	Score          int
+}
+
+func (r ActionReplacement) String() string {
+	s := fmt.Sprintf("%s: %s -> %s", r.JobName, r.OriginalAction, r.NewAction)
+	if r.Score > 0 {
+		s += fmt.Sprintf(" (score %d)", r.Score)
+	}
+	if r.Description != "" {
+		s += ": " + r.Description
+	}
+	return s
+}
+
+// ParseCatalog parses a JSON list of maintained actions
+func ParseCatalog(data []byte) (*Catalog, error) {
+	var actions []Action
+	if err := json.Unmarshal(data, &actions); err != nil {
+		return nil, fmt.Errorf("failed to parse maintained actions JSON: %v", err)
+	}
+
+	catalog := &Catalog{byOriginal: make(map[string]int)}
+	for _, action := range actions {
+		if action.ForkedFrom.Name == "" {
+			continue
+		}
+		catalog.byOriginal[strings.ToLower(action.ForkedFrom.Name)] = len(catalog.Actions)
+		catalog.Actions = append(catalog.Actions, action)
+	}
+	return catalog, nil
+}
+
+// LoadCatalog loads the maintained actions from a https URL or a local path.
+// An empty source loads the catalog embedded in this package. Plain http URLs are
+// rejected, since the catalog decides which actions workflows are moved to.
+func LoadCatalog(source string) (*Catalog, error) {
+	var data []byte
+	var err error
+	switch {
+	case source == "":
+		data = embeddedCatalog
+	case strings.HasPrefix(source, "http://"):
+		return nil, fmt.Errorf("maintained actions file must be loaded over https: %s", source)
+	case strings.HasPrefix(source, "https://"):
+		data, err = downloadCatalog(source)
+	default:
+		data, err = ioutil.ReadFile(source)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read maintained actions file: %v", err)
+	}
+	return ParseCatalog(data)
+}
+
+func downloadCatalog(url string) ([]byte, error) {
+	resp, err := catalogClient.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s returned %s", url, resp.Status)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+// Lookup returns the maintained action forked from original. Action names are not case sensitive.
+func (c *Catalog) Lookup(original string) (Action, bool) {
+	if c == nil {
+		return Action{}, false
+	}
+	i, ok := c.byOriginal[strings.ToLower(original)]
+	if !ok {
+		return Action{}, false
+	}
+	return c.Actions[i], true
+}
+
+// ActionMap returns the original action to maintained action map of the catalog
+func (c *Catalog) ActionMap() map[string]string {
+	actionMap := make(map[string]string)
+	for _, action := range c.Actions {
+		actionMap[action.ForkedFrom.Name] = action.Name
+	}
+	return actionMap
+}
+
+// Allows reports whether the policy allows replacing original with action, and if not why.
+// scored is false for replacements that are not in the catalog, whose score is not checked.
+func (p CatalogPolicy) Allows(original string, action Action, scored bool) (bool, string) {
+	if pin.ActionExists(original, p.Deny) {
+		return false, "denied by policy"
+	}
+	if len(p.Allow) > 0 && !pin.ActionExists(original, p.Allow) {
+		return false, "not in the allow list"
+	}
+	if scored && action.Score < p.MinScore {
+		return false, fmt.Sprintf("score %d is below the minimum of %d", action.Score, p.MinScore)
+	}
+	return true, ""
+}
+
+func sortReplacements(replacements []ActionReplacement) {
+	sort.Slice(replacements, func(i, j int) bool {
+		return replacements[i].String() < replacements[j].String()
+	})
+}
@@ -0,0 +1,169 @@
+package maintainedactions
+
+import (
+	"io/ioutil"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/jarcoal/httpmock"
+)
+
+const testCatalog = `[
+  {
+    "name": "step-security/action-semantic-pull-request",
+    "description": "Ensures that your PR title matches the Conventional Commits spec.",
+    "forkedFrom": {"name": "amannn/action-semantic-pull-request"},
+    "score": 10
+  },
+  {
+    "name": "step-security/skip-duplicate-actions",
+    "description": "Save time and cost when using GitHub Actions",
+    "forkedFrom": {"name": "fkirc/skip-duplicate-actions"},
+    "score": 4
+  },
+  {
+    "name": "step-security/git-restore-mtime-action",
+    "description": "Restore file modification times",
+    "forkedFrom": {"name": "chetan/git-restore-mtime-action"},
+    "score": 8
+  },
+  {
+    "name": "step-security/harden-runner",
+    "description": "Not a fork"
+  }
+]`
+
+func TestLoadCatalog(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	httpmock.RegisterResponder("GET", "https://example.com/maintainedActions.json",
+		httpmock.NewStringResponder(200, testCatalog))
+	httpmock.RegisterResponder("GET", "https://example.com/missing.json",
+		httpmock.NewStringResponder(404, `Not Found`))
+
+	embedded, err := LoadCatalog("")
+	if err != nil {
+		t.Fatalf("LoadCatalog() embedded error = %v", err)
+	}
+	local, err := LoadCatalog("maintainedActions.json")
+	if err != nil {
+		t.Fatalf("LoadCatalog() local error = %v", err)
+	}
+	if len(embedded.Actions) == 0 || len(embedded.Actions) != len(local.Actions) {
+		t.Errorf("LoadCatalog() embedded has %d actions, local file %d", len(embedded.Actions), len(local.Actions))
+	}
+
+	remote, err := LoadCatalog("https://example.com/maintainedActions.json")
+	if err != nil {
+		t.Fatalf("LoadCatalog() URL error = %v", err)
+	}
+	if len(remote.Actions) != 3 {
+		t.Errorf("LoadCatalog() URL got %d actions, want 3 forks", len(remote.Actions))
+	}
+	action, ok := remote.Lookup("FKirc/Skip-Duplicate-Actions")
+	if !ok || action.Name != "step-security/skip-duplicate-actions" || action.Score != 4 {
+		t.Errorf("Lookup() = %v, %v", action, ok)
+	}
+	if _, ok := remote.Lookup("step-security/harden-runner"); ok {
+		t.Error("Lookup() found an action that is not a fork")
+	}
+
+	if _, err := LoadCatalog("https://example.com/missing.json"); err == nil {
+		t.Error("LoadCatalog() expected an error for a missing URL")
+	}
+	if _, err := LoadCatalog("missing.json"); err == nil {
+		t.Error("LoadCatalog() expected an error for a missing file")
+	}
+	if _, err := LoadCatalog("http://example.com/maintainedActions.json"); err == nil {
+		t.Error("LoadCatalog() expected an error for a plain http URL")
+	}
+}
+
+func TestCatalogPolicyAllows(t *testing.T) {
+	action := Action{Name: "step-security/skip-duplicate-actions", Score: 4}
+	tests := []struct {
+		name       string
+		policy     CatalogPolicy
+		original   string
+		scored     bool
+		want       bool
+		wantReason string
+	}{
+		{"no policy", CatalogPolicy{}, "fkirc/skip-duplicate-actions", true, true, ""},
+		{"score too low", CatalogPolicy{MinScore: 5}, "fkirc/skip-duplicate-actions", true, false, "score 4 is below the minimum of 5"},
+		{"score not known", CatalogPolicy{MinScore: 5}, "fkirc/skip-duplicate-actions", false, true, ""},
+		{"denied", CatalogPolicy{Deny: []string{"fkirc/*"}}, "fkirc/skip-duplicate-actions", true, false, "denied by policy"},
+		{"allowed", CatalogPolicy{Allow: []string{"fkirc/*"}}, "fkirc/skip-duplicate-actions", true, true, ""},
+		{"not allowed", CatalogPolicy{Allow: []string{"amannn/*"}}, "fkirc/skip-duplicate-actions", true, false, "not in the allow list"},
+		{"deny wins", CatalogPolicy{Allow: []string{"fkirc/*"}, Deny: []string{"fkirc/skip-duplicate-actions"}}, "fkirc/skip-duplicate-actions", true, false, "denied by policy"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, reason := tt.policy.Allows(tt.original, action, tt.scored)
+			if got != tt.want || reason != tt.wantReason {
+				t.Errorf("Allows() = %v, %q, want %v, %q", got, reason, tt.want, tt.wantReason)
+			}
+		})
+	}
+}
+
+func TestReplaceActionsWithCatalog(t *testing.T) {
+	const inputDirectory = "../../../testfiles/maintainedActions/input"
+	const outputDirectory = "../../../testfiles/maintainedActions/output"
+
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	httpmock.RegisterResponder("GET", "https://api.github.com/repos/step-security/action-semantic-pull-request/releases/latest",
+		httpmock.NewStringResponder(200, `{"id":1,"tag_name":"v6.1.0","name":"v6.1.0"}`))
+	httpmock.RegisterResponder("GET", "https://api.github.com/repos/step-security/skip-duplicate-actions/releases/latest",
+		httpmock.NewStringResponder(200, `{"id":2,"tag_name":"v5.3.1","name":"v5.3.1"}`))
+	httpmock.RegisterResponder("GET", "https://api.github.com/repos/step-security/git-restore-mtime-action/releases/latest",
+		httpmock.NewStringResponder(200, `{"id":3,"tag_name":"v2.0.0","name":"v2.0.0"}`))
+	httpmock.RegisterResponder("GET", "https://api.github.com/repos/step-security/actions-cache/releases/latest",
+		httpmock.NewStringResponder(200, `{"id":4,"tag_name":"v4.0.0","name":"v4.0.0"}`))
+
+	catalog, err := ParseCatalog([]byte(testCatalog))
+	if err != nil {
+		t.Fatalf("ParseCatalog() error = %v", err)
+	}
+	input, err := ioutil.ReadFile(path.Join(inputDirectory, "oneJob_latest.yml"))
+	if err != nil {
+		t.Fatalf("error reading input file: %v", err)
+	}
+	expectedOutput, err := ioutil.ReadFile(path.Join(outputDirectory, "catalogPolicy.yml"))
+	if err != nil {
+		t.Fatalf("error reading expected output file: %v", err)
+	}
+
+	// the map adds a replacement the catalog does not have, which has no score to check
+	actionMap := map[string]string{"tespkg/actions-cache/restore": "step-security/actions-cache/restore"}
+	config := ReplaceActionsConfig{
+		Catalog: catalog,
+		Policy: CatalogPolicy{
+			MinScore: 5,
+			Deny:     []string{"chetan/*"},
+		},
+	}
+	response, err := ReplaceActionsWithConfig(string(input), actionMap, config)
+	if err != nil {
+		t.Fatalf("ReplaceActionsWithConfig() error = %v", err)
+	}
+	if response.FinalOutput != string(expectedOutput) {
+		t.Errorf("ReplaceActionsWithConfig() = %v, want %v", response.FinalOutput, string(expectedOutput))
+	}
+
+	var got []string
+	for _, replacement := range response.Replacements {
+		got = append(got, replacement.String())
+	}
+	want := []string{
+		"test: amannn/action-semantic-pull-request@v5 -> step-security/action-semantic-pull-request@v6 (score 10): Ensures that your PR title matches the Conventional Commits spec.",
+		"test: tespkg/actions-cache/restore@v1 -> step-security/actions-cache/restore@v4",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("ReplaceActionsWithConfig() replacements =\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
@@ -0,0 +1,170 @@
+package maintainedactions
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/google/go-github/v40/github"
+	"github.com/step-security/secure-repo/remediation/workflow/metadata"
+	"golang.org/x/oauth2"
+	"gopkg.in/yaml.v3"
+)
+
+// actionDefinition is the part of action.yml that decides whether one action can replace another
+type actionDefinition struct {
+	Inputs  map[string]actionInput  `yaml:"inputs"`
+	Outputs map[string]actionOutput `yaml:"outputs"`
+}
+
+type actionInput struct {
+	// Required is a string since action.yml files use both true and 'true'
+	Required string  `yaml:"required"`
+	Default  *string `yaml:"default"`
+}
+
+type actionOutput struct {
+	Description string `yaml:"description"`
+}
+
+// IncompatibleReplacement is a replacement whose inputs or outputs do not match the step
+type IncompatibleReplacement struct {
+	JobName        string
+	OriginalAction string
+	NewAction      string
+	Problems       []string
+	// Skipped is true if the step was left unchanged
+	Skipped bool
+}
+
+func (r IncompatibleReplacement) String() string {
+	action := "replaced"
+	if r.Skipped {
+		action = "skipped"
+	}
+	return fmt.Sprintf("%s: %s -> %s %s: %s", r.JobName, r.OriginalAction, r.NewAction, action, strings.Join(r.Problems, "; "))
+}
+
+// getActionDefinition fetches action.yml, or action.yaml, of action (owner/repo or owner/repo/path) at ref
+func getActionDefinition(action, ref string) (*actionDefinition, error) {
+	parts := strings.SplitN(action, "/", 3)
+	if len(parts) < 2 {
+		return nil, fmt.Errorf("invalid owner/repo format: %s", action)
+	}
+	owner, repo, dir := parts[0], parts[1], ""
+	if len(parts) == 3 {
+		dir = parts[2]
+	}
+
+	ctx := context.Background()
+	client := github.NewClient(nil)
+	token := os.Getenv("PAT")
+	if token != "" {
+		ts := oauth2.StaticTokenSource(&oauth2.Token{AccessToken: token})
+		client = github.NewClient(oauth2.NewClient(ctx, ts))
+	}
+
+	var lastErr error
+	for _, fileName := range []string{"action.yml", "action.yaml"} {
+		file, _, resp, err := client.Repositories.GetContents(ctx, owner, repo, path.Join(dir, fileName), &github.RepositoryContentGetOptions{Ref: ref})
+		if err != nil {
+			lastErr = err
+			if resp != nil && resp.StatusCode == http.StatusNotFound {
+				continue
+			}
+			break
+		}
+		if file == nil {
+			lastErr = fmt.Errorf("%s is not a file", fileName)
+			continue
+		}
+		content, err := file.GetContent()
+		if err != nil {
+			return nil, err
+		}
+		definition := &actionDefinition{}
+		if err := yaml.Unmarshal([]byte(content), definition); err != nil {
+			return nil, fmt.Errorf("unable to parse %s of %s@%s: %v", fileName, action, ref, err)
+		}
+		return definition, nil
+	}
+	return nil, fmt.Errorf("unable to get action.yml of %s@%s: %v", action, ref, lastErr)
+}
+
+// checkCompatibility compares the action.yml of the original action and its replacement
+// for the way the step uses it. A problem is an input the step passes that the new action
+// does not accept, a required input of the new action the step does not set, or an output
+// of the original action the workflow reads that the new action does not set.
+func checkCompatibility(inputYaml string, step metadata.Step, newAction, newVersion string) []string {
+	originalAction, originalRef := step.Uses, ""
+	if i := strings.Index(step.Uses, "@"); i >= 0 {
+		originalAction, originalRef = step.Uses[:i], step.Uses[i+1:]
+	}
+
+	original, err := getActionDefinition(originalAction, originalRef)
+	if err != nil {
+		return []string{fmt.Sprintf("unable to compare inputs: %v", err)}
+	}
+	replacement, err := getActionDefinition(newAction, newVersion)
+	if err != nil {
+		return []string{fmt.Sprintf("unable to compare inputs: %v", err)}
+	}
+
+	// input names are not case sensitive
+	newInputs := map[string]actionInput{}
+	for name, input := range replacement.Inputs {
+		newInputs[strings.ToLower(name)] = input
+	}
+	usedInputs := map[string]bool{}
+	for name := range step.With {
+		usedInputs[strings.ToLower(name)] = true
+	}
+
+	var problems []string
+	for _, name := range sortedKeys(step.With) {
+		if _, ok := newInputs[strings.ToLower(name)]; !ok {
+			problems = append(problems, fmt.Sprintf("input %s is not an input of %s@%s", name, newAction, newVersion))
+		}
+	}
+	for _, name := range sortedKeys(replacement.Inputs) {
+		input := replacement.Inputs[name]
+		if strings.EqualFold(strings.TrimSpace(input.Required), "true") && input.Default == nil && !usedInputs[strings.ToLower(name)] {
+			problems = append(problems, fmt.Sprintf("required input %s of %s@%s is not set", name, newAction, newVersion))
+		}
+	}
+	if step.ID != "" {
+		for _, name := range sortedKeys(original.Outputs) {
+			if _, ok := replacement.Outputs[name]; ok {
+				continue
+			}
+			if strings.Contains(inputYaml, fmt.Sprintf("steps.%s.outputs.%s", step.ID, name)) {
+				problems = append(problems, fmt.Sprintf("output %s is used but not set by %s@%s", name, newAction, newVersion))
+			}
+		}
+	}
+	return problems
+}
+
+func sortedKeys(m interface{}) []string {
+	var keys []string
+	switch v := m.(type) {
+	case metadata.With:
+		for key := range v {
+			keys = append(keys, key)
+		}
+	case map[string]actionInput:
+		for key := range v {
+			keys = append(keys, key)
+		}
+	case map[string]actionOutput:
+		for key := range v {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -312,6 +312,16 @@ func TestLoadMaintainedActions_ReadError(t *testing.T) {
 	}
 }
 
+func TestLoadMaintainedActions_Embedded(t *testing.T) {
+	actionMap, err := LoadMaintainedActions("")
+	if err != nil {
+		t.Fatalf("expected the embedded catalog for an empty path, got %v", err)
+	}
+	if actionMap["amannn/action-semantic-pull-request"] != "step-security/action-semantic-pull-request" {
+		t.Errorf("embedded catalog is missing amannn/action-semantic-pull-request, got %v", actionMap)
+	}
+}
+
 func TestLoadMaintainedActions_InvalidJSON(t *testing.T) {
 	dir := t.TempDir()
 	f := path.Join(dir, "bad.json")
@@ -1,10 +1,10 @@
 package maintainedactions
 
 import (
-	"encoding/json"
 	"fmt"
-	"io/ioutil"
 	"log"
+	"regexp"
+	"sort"
 	"strings"
 
 	"github.com/step-security/secure-repo/remediation/workflow/metadata"
@@ -24,37 +24,29 @@ type Action struct {
 	Image string `json:"image"`
 }
 
+// versionCommentRegex matches the version comment of a pinned action, e.g. # v4.1.1
+var versionCommentRegex = regexp.MustCompile(`^\s*#\s*v?[0-9]`)
+
 type replacement struct {
 	jobName        string
 	stepIdx        int
 	newAction      string
 	originalAction string
 	latestVersion  string
+	// commitSHA is set if the step is pinned to a SHA, latestVersion is then its version comment
+	commitSHA string
 }
 
-// LoadMaintainedActions loads the maintained actions from the JSON file
+// LoadMaintainedActions loads the maintained actions from the JSON file, see LoadCatalog.
+// An empty jsonPath loads the catalog embedded in this package.
 func LoadMaintainedActions(jsonPath string) (map[string]string, error) {
-	// Read the JSON file
-	data, err := ioutil.ReadFile(jsonPath)
+	catalog, err := LoadCatalog(jsonPath)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read maintained actions file: %v", err)
-	}
-
-	// Parse the JSON
-	var actions []Action
-	if err := json.Unmarshal(data, &actions); err != nil {
-		return nil, fmt.Errorf("failed to parse maintained actions JSON: %v", err)
+		return nil, err
 	}
 
 	// Create a map of original actions to their Step Security replacements
-	actionMap := make(map[string]string)
-	for _, action := range actions {
-		if action.ForkedFrom.Name != "" {
-			actionMap[action.ForkedFrom.Name] = action.Name
-		}
-	}
-
-	return actionMap, nil
+	return catalog.ActionMap(), nil
 }
 
 // resolveVersion determines the version to use for the replacement action.
@@ -91,44 +83,130 @@ func resolveVersion(originalUses, actionName, newAction string, replaceByMajorTa
 	return tag, nil
 }
 
+// ReplaceActionsConfig configures ReplaceActionsWithConfig
+type ReplaceActionsConfig struct {
+	// ReplaceByMajorTag uses the same major version as the original, instead of the latest release
+	ReplaceByMajorTag bool
+	// CheckInputs compares action.yml of the original and the replacement at their refs
+	// with the inputs the step passes and the outputs the workflow reads
+	CheckInputs bool
+	// SkipIncompatible leaves steps with input or output problems unchanged.
+	// Otherwise they are replaced and only reported.
+	SkipIncompatible bool
+	// PinToSHA replaces steps pinned to a commit SHA with newAction@sha # version, so the
+	// replacement stays pinned without the PinActions stage. Steps pinned to a tag keep a tag.
+	PinToSHA bool
+	// Catalog adds the maintained actions of a catalog to the replacements passed as a map,
+	// and the description and score of the new action to the report
+	Catalog *Catalog
+	// Policy limits the replacements that are made
+	Policy CatalogPolicy
+}
+
+type ReplaceActionsResponse struct {
+	FinalOutput string
+	IsChanged   bool
+	// Incompatible are the replacements CheckInputs found problems with
+	Incompatible []IncompatibleReplacement
+	// Replacements are the steps that were replaced
+	Replacements []ActionReplacement
+}
+
 // ReplaceActions replaces original actions with Step Security actions in a workflow.
 // When replaceByMajorTag is true, the replacement action uses the same major version as the original.
 // When false (default), it uses the latest release of the replacement action.
 func ReplaceActions(inputYaml string, customerMaintainedActions map[string]string, replaceByMajorTag bool) (string, bool, error) {
+	response, err := ReplaceActionsWithConfig(inputYaml, customerMaintainedActions, ReplaceActionsConfig{ReplaceByMajorTag: replaceByMajorTag})
+	if err != nil {
+		return "", false, err
+	}
+	return response.FinalOutput, response.IsChanged, nil
+}
+
+// ReplaceActionsWithConfig is ReplaceActions that can check that the replacement accepts
+// the inputs of each step, see ReplaceActionsConfig.
+func ReplaceActionsWithConfig(inputYaml string, customerMaintainedActions map[string]string, config ReplaceActionsConfig) (*ReplaceActionsResponse, error) {
 	workflow := metadata.Workflow{}
-	updated := false
+	response := &ReplaceActionsResponse{FinalOutput: inputYaml}
 
 	actionMap := customerMaintainedActions
 
 	err := yaml.Unmarshal([]byte(inputYaml), &workflow)
 	if err != nil {
-		return "", updated, fmt.Errorf("unable to parse yaml: %v", err)
+		return nil, fmt.Errorf("unable to parse yaml: %v", err)
 	}
 
 	// Step 1: Check if anything needs to be replaced
 
 	var replacements []replacement
 
+	addReplacement := func(jobName string, stepIdx int, step metadata.Step) {
+		actionName := strings.Split(step.Uses, "@")[0]
+		entry, inCatalog := config.Catalog.Lookup(actionName)
+		newAction, ok := actionMap[actionName]
+		if !ok {
+			if !inCatalog {
+				return
+			}
+			newAction = entry.Name
+		} else if inCatalog && !strings.EqualFold(entry.Name, newAction) {
+			// the map replaces it with an action that is not the catalog's
+			entry, inCatalog = Action{}, false
+		}
+		if allowed, reason := config.Policy.Allows(actionName, entry, inCatalog); !allowed {
+			log.Printf("skipping replacement of %s with %s: %s", step.Uses, newAction, reason)
+			return
+		}
+		version, err := resolveVersion(step.Uses, actionName, newAction, config.ReplaceByMajorTag)
+		if err != nil {
+			log.Printf("skipping replacement of %s: %v", step.Uses, err)
+			return
+		}
+		if config.CheckInputs {
+			if problems := checkCompatibility(inputYaml, step, newAction, version); len(problems) > 0 {
+				response.Incompatible = append(response.Incompatible, IncompatibleReplacement{
+					JobName:        jobName,
+					OriginalAction: step.Uses,
+					NewAction:      newAction + "@" + version,
+					Problems:       problems,
+					Skipped:        config.SkipIncompatible,
+				})
+				if config.SkipIncompatible {
+					return
+				}
+			}
+		}
+		commitSHA := ""
+		if config.PinToSHA && isPinnedToSHA(step.Uses) {
+			commitSHA, version, err = pin.ResolveActionSHA(newAction, version)
+			if err != nil {
+				log.Printf("skipping replacement of %s: unable to pin %s@%s: %v", step.Uses, newAction, version, err)
+				return
+			}
+		}
+		replacements = append(replacements, replacement{
+			jobName:        jobName,
+			stepIdx:        stepIdx,
+			newAction:      newAction,
+			originalAction: step.Uses,
+			latestVersion:  version,
+			commitSHA:      commitSHA,
+		})
+		response.Replacements = append(response.Replacements, ActionReplacement{
+			JobName:        jobName,
+			OriginalAction: step.Uses,
+			NewAction:      newAction + "@" + version,
+			Description:    entry.Description,
+			Score:          entry.Score,
+		})
+	}
+
 	for jobName, job := range workflow.Jobs {
 		if metadata.IsCallingReusableWorkflow(job) {
 			continue
 		}
 		for stepIdx, step := range job.Steps {
-			actionName := strings.Split(step.Uses, "@")[0]
-			if newAction, ok := actionMap[actionName]; ok {
-				version, err := resolveVersion(step.Uses, actionName, newAction, replaceByMajorTag)
-				if err != nil {
-					log.Printf("skipping replacement of %s: %v", step.Uses, err)
-					continue
-				}
-				replacements = append(replacements, replacement{
-					jobName:        jobName,
-					stepIdx:        stepIdx,
-					newAction:      newAction,
-					originalAction: step.Uses,
-					latestVersion:  version,
-				})
-			}
+			addReplacement(jobName, stepIdx, step)
 		}
 	}
 
@@ -136,43 +214,34 @@ func ReplaceActions(inputYaml string, customerMaintainedActions map[string]strin
 	if workflow.Runs.Using == "composite" {
 		for stepIdx, step := range workflow.Runs.Steps {
 			if len(step.Uses) > 0 {
-				actionName := strings.Split(step.Uses, "@")[0]
-				if newAction, ok := actionMap[actionName]; ok {
-					version, err := resolveVersion(step.Uses, actionName, newAction, replaceByMajorTag)
-					if err != nil {
-						log.Printf("skipping replacement of %s: %v", step.Uses, err)
-						continue
-					}
-					replacements = append(replacements, replacement{
-						jobName:        "composite",
-						stepIdx:        stepIdx,
-						newAction:      newAction,
-						originalAction: step.Uses,
-						latestVersion:  version,
-					})
-				}
+				addReplacement("composite", stepIdx, step)
 			}
 		}
 	}
 
+	sort.Slice(response.Incompatible, func(i, j int) bool {
+		return response.Incompatible[i].String() < response.Incompatible[j].String()
+	})
+	sortReplacements(response.Replacements)
+
 	if len(replacements) == 0 {
 		// No changes needed
-		return inputYaml, false, nil
+		return response, nil
 	}
 
 	// Step 2: Now modify the YAML lines manually
 	t := yaml.Node{}
 	err = yaml.Unmarshal([]byte(inputYaml), &t)
 	if err != nil {
-		return "", updated, fmt.Errorf("unable to parse yaml: %v", err)
+		return nil, fmt.Errorf("unable to parse yaml: %v", err)
 	}
 
 	inputLines := strings.Split(inputYaml, "\n")
-	inputLines, updated = replaceAction(&t, inputLines, replacements, updated)
+	inputLines, response.IsChanged = replaceAction(&t, inputLines, replacements, false)
 
-	output := strings.Join(inputLines, "\n")
+	response.FinalOutput = strings.Join(inputLines, "\n")
 
-	return output, updated, nil
+	return response, nil
 }
 
 func replaceAction(t *yaml.Node, inputLines []string, replacements []replacement, updated bool) ([]string, bool) {
@@ -204,12 +273,52 @@ func replaceAction(t *yaml.Node, inputLines []string, replacements []replacement
 		lineNum := usesNode.Line - 1 // 0-based indexing
 		columnNum := usesNode.Column - 1
 
-		// Replace the line
-		oldLine := inputLines[lineNum]
-		prefix := oldLine[:columnNum]
-		inputLines[lineNum] = prefix + r.newAction + "@" + r.latestVersion
+		// Replace only the value, keeping its quotes and any comment after it
+		inputLines[lineNum] = replaceUsesValue(inputLines[lineNum], columnNum, usesNode.Style, r)
 		updated = true
 
 	}
 	return inputLines, updated
 }
+
+// replaceUsesValue replaces the uses: value of line starting at valueColumn. A trailing
+// comment is kept. SHA pinned replacements get the version at its start, see
+// pin.ReplaceLineComment. When a SHA pinned original is replaced with a tag, the
+// version at the start of its comment is dropped, since it describes the old commit.
+func replaceUsesValue(line string, valueColumn int, style yaml.Style, r replacement) string {
+	if valueColumn > len(line) {
+		valueColumn = len(line)
+	}
+	prefix, rest := line[:valueColumn], line[valueColumn:]
+	comment := ""
+	if idx := strings.Index(rest, " #"); idx >= 0 {
+		value := strings.TrimRight(rest[:idx], " \t")
+		comment = rest[len(value):]
+	}
+
+	quote := ""
+	switch style {
+	case yaml.DoubleQuotedStyle:
+		quote = `"`
+	case yaml.SingleQuotedStyle:
+		quote = "'"
+	}
+
+	if r.commitSHA != "" {
+		return pin.ReplaceLineComment(prefix+quote+r.newAction+"@"+r.commitSHA+quote+comment, valueColumn, r.latestVersion)
+	}
+	if isPinnedToSHA(r.originalAction) && versionCommentRegex.MatchString(comment) {
+		text := strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(comment), "#"))
+		comment = ""
+		if text = strings.TrimSpace(strings.TrimPrefix(text, pin.LeadingVersion(text))); text != "" {
+			comment = " # " + text
+		}
+	}
+	return strings.TrimRight(prefix+quote+r.newAction+"@"+r.latestVersion+quote+comment, " \t")
+}
+
+// isPinnedToSHA reports whether uses refers to a full length commit SHA
+func isPinnedToSHA(uses string) bool {
+	parts := strings.SplitN(uses, "@", 2)
+	return len(parts) == 2 && len(parts[1]) == 40 && pin.IsAllHex(parts[1])
+}
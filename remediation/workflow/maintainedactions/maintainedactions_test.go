@@ -1,8 +1,11 @@
 package maintainedactions
 
 import (
+	"encoding/base64"
+	"fmt"
 	"io/ioutil"
 	"path"
+	"strings"
 	"testing"
 
 	"github.com/jarcoal/httpmock"
@@ -218,4 +221,154 @@ func TestReplaceActionsLatestRelease(t *testing.T) {
 			}
 		})
 	}
-}
\ No newline at end of file
+}
+func TestReplaceActionsCheckInputs(t *testing.T) {
+	const inputDirectory = "../../../testfiles/maintainedActions/input"
+	const outputDirectory = "../../../testfiles/maintainedActions/output"
+
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	for _, repo := range []string{"action-semantic-pull-request/git/ref/tags/v5", "skip-duplicate-actions/git/ref/tags/v5", "git-restore-mtime-action/git/ref/tags/v1"} {
+		httpmock.RegisterResponder("GET", "https://api.github.com/repos/step-security/"+repo,
+			httpmock.NewStringResponder(200, `{"ref":"refs/tags/v1","object":{"sha":"aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa","type":"commit"}}`))
+	}
+
+	actionYml := func(content string) httpmock.Responder {
+		return httpmock.NewStringResponder(200, fmt.Sprintf(`{"type":"file","encoding":"base64","content":"%s"}`, base64.StdEncoding.EncodeToString([]byte(content))))
+	}
+	notFound := httpmock.NewStringResponder(404, `{"message":"Not Found"}`)
+
+	// same inputs, compatible
+	httpmock.RegisterResponder("GET", "https://api.github.com/repos/amannn/action-semantic-pull-request/contents/action.yml",
+		actionYml("inputs:\n  types:\n    required: false\n"))
+	httpmock.RegisterResponder("GET", "https://api.github.com/repos/step-security/action-semantic-pull-request/contents/action.yml",
+		actionYml("inputs:\n  types:\n    required: false\n  scopes:\n    required: false\n"))
+
+	// renamed input and dropped output
+	httpmock.RegisterResponder("GET", "https://api.github.com/repos/fkirc/skip-duplicate-actions/contents/action.yml",
+		actionYml("inputs:\n  do_not_skip:\n    required: false\noutputs:\n  should_skip:\n    description: skip\n  reason:\n    description: why\n"))
+	httpmock.RegisterResponder("GET", "https://api.github.com/repos/step-security/skip-duplicate-actions/contents/action.yml",
+		actionYml("inputs:\n  do-not-skip:\n    required: false\noutputs:\n  skip:\n    description: skip\n"))
+
+	// new required input without a default, original only has action.yaml
+	httpmock.RegisterResponder("GET", "https://api.github.com/repos/chetan/git-restore-mtime-action/contents/action.yml", notFound)
+	httpmock.RegisterResponder("GET", "https://api.github.com/repos/chetan/git-restore-mtime-action/contents/action.yaml",
+		actionYml("inputs:\n  pattern:\n    required: false\n    default: '**'\n"))
+	httpmock.RegisterResponder("GET", "https://api.github.com/repos/step-security/git-restore-mtime-action/contents/action.yml",
+		actionYml("inputs:\n  pattern:\n    required: 'false'\n    default: '**'\n  token:\n    required: true\n"))
+
+	actionMap := map[string]string{
+		"amannn/action-semantic-pull-request": "step-security/action-semantic-pull-request",
+		"fkirc/skip-duplicate-actions":        "step-security/skip-duplicate-actions",
+		"chetan/git-restore-mtime-action":     "step-security/git-restore-mtime-action",
+	}
+
+	input, err := ioutil.ReadFile(path.Join(inputDirectory, "checkInputs.yml"))
+	if err != nil {
+		t.Fatalf("error reading input file: %v", err)
+	}
+	expectedOutput, err := ioutil.ReadFile(path.Join(outputDirectory, "checkInputs.yml"))
+	if err != nil {
+		t.Fatalf("error reading expected output file: %v", err)
+	}
+
+	response, err := ReplaceActionsWithConfig(string(input), actionMap, ReplaceActionsConfig{ReplaceByMajorTag: true, CheckInputs: true, SkipIncompatible: true})
+	if err != nil {
+		t.Fatalf("ReplaceActionsWithConfig() error = %v", err)
+	}
+	if response.FinalOutput != string(expectedOutput) {
+		t.Errorf("ReplaceActionsWithConfig() = %v, want %v", response.FinalOutput, string(expectedOutput))
+	}
+	if !response.IsChanged {
+		t.Error("ReplaceActionsWithConfig() expected IsChanged = true")
+	}
+
+	var got []string
+	for _, incompatible := range response.Incompatible {
+		got = append(got, incompatible.String())
+	}
+	want := []string{
+		"mtime: chetan/git-restore-mtime-action@v1 -> step-security/git-restore-mtime-action@v1 skipped: required input token of step-security/git-restore-mtime-action@v1 is not set",
+		"skip: fkirc/skip-duplicate-actions@v5 -> step-security/skip-duplicate-actions@v5 skipped: input do_not_skip is not an input of step-security/skip-duplicate-actions@v5; output should_skip is used but not set by step-security/skip-duplicate-actions@v5",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("ReplaceActionsWithConfig() incompatible =\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+
+	// without SkipIncompatible the steps are replaced and only reported
+	response, err = ReplaceActionsWithConfig(string(input), actionMap, ReplaceActionsConfig{ReplaceByMajorTag: true, CheckInputs: true})
+	if err != nil {
+		t.Fatalf("ReplaceActionsWithConfig() error = %v", err)
+	}
+	if strings.Contains(response.FinalOutput, "fkirc/") || strings.Contains(response.FinalOutput, "chetan/") {
+		t.Errorf("ReplaceActionsWithConfig() expected all steps replaced, got %s", response.FinalOutput)
+	}
+	if len(response.Incompatible) != 2 || response.Incompatible[0].Skipped {
+		t.Errorf("ReplaceActionsWithConfig() expected 2 flagged replacements, got %v", response.Incompatible)
+	}
+}
+
+func TestReplaceActionsPinToSHA(t *testing.T) {
+	const inputDirectory = "../../../testfiles/maintainedActions/input"
+	const outputDirectory = "../../../testfiles/maintainedActions/output"
+
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	httpmock.RegisterResponder("GET", "https://api.github.com/repos/step-security/action-semantic-pull-request/releases/latest",
+		httpmock.NewStringResponder(200, `{"id":1,"tag_name":"v6.1.0","name":"v6.1.0"}`))
+	httpmock.RegisterResponder("GET", "https://api.github.com/repos/step-security/action-semantic-pull-request/commits/v6",
+		httpmock.NewStringResponder(200, `aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa`))
+	httpmock.RegisterResponder("GET", "https://api.github.com/repos/step-security/action-semantic-pull-request/git/matching-refs/tags/v6.",
+		httpmock.NewStringResponder(200, `[{"ref":"refs/tags/v6.0.0","object":{"sha":"0000000000000000000000000000000000000000","type":"commit"}},{"ref":"refs/tags/v6.1.0","object":{"sha":"aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa","type":"commit"}}]`))
+
+	httpmock.RegisterResponder("GET", "https://api.github.com/repos/step-security/skip-duplicate-actions/releases/latest",
+		httpmock.NewStringResponder(200, `{"id":2,"tag_name":"v5.3.1","name":"v5.3.1"}`))
+
+	httpmock.RegisterResponder("GET", "https://api.github.com/repos/step-security/git-restore-mtime-action/releases/latest",
+		httpmock.NewStringResponder(200, `{"id":3,"tag_name":"v2.0.0","name":"v2.0.0"}`))
+	httpmock.RegisterResponder("GET", "https://api.github.com/repos/step-security/git-restore-mtime-action/commits/v2",
+		httpmock.NewStringResponder(200, `cccccccccccccccccccccccccccccccccccccccc`))
+	httpmock.RegisterResponder("GET", "https://api.github.com/repos/step-security/git-restore-mtime-action/git/matching-refs/tags/v2.",
+		httpmock.NewStringResponder(200, `[{"ref":"refs/tags/v2.0.0","object":{"sha":"cccccccccccccccccccccccccccccccccccccccc","type":"commit"}}]`))
+
+	actionMap, err := LoadMaintainedActions("maintainedActions.json")
+	if err != nil {
+		t.Fatalf("unable to load maintained actions: %v", err)
+	}
+	input, err := ioutil.ReadFile(path.Join(inputDirectory, "pinToSHA.yml"))
+	if err != nil {
+		t.Fatalf("error reading input file: %v", err)
+	}
+	expectedOutput, err := ioutil.ReadFile(path.Join(outputDirectory, "pinToSHA.yml"))
+	if err != nil {
+		t.Fatalf("error reading expected output file: %v", err)
+	}
+
+	response, err := ReplaceActionsWithConfig(string(input), actionMap, ReplaceActionsConfig{PinToSHA: true})
+	if err != nil {
+		t.Fatalf("ReplaceActionsWithConfig() error = %v", err)
+	}
+	if response.FinalOutput != string(expectedOutput) {
+		t.Errorf("ReplaceActionsWithConfig() = %v, want %v", response.FinalOutput, string(expectedOutput))
+	}
+	if !response.IsChanged {
+		t.Error("ReplaceActionsWithConfig() expected IsChanged = true")
+	}
+
+	// without PinToSHA the replacement is a tag and the version in the comment of the old SHA is dropped
+	got, _, err := ReplaceActions(string(input), actionMap, false)
+	if err != nil {
+		t.Fatalf("ReplaceActions() error = %v", err)
+	}
+	for _, want := range []string{
+		"      - uses: step-security/action-semantic-pull-request@v6\n",
+		"      - uses: \"step-security/skip-duplicate-actions@v5\" # keep in sync with release.yml\n",
+		"      - uses: 'step-security/git-restore-mtime-action@v2' # keeps file times\n",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("ReplaceActions() = %v, want line %q", got, want)
+		}
+	}
+}
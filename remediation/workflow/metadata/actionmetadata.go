@@ -23,6 +23,7 @@ type Workflow struct {
 	Runs Runs `yaml:"runs"`
 }
 type Step struct {
+	ID   string `yaml:"id"`
 	Run  string `yaml:"run"`
 	Uses string `yaml:"uses"`
 	With With   `yaml:"with"`
@@ -40,6 +41,8 @@ type Job struct {
 type Runs struct {
 	Using string `yaml:"using"`
 	Steps []Step `yaml:"steps"`
+	// Image is set for docker actions: either docker://<image> or a Dockerfile path relative to action.yml
+	Image string `yaml:"image"`
 }
 
 type Container struct {
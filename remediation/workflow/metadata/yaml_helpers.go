@@ -0,0 +1,23 @@
+package metadata
+
+import "gopkg.in/yaml.v3"
+
+// GetMappingEntry returns the key and value nodes of key in a YAML mapping node,
+// or nil if node is not a mapping or does not have key.
+func GetMappingEntry(node *yaml.Node, key string) (*yaml.Node, *yaml.Node) {
+	if node == nil || node.Kind != yaml.MappingNode {
+		return nil, nil
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return node.Content[i], node.Content[i+1]
+		}
+	}
+	return nil, nil
+}
+
+// GetMappingValue returns the value node of key in a YAML mapping node, see GetMappingEntry.
+func GetMappingValue(node *yaml.Node, key string) *yaml.Node {
+	_, value := GetMappingEntry(node, key)
+	return value
+}
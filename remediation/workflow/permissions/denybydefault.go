@@ -0,0 +1,344 @@
+package permissions
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	metadata "github.com/step-security/secure-repo/remediation/workflow/metadata"
+	"gopkg.in/yaml.v3"
+)
+
+const errorDenyByDefaultUnknownPermissions = "KnownIssue-9: Permissions of the job could not be analyzed and the workflow has no top-level permissions to copy"
+
+// permissionsEdit replaces lines [start, end] with lines, all 0-based. end is start-1 for an insert.
+type permissionsEdit struct {
+	start int
+	end   int
+	lines []string
+}
+
+// SetDenyByDefaultPermissions rewrites a workflow to deny by default: the top-level permissions
+// become {} and each job gets the permissions it needs per the knowledge base. Unlike
+// AddWorkflowLevelPermissions it also works on workflows that already have permissions.
+//   - Top-level grants move down to the jobs that need them. Jobs that can not be analyzed,
+//     e.g. reusable workflow calls, get a copy of the top-level permissions.
+//   - Jobs with write-all or read-all are narrowed to what they need. Grants in a job's permissions
+//     mapping are lowered to the level the job needs, or removed if it needs none. They are not raised.
+//
+// PermissionChanges explains where each grant went or why it was removed.
+func SetDenyByDefaultPermissions(inputYaml string, addProjectComment bool) (*SecureWorkflowReponse, error) {
+	response := &SecureWorkflowReponse{FinalOutput: inputYaml}
+
+	workflow := metadata.Workflow{}
+	err := yaml.Unmarshal([]byte(inputYaml), &workflow)
+	if err != nil {
+		response.HasErrors = true
+		response.IncorrectYaml = true
+		return response, nil
+	}
+
+	t := yaml.Node{}
+	err = yaml.Unmarshal([]byte(inputYaml), &t)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse yaml %v", err)
+	}
+	if len(t.Content) == 0 {
+		return nil, fmt.Errorf("Workflow file provided is Empty")
+	}
+	root := t.Content[0]
+	jobsKey, jobsNode := metadata.GetMappingEntry(root, "jobs")
+	if jobsNode == nil || jobsNode.Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("jobs not found in workflow")
+	}
+
+	topPermissions := workflow.Permissions
+	topIsEmpty := topPermissions.IsSet && !topPermissions.ReadAll && !topPermissions.WriteAll && len(topPermissions.Scopes) == 0
+
+	inputLines := strings.Split(inputYaml, "\n")
+	errors := make(map[string][]string)
+	var edits []permissionsEdit
+	var changes []string
+	// scope -> jobs that were given it in place of the top-level grant
+	movedTo := make(map[string][]string)
+	var copiedTo []string
+
+	for i := 0; i+1 < len(jobsNode.Content); i += 2 {
+		jobName := jobsNode.Content[i].Value
+		jobNode := jobsNode.Content[i+1]
+		job := workflow.Jobs[jobName]
+		permissionsKey, _ := metadata.GetMappingEntry(jobNode, "permissions")
+
+		if alreadyHasJobPermissions(job) {
+			perms, jobErrors, missingActions := analyzeJobPermissions(workflow, job)
+			if len(jobErrors) > 0 {
+				errors[jobName] = append(errors[jobName], jobErrors...)
+				response.MissingActions = append(response.MissingActions, missingActions...)
+				continue
+			}
+			if !job.Permissions.WriteAll && !job.Permissions.ReadAll {
+				// explicit grants per scope, they do not depend on the top-level permissions
+				block, jobChanges := narrowJobPermissions(jobName, job.Permissions.Scopes, perms)
+				if len(jobChanges) > 0 {
+					edits = append(edits, replacePermissionsBlock(inputLines, permissionsKey, block))
+					changes = append(changes, jobChanges...)
+				}
+				continue
+			}
+			edits = append(edits, replacePermissionsBlock(inputLines, permissionsKey, permissionsBlock(perms)))
+			changes = append(changes, fmt.Sprintf("%s: %s narrowed to %s", jobName, scalarPermissions(job.Permissions), strings.Join(stripComments(perms), ", ")))
+			continue
+		}
+
+		if topIsEmpty {
+			// the job already runs without permissions
+			continue
+		}
+
+		var block []string
+		perms, jobErrors, missingActions := analyzeJobPermissions(workflow, job)
+		if len(jobErrors) > 0 {
+			errors[jobName] = append(errors[jobName], jobErrors...)
+			response.MissingActions = append(response.MissingActions, missingActions...)
+			if !topPermissions.IsSet {
+				// the job runs with the repository's default permissions, which are not known
+				errors[jobName] = append(errors[jobName], errorDenyByDefaultUnknownPermissions)
+				response.HasErrors = true
+				continue
+			}
+			block = copyPermissionsBlock(topPermissions)
+			copiedTo = append(copiedTo, jobName)
+			changes = append(changes, fmt.Sprintf("%s: top-level permissions copied, as its permissions could not be analyzed: %s", jobName, jobErrors[0]))
+		} else {
+			block = permissionsBlock(perms)
+			for _, scope := range scopesOf(perms) {
+				movedTo[scope] = append(movedTo[scope], jobName)
+			}
+		}
+		indent := strings.Repeat(" ", jobNode.Column-1)
+		for j := range block {
+			block[j] = indent + block[j]
+		}
+		edits = append(edits, permissionsEdit{start: jobNode.Line - 1, end: jobNode.Line - 2, lines: block})
+	}
+
+	for job, jobErrors := range errors {
+		response.JobErrors = append(response.JobErrors, JobError{JobName: job, Errors: jobErrors})
+	}
+	sort.Slice(response.JobErrors, func(i, j int) bool {
+		return response.JobErrors[i].JobName < response.JobErrors[j].JobName
+	})
+	if response.HasErrors {
+		// jobs would lose permissions they may need, leave the workflow as it is
+		return response, nil
+	}
+
+	topLine := "permissions: {}"
+	if addProjectComment {
+		topLine += "  # added using https://github.com/step-security/secure-repo"
+	}
+	topKey, _ := metadata.GetMappingEntry(root, "permissions")
+	switch {
+	case topIsEmpty:
+		// nothing to change at the top
+	case topKey != nil:
+		edits = append(edits, replacePermissionsBlock(inputLines, topKey, []string{topLine}))
+		changes = append(changes, topLevelChanges(topPermissions, movedTo, copiedTo)...)
+	default:
+		indent := strings.Repeat(" ", jobsKey.Column-1)
+		edits = append(edits, permissionsEdit{start: jobsKey.Line - 1, end: jobsKey.Line - 2, lines: []string{indent + topLine, ""}})
+		changes = append(changes, "top-level: permissions: {} added, jobs get the permissions they need")
+	}
+
+	if len(edits) == 0 {
+		return response, nil
+	}
+
+	// apply edits bottom up so line numbers of the remaining edits stay valid
+	sort.SliceStable(edits, func(i, j int) bool {
+		return edits[i].start > edits[j].start
+	})
+	for _, edit := range edits {
+		lines := append([]string{}, inputLines[:edit.start]...)
+		lines = append(lines, edit.lines...)
+		inputLines = append(lines, inputLines[edit.end+1:]...)
+	}
+
+	response.FinalOutput = strings.Join(inputLines, "\n")
+	response.IsChanged = true
+	response.PermissionChanges = changes
+	return response, nil
+}
+
+// analyzeJobPermissions returns the permissions the steps of job need, or why they can not be known
+func analyzeJobPermissions(workflow metadata.Workflow, job metadata.Job) ([]string, []string, []string) {
+	if githubTokenInJobLevelEnv(job) {
+		return nil, []string{errorGithubTokenInJobEnv}, nil
+	}
+	if metadata.IsCallingReusableWorkflow(job) {
+		return nil, []string{fmt.Sprintf(errorReusableWorkflow, job.Uses)}, nil
+	}
+
+	jobState := &JobState{}
+	jobState.WorkflowEnv = workflow.Env
+	perms, err := jobState.getPermissions(job.Steps)
+	if err != nil {
+		var jobErrors []string
+		for _, err := range jobState.Errors {
+			jobErrors = append(jobErrors, err.Error())
+		}
+		return nil, jobErrors, jobState.MissingActions
+	}
+	return perms, nil, nil
+}
+
+// permissionLevels orders the levels of a permission scope
+var permissionLevels = map[string]int{"none": 0, "read": 1, "write": 2}
+
+// narrowJobPermissions returns the unindented lines of a job's explicit permissions with each
+// grant lowered to what perms, the permissions the job needs, has for its scope. Grants of scopes
+// the job does not need are removed. It also returns the changes, which are empty if there are none.
+func narrowJobPermissions(jobName string, scopes map[string]string, perms []string) ([]string, []string) {
+	needed := make(map[string]string)
+	for _, perm := range perms {
+		scope, level := splitPermission(perm)
+		needed[scope] = level
+	}
+
+	var block, changes []string
+	for _, perm := range perms {
+		scope, level := splitPermission(perm)
+		granted, ok := scopes[scope]
+		if !ok {
+			continue
+		}
+		if permissionLevels[granted] > permissionLevels[level] {
+			block = append(block, "  "+perm)
+			changes = append(changes, fmt.Sprintf("%s: %s: %s narrowed to %s: %s", jobName, scope, granted, scope, level))
+		} else {
+			block = append(block, fmt.Sprintf("  %s: %s", scope, granted))
+		}
+	}
+	for _, scope := range sortedScopes(scopes) {
+		if _, ok := needed[scope]; ok {
+			continue
+		}
+		if scopes[scope] == "none" {
+			block = append(block, fmt.Sprintf("  %s: none", scope))
+			continue
+		}
+		changes = append(changes, fmt.Sprintf("%s: %s: %s removed, no step needs it", jobName, scope, scopes[scope]))
+	}
+
+	if len(block) == 0 {
+		return []string{"permissions: {}"}, changes
+	}
+	return append([]string{"permissions:"}, block...), changes
+}
+
+// splitPermission splits a permission like "contents: read  # for actions/checkout" into its scope and level
+func splitPermission(perm string) (string, string) {
+	parts := strings.SplitN(strings.Split(perm, "#")[0], ":", 2)
+	if len(parts) < 2 {
+		return strings.TrimSpace(parts[0]), ""
+	}
+	return strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+}
+
+// topLevelChanges explains what happened to each top-level grant
+func topLevelChanges(top metadata.Permissions, movedTo map[string][]string, copiedTo []string) []string {
+	copied := ""
+	if len(copiedTo) > 0 {
+		copied = fmt.Sprintf(", copied to %s", strings.Join(copiedTo, ", "))
+	}
+	if top.ReadAll || top.WriteAll {
+		return []string{fmt.Sprintf("top-level: %s replaced with {}, jobs get the permissions they need%s", scalarPermissions(top), copied)}
+	}
+
+	var changes []string
+	for _, scope := range sortedScopes(top.Scopes) {
+		grant := fmt.Sprintf("%s: %s", scope, top.Scopes[scope])
+		if jobs := movedTo[scope]; len(jobs) > 0 {
+			changes = append(changes, fmt.Sprintf("top-level: %s moved to %s%s", grant, strings.Join(jobs, ", "), copied))
+		} else {
+			changes = append(changes, fmt.Sprintf("top-level: %s removed, no job needs it%s", grant, copied))
+		}
+	}
+	return changes
+}
+
+// replacePermissionsBlock replaces the permissions key at keyNode and the lines of its value.
+// lines are indented like the key.
+func replacePermissionsBlock(inputLines []string, keyNode *yaml.Node, lines []string) permissionsEdit {
+	start := keyNode.Line - 1
+	end := start
+	for i := start + 1; i < len(inputLines); i++ {
+		if strings.TrimSpace(inputLines[i]) == "" {
+			continue
+		}
+		if len(inputLines[i])-len(strings.TrimLeft(inputLines[i], " ")) <= keyNode.Column-1 {
+			break
+		}
+		end = i
+	}
+
+	indent := strings.Repeat(" ", keyNode.Column-1)
+	indented := make([]string, len(lines))
+	for i, line := range lines {
+		indented[i] = indent + line
+	}
+	return permissionsEdit{start: start, end: end, lines: indented}
+}
+
+// permissionsBlock returns the unindented lines of a job's permissions
+func permissionsBlock(perms []string) []string {
+	block := []string{"permissions:"}
+	for _, perm := range perms {
+		block = append(block, "  "+perm)
+	}
+	return block
+}
+
+// copyPermissionsBlock returns the unindented lines of permissions equal to top
+func copyPermissionsBlock(top metadata.Permissions) []string {
+	if top.ReadAll || top.WriteAll {
+		return []string{"permissions: " + scalarPermissions(top)}
+	}
+	block := []string{"permissions:"}
+	for _, scope := range sortedScopes(top.Scopes) {
+		block = append(block, fmt.Sprintf("  %s: %s", scope, top.Scopes[scope]))
+	}
+	return block
+}
+
+func scalarPermissions(p metadata.Permissions) string {
+	if p.WriteAll {
+		return "write-all"
+	}
+	return "read-all"
+}
+
+func stripComments(perms []string) []string {
+	var stripped []string
+	for _, perm := range perms {
+		stripped = append(stripped, strings.TrimSpace(strings.Split(perm, "#")[0]))
+	}
+	return stripped
+}
+
+func scopesOf(perms []string) []string {
+	var scopes []string
+	for _, perm := range perms {
+		scopes = append(scopes, strings.TrimSpace(strings.Split(perm, ":")[0]))
+	}
+	return scopes
+}
+
+func sortedScopes(scopes map[string]string) []string {
+	var keys []string
+	for scope := range scopes {
+		keys = append(keys, scope)
+	}
+	sort.Strings(keys)
+	return keys
+}
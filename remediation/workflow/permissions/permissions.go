@@ -7,26 +7,59 @@ import (
 
 	"github.com/PaesslerAG/gval"
 	"github.com/generikvault/gvalstrings"
+	"github.com/step-security/secure-repo/remediation/registry"
 	metadata "github.com/step-security/secure-repo/remediation/workflow/metadata"
 	"gopkg.in/yaml.v3"
 )
 
 type SecureWorkflowReponse struct {
-	OriginalInput          string
-	FinalOutput            string
-	IsChanged              bool
-	HasErrors              bool
-	AlreadyHasPermissions  bool
-	AddedMaintainedActions bool
-	PinnedActions          bool
-	AddedHardenRunner      bool
-	AddedPermissions       bool
-	ReplacedRunnerLabels   bool
-	IncorrectYaml          bool
-	WorkflowFetchError     bool
-	JobErrors              []JobError
-	MissingActions         []string
-	UsingSecureRepoPAT     bool
+	OriginalInput            string
+	FinalOutput              string
+	IsChanged                bool
+	HasErrors                bool
+	AlreadyHasPermissions    bool
+	AddedMaintainedActions   bool
+	PinnedActions            bool
+	AddedHardenRunner        bool
+	AddedPermissions         bool
+	ReplacedRunnerLabels     bool
+	IncorrectYaml            bool
+	WorkflowFetchError       bool
+	JobErrors                []JobError
+	MissingActions           []string
+	UsingSecureRepoPAT       bool
+	ImpostorCommits          []string
+	VersionCommentMismatches []string
+	FixedVersionComments     bool
+	UpdatedPins              bool
+	PinUpdates               []string
+	// NodeRuntimeFindings are actions on a retired or deprecated Node runtime
+	NodeRuntimeFindings []string
+	FixedNodeRuntimes   bool
+	// HardenRunnerPolicies says which harden-runner rule selected the config of each job
+	HardenRunnerPolicies []string
+	// UnresolvedImages are docker images that could not be pinned because the registry
+	// could not resolve them, with the error
+	UnresolvedImages []string
+	// UnresolvedRunnerLabels are runs-on expressions whose labels could not be replaced
+	UnresolvedRunnerLabels []string
+	// RunnerLabelChanges lists the labels of each job before and after replacing them
+	RunnerLabelChanges []string
+	// IncompatibleMaintainedActions are maintained action replacements skipped because
+	// the replacement does not accept the step's inputs, with the reason
+	IncompatibleMaintainedActions []string
+	// MaintainedActionReplacements are the maintained action replacements made, with
+	// the description and score of the new action
+	MaintainedActionReplacements []string
+	ReplacedDeprecatedActions    bool
+	// DeprecatedActions are the steps using deprecated actions, with their successor,
+	// and for steps that were not replaced the inputs or outputs without a translation
+	DeprecatedActions []string
+	// PermissionChanges explains the changes SetDenyByDefaultPermissions made to existing permissions
+	PermissionChanges []string
+	// ImageVerifications are the signature and provenance checks of the pinned images,
+	// when verifyImages is set
+	ImageVerifications []registry.VerificationResult
 }
 
 type JobError struct {
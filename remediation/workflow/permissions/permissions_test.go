@@ -231,3 +231,70 @@ func TestAddWorkflowLevelPermissionsWithEmpty(t *testing.T) {
 		t.Errorf("test failed with addEmptyTopLevelPermissions=false for empty-permissions.yml - should contain 'contents: read' but not 'permissions: {}'\nGot:\n%s", output2)
 	}
 }
+
+func TestSetDenyByDefaultPermissions(t *testing.T) {
+	const inputDirectory = "../../../testfiles/denybydefaultperms/input"
+	const outputDirectory = "../../../testfiles/denybydefaultperms/output"
+
+	os.Setenv("KBFolder", "../../../knowledge-base/actions")
+
+	tests := []struct {
+		fileName    string
+		wantChanged bool
+		wantErrors  bool
+		wantChanges []string
+	}{
+		{
+			fileName:    "top-level-grants.yml",
+			wantChanged: true,
+			wantChanges: []string{
+				"comment: write-all narrowed to issues: write, pull-requests: write",
+				"docs: top-level permissions copied, as its permissions could not be analyzed: KnownIssue-7: Action ./.github/workflows/docs.yml is a reusable workflow. Reusable workflows are not supported as of now.",
+				"lint: contents: write narrowed to contents: read",
+				"lint: pull-requests: read removed, no step needs it",
+				"labels: issues: write removed, no step needs it",
+				"top-level: contents: write moved to build, release, copied to docs",
+				"top-level: issues: write removed, no job needs it, copied to docs",
+				"top-level: packages: write removed, no job needs it, copied to docs",
+			},
+		},
+		{
+			fileName:    "no-top-level.yml",
+			wantChanged: true,
+			wantChanges: []string{"top-level: permissions: {} added, jobs get the permissions they need"},
+		},
+		{
+			fileName:   "unknown-permissions.yml",
+			wantErrors: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.fileName, func(t *testing.T) {
+			input, err := ioutil.ReadFile(path.Join(inputDirectory, tt.fileName))
+			if err != nil {
+				t.Fatal(err)
+			}
+			expectedOutput, err := ioutil.ReadFile(path.Join(outputDirectory, tt.fileName))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			response, err := SetDenyByDefaultPermissions(string(input), false)
+			if err != nil {
+				t.Fatalf("SetDenyByDefaultPermissions() error = %v", err)
+			}
+			if response.FinalOutput != string(expectedOutput) {
+				t.Errorf("test failed %s did not match expected output\nExpected:\n%s\n\nGot:\n%s", tt.fileName, string(expectedOutput), response.FinalOutput)
+			}
+			if response.IsChanged != tt.wantChanged {
+				t.Errorf("SetDenyByDefaultPermissions() IsChanged = %v, want %v", response.IsChanged, tt.wantChanged)
+			}
+			if response.HasErrors != tt.wantErrors {
+				t.Errorf("SetDenyByDefaultPermissions() HasErrors = %v, want %v, job errors %v", response.HasErrors, tt.wantErrors, response.JobErrors)
+			}
+			if strings.Join(response.PermissionChanges, "\n") != strings.Join(tt.wantChanges, "\n") {
+				t.Errorf("SetDenyByDefaultPermissions() changes =\n%s\nwant\n%s", strings.Join(response.PermissionChanges, "\n"), strings.Join(tt.wantChanges, "\n"))
+			}
+		})
+	}
+}
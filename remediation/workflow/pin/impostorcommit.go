@@ -0,0 +1,124 @@
+package pin
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/google/go-github/v40/github"
+	"gopkg.in/yaml.v3"
+)
+
+// maxReleaseComparisons bounds the release tags compared per pinned action. An impostor commit
+// diverges from every ref, so without a bound it would cost one compare call per release.
+const maxReleaseComparisons = 30
+
+// VerifyPinnedActions returns the uses: references of actions pinned to a commit SHA
+// that is not reachable from the default branch or a release tag of the repository named in the reference.
+//
+// GitHub serves a commit that only exists in a fork through the parent repository as well
+// (an "impostor commit"), so a SHA that resolves under owner/repo is no proof that it belongs
+// to owner/repo. Such references are reported, not modified.
+func VerifyPinnedActions(inputYaml string) ([]string, error) {
+	t := yaml.Node{}
+	err := yaml.Unmarshal([]byte(inputYaml), &t)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse yaml %v", err)
+	}
+
+	ctx := context.Background()
+	client := newGitHubClient(getPAT())
+
+	impostorCommits := []string{}
+	verified := make(map[string]bool)
+	for _, usesNode := range collectUsesNodes(&t) {
+		action := usesNode.Value
+		if !strings.Contains(action, "@") || strings.HasPrefix(action, "docker://") {
+			continue
+		}
+		leftOfAt := strings.Split(action, "@")
+		commitSHA := leftOfAt[1]
+		if len(commitSHA) != 40 || !IsAllHex(commitSHA) {
+			continue
+		}
+		if _, ok := verified[action]; ok {
+			continue
+		}
+
+		splitOnSlash := strings.Split(leftOfAt[0], "/")
+		if len(splitOnSlash) < 2 {
+			continue
+		}
+		owner := splitOnSlash[0]
+		repo := splitOnSlash[1]
+
+		comment := strings.TrimSpace(strings.TrimPrefix(usesNode.LineComment, "#"))
+		reachable, err := isCommitReachable(ctx, client, owner, repo, commitSHA, versionInCommentRegex.FindString(comment))
+		if err != nil {
+			return impostorCommits, err
+		}
+		verified[action] = reachable
+		if !reachable {
+			log.Printf("commit %s is not reachable from the default branch or a release tag of %s/%s", commitSHA, owner, repo)
+			impostorCommits = append(impostorCommits, action)
+		}
+	}
+
+	return impostorCommits, nil
+}
+
+// isCommitReachable reports whether commitSHA is the head of, or an ancestor of, the default branch,
+// the tag named in the version comment, or one of the latest release tags of owner/repo.
+// Refs are checked in that order, which covers most pins with one or two compare calls.
+func isCommitReachable(ctx context.Context, client *github.Client, owner, repo, commitSHA, commentTag string) (bool, error) {
+	repository, _, err := client.Repositories.Get(ctx, owner, repo)
+	if err != nil {
+		return false, err
+	}
+	refs := []string{repository.GetDefaultBranch()}
+	if commentTag != "" {
+		refs = append(refs, commentTag)
+	}
+	for _, ref := range refs {
+		reachable, err := isCommitReachableFrom(ctx, client, owner, repo, ref, commitSHA)
+		if err != nil || reachable {
+			return reachable, err
+		}
+	}
+
+	releases, _, err := client.Repositories.ListReleases(ctx, owner, repo, &github.ListOptions{PerPage: maxReleaseComparisons})
+	if err != nil {
+		return false, err
+	}
+	for _, release := range releases {
+		if release.GetDraft() || release.GetTagName() == commentTag {
+			continue
+		}
+		reachable, err := isCommitReachableFrom(ctx, client, owner, repo, release.GetTagName(), commitSHA)
+		if err != nil || reachable {
+			return reachable, err
+		}
+	}
+
+	return false, nil
+}
+
+// isCommitReachableFrom reports whether commitSHA is ref itself or an ancestor of it. A ref that
+// does not exist is not an error.
+func isCommitReachableFrom(ctx context.Context, client *github.Client, owner, repo, ref, commitSHA string) (bool, error) {
+	// base...head is "behind" when head is an ancestor of base
+	comparison, resp, err := client.Repositories.CompareCommits(ctx, owner, repo, ref, commitSHA, nil)
+	if err != nil {
+		if resp != nil && resp.StatusCode == http.StatusNotFound {
+			return false, nil
+		}
+		return false, err
+	}
+	switch comparison.GetStatus() {
+	case "behind", "identical":
+		return true, nil
+	}
+	return false, nil
+}
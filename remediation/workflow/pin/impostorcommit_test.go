@@ -0,0 +1,88 @@
+package pin
+
+import (
+	"testing"
+
+	"github.com/jarcoal/httpmock"
+)
+
+func TestVerifyPinnedActions(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	const input = `name: Verify
+on: [push]
+jobs:
+  build:
+    runs-on: ubuntu-latest
+    steps:
+    - uses: actions/checkout@a81bbbf8298c0fa03ea29cdc473d45769f953675 # v2.3.4
+    - uses: actions/setup-node@1f8c6b94b26d0feae1e387ca63ccbdc44d27b561 # v2.5.1
+    - uses: actions/cache@0000000000000000000000000000000000000001
+    - uses: actions/upload-artifact@a8a3f3ad30e3422c9c7b888a15615d19a852ae32
+    - uses: ./local-action
+    - uses: docker://alpine:3.19
+  test:
+    runs-on: ubuntu-latest
+    steps:
+    - uses: actions/checkout@a81bbbf8298c0fa03ea29cdc473d45769f953675 # v2.3.4
+    - uses: actions/setup-python@v5
+`
+
+	repository := func(defaultBranch string) httpmock.Responder {
+		return httpmock.NewStringResponder(200, `{"default_branch": "`+defaultBranch+`"}`)
+	}
+	diverged := httpmock.NewStringResponder(200, `{"status": "diverged", "ahead_by": 1, "behind_by": 3}`)
+
+	// actions/checkout: SHA is not on the default branch, but is the tag named in the comment
+	httpmock.RegisterResponder("GET", "https://api.github.com/repos/actions/checkout", repository("main"))
+	httpmock.RegisterResponder("GET", "https://api.github.com/repos/actions/checkout/compare/main...a81bbbf8298c0fa03ea29cdc473d45769f953675", diverged)
+	httpmock.RegisterResponder("GET", "https://api.github.com/repos/actions/checkout/compare/v2.3.4...a81bbbf8298c0fa03ea29cdc473d45769f953675",
+		httpmock.NewStringResponder(200, `{"status": "identical"}`))
+
+	// actions/setup-node: SHA is an ancestor of the default branch
+	httpmock.RegisterResponder("GET", "https://api.github.com/repos/actions/setup-node", repository("main"))
+	httpmock.RegisterResponder("GET", "https://api.github.com/repos/actions/setup-node/compare/main...1f8c6b94b26d0feae1e387ca63ccbdc44d27b561",
+		httpmock.NewStringResponder(200, `{"status": "behind", "behind_by": 12}`))
+
+	// actions/upload-artifact: SHA is only on a release of a maintenance branch
+	httpmock.RegisterResponder("GET", "https://api.github.com/repos/actions/upload-artifact", repository("main"))
+	httpmock.RegisterResponder("GET", "https://api.github.com/repos/actions/upload-artifact/compare/main...a8a3f3ad30e3422c9c7b888a15615d19a852ae32", diverged)
+	httpmock.RegisterResponder("GET", "https://api.github.com/repos/actions/upload-artifact/releases",
+		httpmock.NewStringResponder(200, `[{"tag_name": "v4.0.0"}, {"tag_name": "v3.1.3"}, {"tag_name": "v3.1.2"}]`))
+	httpmock.RegisterResponder("GET", "https://api.github.com/repos/actions/upload-artifact/compare/v4.0.0...a8a3f3ad30e3422c9c7b888a15615d19a852ae32", diverged)
+	httpmock.RegisterResponder("GET", "https://api.github.com/repos/actions/upload-artifact/compare/v3.1.3...a8a3f3ad30e3422c9c7b888a15615d19a852ae32",
+		httpmock.NewStringResponder(200, `{"status": "behind", "behind_by": 2}`))
+
+	// actions/cache: SHA only exists in a fork, so it diverges from every ref
+	httpmock.RegisterResponder("GET", "https://api.github.com/repos/actions/cache", repository("main"))
+	httpmock.RegisterResponder("GET", "https://api.github.com/repos/actions/cache/compare/main...0000000000000000000000000000000000000001", diverged)
+	httpmock.RegisterResponder("GET", "https://api.github.com/repos/actions/cache/releases",
+		httpmock.NewStringResponder(200, `[{"tag_name": "v5.0.0", "draft": true}, {"tag_name": "v4.0.0"}]`))
+	httpmock.RegisterResponder("GET", "https://api.github.com/repos/actions/cache/compare/v4.0.0...0000000000000000000000000000000000000001",
+		httpmock.NewStringResponder(404, `{"message": "Not Found"}`))
+
+	got, err := VerifyPinnedActions(input)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(got) != 1 || got[0] != "actions/cache@0000000000000000000000000000000000000001" {
+		t.Errorf("VerifyPinnedActions() = %v, want [actions/cache@0000000000000000000000000000000000000001]", got)
+	}
+
+	info := httpmock.GetCallCountInfo()
+	// the repeated actions/checkout pin is verified once
+	if calls := info["GET https://api.github.com/repos/actions/checkout"]; calls != 1 {
+		t.Errorf("expected actions/checkout to be looked up once, got %d", calls)
+	}
+	// comparisons stop at the first ref the SHA is reachable from
+	if calls := info["GET https://api.github.com/repos/actions/upload-artifact/compare/v3.1.2...a8a3f3ad30e3422c9c7b888a15615d19a852ae32"]; calls != 0 {
+		t.Errorf("expected no comparison after the first hit, got %d", calls)
+	}
+}
+
+func TestVerifyPinnedActionsInvalidYaml(t *testing.T) {
+	if _, err := VerifyPinnedActions("jobs: ["); err == nil {
+		t.Error("expected error for invalid yaml")
+	}
+}
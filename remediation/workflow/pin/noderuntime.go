@@ -0,0 +1,298 @@
+package pin
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/google/go-github/v40/github"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	NodeRuntimeRetired    = "retired"
+	NodeRuntimeDeprecated = "deprecated"
+)
+
+// nodeRuntimeStatus is the status of the Node runtimes GitHub has retired or announced
+// the retirement of. Runtimes not listed, e.g. node24, are current.
+var nodeRuntimeStatus = map[string]string{
+	"node12": NodeRuntimeRetired,
+	"node16": NodeRuntimeRetired,
+	"node20": NodeRuntimeDeprecated,
+}
+
+var majorTagRegex = regexp.MustCompile(`^v[0-9]+$`)
+
+// NodeRuntimeFinding is an action whose action.yml declares a retired or deprecated Node runtime,
+// or whose runtime or fix could not be looked up
+type NodeRuntimeFinding struct {
+	Action string // owner/repo@ref as written in the workflow
+	Using  string // runs.using of action.yml at ref
+	Status string // NodeRuntimeRetired or NodeRuntimeDeprecated
+	// FixedVersion is the lowest newer release on a current runtime, empty if none was found
+	FixedVersion string
+	// Error is why the action could not be checked or fixed. The action is left as is.
+	Error string
+}
+
+func (f NodeRuntimeFinding) String() string {
+	if f.Using == "" {
+		return fmt.Sprintf("%s: unable to check the Node runtime: %s", f.Action, f.Error)
+	}
+	s := fmt.Sprintf("%s: %s is %s", f.Action, f.Using, f.Status)
+	if f.FixedVersion != "" {
+		s += fmt.Sprintf(", %s uses a current runtime", f.FixedVersion)
+	}
+	if f.Error != "" {
+		s += fmt.Sprintf(", unable to fix: %s", f.Error)
+	}
+	return s
+}
+
+// CheckNodeRuntimes reads runs.using from action.yml of every action at the ref it is pinned to
+// and reports actions on a retired or deprecated Node runtime. When fix is true, those actions are
+// moved to the lowest newer release on a current runtime. SHA pins stay SHA pins with a version
+// comment, a major tag like v2 becomes the new major tag if it exists, other tags the release tag.
+// An action that can not be looked up is reported with the error, and the other actions are still checked.
+func CheckNodeRuntimes(inputYaml string, fix bool) (string, bool, []NodeRuntimeFinding, error) {
+	t := yaml.Node{}
+	err := yaml.Unmarshal([]byte(inputYaml), &t)
+	if err != nil {
+		return inputYaml, false, nil, fmt.Errorf("unable to parse yaml %v", err)
+	}
+
+	client := newGitHubClient(getPAT())
+
+	inputLines := strings.Split(inputYaml, "\n")
+	updated := false
+	findings := []NodeRuntimeFinding{}
+	// fixes is the ref and version comment each action is moved to, nil if it is left as is
+	type fixedRef struct {
+		ref        string
+		commentTag string
+	}
+	fixes := make(map[string]*fixedRef)
+
+	for _, usesNode := range collectUsesNodes(&t) {
+		action := usesNode.Value
+		if !strings.Contains(action, "@") || strings.HasPrefix(action, "docker://") || strings.Contains(action, "/.github/workflows/") {
+			// local actions, docker actions and reusable workflows have no Node runtime
+			continue
+		}
+		leftOfAt := strings.Split(action, "@")
+		ref := leftOfAt[1]
+		splitOnSlash := strings.SplitN(leftOfAt[0], "/", 3)
+		if len(splitOnSlash) < 2 {
+			continue
+		}
+		owner, repo, dir := splitOnSlash[0], splitOnSlash[1], ""
+		if len(splitOnSlash) == 3 {
+			dir = splitOnSlash[2]
+		}
+
+		fixed, ok := fixes[action]
+		if !ok {
+			comment := strings.TrimSpace(strings.TrimPrefix(usesNode.LineComment, "#"))
+			finding := checkNodeRuntime(client, owner, repo, dir, ref, comment, fix)
+			if finding != nil {
+				finding.Action = action
+				if finding.FixedVersion != "" && finding.Error == "" {
+					newRef, commentTag, err := getFixedRef(client, owner, repo, ref, finding.FixedVersion)
+					if err != nil {
+						finding.Error = err.Error()
+					} else {
+						fixed = &fixedRef{ref: newRef, commentTag: commentTag}
+					}
+				}
+				findings = append(findings, *finding)
+			}
+			fixes[action] = fixed
+		}
+		if fixed == nil {
+			continue
+		}
+
+		lineNum := usesNode.Line - 1
+		line := inputLines[lineNum]
+		column := usesNode.Column - 1
+		line = line[:column] + strings.Replace(line[column:], "@"+ref, "@"+fixed.ref, 1)
+		if fixed.commentTag != "" {
+			line = ReplaceLineComment(line, column, fixed.commentTag)
+		}
+		inputLines[lineNum] = line
+		updated = true
+	}
+
+	return strings.Join(inputLines, "\n"), updated, findings, nil
+}
+
+// checkNodeRuntime returns the finding of owner/repo/dir at ref, or nil if it is on a current
+// runtime. A lookup that fails is returned as a finding with the error.
+func checkNodeRuntime(client *github.Client, owner, repo, dir, ref, comment string, fix bool) *NodeRuntimeFinding {
+	using, err := getRunsUsing(client, owner, repo, dir, ref)
+	if err != nil {
+		return &NodeRuntimeFinding{Error: err.Error()}
+	}
+	status, deprecated := nodeRuntimeStatus[using]
+	if !deprecated {
+		return nil
+	}
+	finding := &NodeRuntimeFinding{Using: using, Status: status}
+	if fix {
+		finding.FixedVersion, err = getCurrentRuntimeRelease(client, owner, repo, dir, ref, comment)
+		if err != nil {
+			finding.Error = err.Error()
+		}
+	}
+	return finding
+}
+
+// getFixedRef returns the ref an action pinned to ref is moved to for fixedVersion, and the
+// version comment to write if that ref is a SHA
+func getFixedRef(client *github.Client, owner, repo, ref, fixedVersion string) (string, string, error) {
+	ctx := context.Background()
+	if len(ref) == 40 && IsAllHex(ref) {
+		commitSHA, _, err := client.Repositories.GetCommitSHA1(ctx, owner, repo, fixedVersion, "")
+		if err != nil {
+			return "", "", err
+		}
+		return commitSHA, fixedVersion, nil
+	}
+	if majorTagRegex.MatchString(ref) {
+		majorTag := strings.SplitN(fixedVersion, ".", 2)[0]
+		if _, _, err := client.Git.GetRef(ctx, owner, repo, "tags/"+majorTag); err == nil {
+			return majorTag, "", nil
+		}
+	}
+	return fixedVersion, "", nil
+}
+
+// getRunsUsing returns runs.using of action.yml, or action.yaml, in dir of owner/repo at ref
+func getRunsUsing(client *github.Client, owner, repo, dir, ref string) (string, error) {
+	for _, fileName := range []string{"action.yml", "action.yaml"} {
+		file, _, resp, err := client.Repositories.GetContents(context.Background(), owner, repo, path.Join(dir, fileName), &github.RepositoryContentGetOptions{Ref: ref})
+		if err != nil {
+			if resp != nil && resp.StatusCode == http.StatusNotFound {
+				continue
+			}
+			return "", err
+		}
+		if file == nil {
+			continue
+		}
+		content, err := file.GetContent()
+		if err != nil {
+			return "", err
+		}
+		action := struct {
+			Runs struct {
+				Using string `yaml:"using"`
+			} `yaml:"runs"`
+		}{}
+		if err := yaml.Unmarshal([]byte(content), &action); err != nil {
+			return "", fmt.Errorf("unable to parse %s of %s/%s@%s: %v", fileName, owner, repo, ref, err)
+		}
+		return strings.ToLower(strings.TrimSpace(action.Runs.Using)), nil
+	}
+	// no action.yml, e.g. a branch that was deleted; nothing to check
+	return "", nil
+}
+
+// getCurrentRuntimeRelease returns the lowest release newer than the one ref points to whose
+// action.yml does not use a retired or deprecated Node runtime, or "" if there is none.
+func getCurrentRuntimeRelease(client *github.Client, owner, repo, dir, ref, comment string) (string, error) {
+	currentVersion := ref
+	if len(ref) == 40 && IsAllHex(ref) {
+		currentVersion = versionInCommentRegex.FindString(comment)
+		if !releaseVersionRegex.MatchString(currentVersion) {
+			var err error
+			currentVersion, err = getCommentTag(client, owner, repo, currentVersion, ref)
+			if err != nil {
+				return "", err
+			}
+		}
+	} else if majorTagRegex.MatchString(ref) {
+		currentVersion = ref + ".0.0"
+	}
+	current, ok := parseReleaseVersion(currentVersion)
+	if !ok {
+		// a branch or a tag that is not a release version
+		return "", nil
+	}
+
+	type candidate struct {
+		tag     string
+		version []int
+	}
+	var candidates []candidate
+	opts := &github.ListOptions{PerPage: 100}
+	for {
+		releases, resp, err := client.Repositories.ListReleases(context.Background(), owner, repo, opts)
+		if err != nil {
+			return "", err
+		}
+		for _, release := range releases {
+			if release.GetDraft() || release.GetPrerelease() {
+				continue
+			}
+			version, ok := parseReleaseVersion(release.GetTagName())
+			if !ok || compareReleaseVersions(version, current) <= 0 {
+				continue
+			}
+			candidates = append(candidates, candidate{tag: release.GetTagName(), version: version})
+		}
+		if resp == nil || resp.NextPage == 0 {
+			break
+		}
+		opts.Page = resp.NextPage
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		return compareReleaseVersions(candidates[i].version, candidates[j].version) < 0
+	})
+	isCurrent := func(tag string) (bool, error) {
+		using, err := getRunsUsing(client, owner, repo, dir, tag)
+		if err != nil {
+			return false, err
+		}
+		_, deprecated := nodeRuntimeStatus[using]
+		return !deprecated && using != "", nil
+	}
+	// The runtime usually changes with a major version, so only the newest release of each major
+	// version is checked until one is on a current runtime. The lowest such release of that major
+	// version is then found by bisecting, as releases do not move back to an older runtime.
+	for start := 0; start < len(candidates); {
+		end := start
+		for end+1 < len(candidates) && candidates[end+1].version[0] == candidates[start].version[0] {
+			end++
+		}
+		current, err := isCurrent(candidates[end].tag)
+		if err != nil {
+			return "", err
+		}
+		if !current {
+			start = end + 1
+			continue
+		}
+		low, high := start, end
+		for low < high {
+			mid := (low + high) / 2
+			current, err := isCurrent(candidates[mid].tag)
+			if err != nil {
+				return "", err
+			}
+			if current {
+				high = mid
+			} else {
+				low = mid + 1
+			}
+		}
+		return candidates[high].tag, nil
+	}
+	return "", nil
+}
@@ -0,0 +1,156 @@
+package pin
+
+import (
+	"encoding/base64"
+	"fmt"
+	"testing"
+
+	"github.com/jarcoal/httpmock"
+)
+
+func TestCheckNodeRuntimes(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	const input = `name: Node runtimes
+on: [push]
+jobs:
+  build:
+    runs-on: ubuntu-latest
+    steps:
+    - uses: actions/checkout@ee0669bd1cc54295c223e0bb666b733df41de1c5 # v2.7.0
+    - uses: actions/setup-node@v4
+    - uses: actions/cache@v4.2.0
+    - uses: step-security/composite-action@v1
+    - uses: octo-org/unavailable-action@v1
+    - uses: ./.github/actions/local
+  test:
+    runs-on: ubuntu-latest
+    steps:
+    - uses: actions/checkout@ee0669bd1cc54295c223e0bb666b733df41de1c5 # v2.7.0
+  call:
+    uses: octo-org/workflows/.github/workflows/build.yml@main
+`
+
+	const expected = `name: Node runtimes
+on: [push]
+jobs:
+  build:
+    runs-on: ubuntu-latest
+    steps:
+    - uses: actions/checkout@08c6903cd8c0fde910a37f88322edcfb5dd907a8 # v5.0.0
+    - uses: actions/setup-node@v5
+    - uses: actions/cache@v4.2.0
+    - uses: step-security/composite-action@v1
+    - uses: octo-org/unavailable-action@v1
+    - uses: ./.github/actions/local
+  test:
+    runs-on: ubuntu-latest
+    steps:
+    - uses: actions/checkout@08c6903cd8c0fde910a37f88322edcfb5dd907a8 # v5.0.0
+  call:
+    uses: octo-org/workflows/.github/workflows/build.yml@main
+`
+
+	actionYml := func(using string) httpmock.Responder {
+		content := fmt.Sprintf("name: action\nruns:\n  using: '%s'\n  main: dist/index.js\n", using)
+		return httpmock.NewStringResponder(200, fmt.Sprintf(`{"type":"file","encoding":"base64","content":"%s"}`, base64.StdEncoding.EncodeToString([]byte(content))))
+	}
+	notFound := httpmock.NewStringResponder(404, `{"message":"Not Found"}`)
+
+	// retired runtime, pinned to a SHA: the lowest release on a current runtime is v5.0.0
+	httpmock.RegisterResponder("GET", "https://api.github.com/repos/actions/checkout/contents/action.yml?ref=ee0669bd1cc54295c223e0bb666b733df41de1c5", actionYml("node12"))
+	httpmock.RegisterResponder("GET", "https://api.github.com/repos/actions/checkout/releases",
+		httpmock.NewStringResponder(200, `[
+			{"tag_name": "v5.0.0"},
+			{"tag_name": "v4.0.0"},
+			{"tag_name": "v3.6.0"},
+			{"tag_name": "v3.0.0"},
+			{"tag_name": "v6.0.0-beta", "prerelease": true},
+			{"tag_name": "v2.7.0"}
+		]`))
+	httpmock.RegisterResponder("GET", "https://api.github.com/repos/actions/checkout/contents/action.yml?ref=v3.0.0", actionYml("node16"))
+	httpmock.RegisterResponder("GET", "https://api.github.com/repos/actions/checkout/contents/action.yml?ref=v3.6.0", actionYml("node16"))
+	httpmock.RegisterResponder("GET", "https://api.github.com/repos/actions/checkout/contents/action.yml?ref=v4.0.0", actionYml("node20"))
+	httpmock.RegisterResponder("GET", "https://api.github.com/repos/actions/checkout/contents/action.yml?ref=v5.0.0", actionYml("node24"))
+	httpmock.RegisterResponder("GET", "https://api.github.com/repos/actions/checkout/commits/v5.0.0",
+		httpmock.NewStringResponder(200, `08c6903cd8c0fde910a37f88322edcfb5dd907a8`))
+
+	// deprecated runtime on a major tag: moves to the major tag of the fixed release
+	httpmock.RegisterResponder("GET", "https://api.github.com/repos/actions/setup-node/contents/action.yml?ref=v4", actionYml("node20"))
+	httpmock.RegisterResponder("GET", "https://api.github.com/repos/actions/setup-node/releases",
+		httpmock.NewStringResponder(200, `[
+			{"tag_name": "v5.0.0"},
+			{"tag_name": "v4.4.0"},
+			{"tag_name": "v3.9.1"}
+		]`))
+	httpmock.RegisterResponder("GET", "https://api.github.com/repos/actions/setup-node/contents/action.yml?ref=v4.4.0", actionYml("node20"))
+	httpmock.RegisterResponder("GET", "https://api.github.com/repos/actions/setup-node/contents/action.yml?ref=v5.0.0", actionYml("node24"))
+	httpmock.RegisterResponder("GET", "https://api.github.com/repos/actions/setup-node/git/ref/tags/v5",
+		httpmock.NewStringResponder(200, `{"ref":"refs/tags/v5","object":{"sha":"a0853c24544627f65ddf259abe73b1d18a591444","type":"commit"}}`))
+
+	// no newer release on a current runtime: reported but left alone
+	httpmock.RegisterResponder("GET", "https://api.github.com/repos/actions/cache/contents/action.yml?ref=v4.2.0", actionYml("node20"))
+	httpmock.RegisterResponder("GET", "https://api.github.com/repos/actions/cache/releases",
+		httpmock.NewStringResponder(200, `[{"tag_name": "v4.2.3"}, {"tag_name": "v4.2.0"}]`))
+	httpmock.RegisterResponder("GET", "https://api.github.com/repos/actions/cache/contents/action.yml?ref=v4.2.3", actionYml("node20"))
+
+	// a lookup that fails is reported, and the other actions are still checked
+	httpmock.RegisterResponder("GET", "https://api.github.com/repos/octo-org/unavailable-action/contents/action.yml?ref=v1",
+		httpmock.NewStringResponder(500, `{"message":"Server Error"}`))
+
+	// composite actions have no Node runtime, and this one only has action.yaml
+	httpmock.RegisterResponder("GET", "https://api.github.com/repos/step-security/composite-action/contents/action.yml?ref=v1", notFound)
+	httpmock.RegisterResponder("GET", "https://api.github.com/repos/step-security/composite-action/contents/action.yaml?ref=v1", actionYml("composite"))
+
+	output, updated, findings, err := CheckNodeRuntimes(input, true)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !updated {
+		t.Errorf("expected actions to be updated")
+	}
+	if output != expected {
+		t.Errorf("CheckNodeRuntimes() output did not match expected output\n%s", output)
+	}
+
+	want := []string{
+		"actions/checkout@ee0669bd1cc54295c223e0bb666b733df41de1c5: node12 is retired, v5.0.0 uses a current runtime",
+		"actions/setup-node@v4: node20 is deprecated, v5.0.0 uses a current runtime",
+		"actions/cache@v4.2.0: node20 is deprecated",
+		"octo-org/unavailable-action@v1: unable to check the Node runtime: GET https://api.github.com/repos/octo-org/unavailable-action/contents/action.yml?ref=v1: 500 Server Error []",
+	}
+	if len(findings) != len(want) {
+		t.Fatalf("got %d findings %v, want %d", len(findings), findings, len(want))
+	}
+	for i := range want {
+		if findings[i].String() != want[i] {
+			t.Errorf("finding %d = %s, want %s", i, findings[i].String(), want[i])
+		}
+	}
+
+	// only the newest release of a major version is read until one is on a current runtime
+	callCount := httpmock.GetCallCountInfo()
+	if n := callCount["GET https://api.github.com/repos/actions/checkout/contents/action.yml?ref=v3.0.0"]; n != 0 {
+		t.Errorf("expected action.yml of v3.0.0 not to be read, it was read %d times", n)
+	}
+
+	// without fix only the findings are reported, and releases are not looked up
+	httpmock.Reset()
+	httpmock.RegisterResponder("GET", "https://api.github.com/repos/actions/checkout/contents/action.yml?ref=ee0669bd1cc54295c223e0bb666b733df41de1c5", actionYml("node12"))
+	httpmock.RegisterResponder("GET", "https://api.github.com/repos/actions/setup-node/contents/action.yml?ref=v4", actionYml("node24"))
+	httpmock.RegisterResponder("GET", "https://api.github.com/repos/actions/cache/contents/action.yml?ref=v4.2.0", actionYml("node24"))
+	httpmock.RegisterResponder("GET", "https://api.github.com/repos/step-security/composite-action/contents/action.yml?ref=v1", actionYml("composite"))
+	httpmock.RegisterResponder("GET", "https://api.github.com/repos/octo-org/unavailable-action/contents/action.yml?ref=v1", actionYml("node24"))
+
+	output, updated, findings, err = CheckNodeRuntimes(input, false)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if updated || output != input {
+		t.Errorf("expected no changes without fix, got\n%s", output)
+	}
+	if len(findings) != 1 || findings[0].String() != "actions/checkout@ee0669bd1cc54295c223e0bb666b733df41de1c5: node12 is retired" {
+		t.Errorf("CheckNodeRuntimes() findings = %v", findings)
+	}
+}
@@ -57,12 +57,11 @@ func PinActions(inputYaml string, exemptedActions []string, pinToImmutable bool,
 
 func PinActionWithPatFallback(action, inputYaml string, exemptedActions []string, pinToImmutable bool, actionCommitMap map[string]string) (string, bool, error) {
 	// use secure repo token
-	PAT := os.Getenv("SECURE_REPO_PAT")
-	if PAT == "" {
-		PAT = os.Getenv("PAT")
-		log.Println("SECURE_REPO_PAT is not set, using PAT")
-	} else {
+	PAT := getPAT()
+	if UsingSecureRepoPAT() {
 		log.Println("SECURE_REPO_PAT is set")
+	} else {
+		log.Println("SECURE_REPO_PAT is not set, using PAT")
 	}
 	out, updated, err := PinAction(action, inputYaml, PAT, exemptedActions, pinToImmutable, actionCommitMap)
 	if err != nil && strings.Contains(err.Error(), "organization has an IP allow list enabled, and your IP address is not permitted to access this resource") {
@@ -95,43 +94,21 @@ func PinAction(action, inputYaml, PAT string, exemptedActions []string, pinToImm
 	owner := splitOnSlash[0]
 	repo := splitOnSlash[1]
 
-	ctx := context.Background()
-	ts := oauth2.StaticTokenSource(
-		&oauth2.Token{AccessToken: PAT},
-	)
-	tc := oauth2.NewClient(ctx, ts)
-
-	client := github.NewClient(tc)
-	var commitSHA string
-	var err error
-
+	client := newGitHubClient(PAT)
+	knownSHA := ""
 	if actionCommitMap != nil {
 		// Check case-insensitively by iterating through the map
 		for mapAction, actionWithCommit := range actionCommitMap {
 			if strings.EqualFold(action, mapAction) && actionWithCommit != "" {
-				commitSHA = actionWithCommit
-
-				if !semanticTagRegex.MatchString(tagOrBranch) {
-					tagOrBranch, err = getSemanticVersion(client, owner, repo, tagOrBranch, commitSHA)
-					if err != nil {
-						return inputYaml, updated, err
-					}
-				}
+				knownSHA = actionWithCommit
 				break
 			}
 		}
 	}
 
-	if commitSHA == "" {
-		commitSHA, _, err = client.Repositories.GetCommitSHA1(ctx, owner, repo, tagOrBranch, "")
-		if err != nil {
-			return inputYaml, updated, err
-		}
-		tagOrBranch, err = getSemanticVersion(client, owner, repo, tagOrBranch, commitSHA)
-		if err != nil {
-			return inputYaml, updated, err
-		}
-
+	commitSHA, tagOrBranch, err := resolveActionRef(client, owner, repo, tagOrBranch, knownSHA)
+	if err != nil {
+		return inputYaml, updated, err
 	}
 
 	// pinnedAction := fmt.Sprintf("%s@%s # %s", leftOfAt[0], commitSHA, tagOrBranch)
@@ -198,6 +175,42 @@ func PinAction(action, inputYaml, PAT string, exemptedActions []string, pinToImm
 	return inputYaml, updated, nil
 }
 
+// ResolveActionSHA returns the commit SHA ref of action (owner/repo or owner/repo/path)
+// points to, and the most specific semantic version tag of that commit, e.g. v4.1.1 for v4.
+// The version is ref itself if no such tag exists.
+func ResolveActionSHA(action, ref string) (string, string, error) {
+	splitOnSlash := strings.Split(action, "/")
+	if len(splitOnSlash) < 2 {
+		return "", "", fmt.Errorf("invalid owner/repo format: %s", action)
+	}
+	owner := splitOnSlash[0]
+	repo := splitOnSlash[1]
+
+	return resolveActionRef(newGitHubClient(getPAT()), owner, repo, ref, "")
+}
+
+// resolveActionRef returns the commit SHA tagOrBranch of owner/repo points to, or knownSHA if
+// it is set, and the most specific semantic version tag of that commit, e.g. v4.1.1 for v4.
+// The version is tagOrBranch itself if it is a semantic version tag or no such tag exists.
+func resolveActionRef(client *github.Client, owner, repo, tagOrBranch, knownSHA string) (string, string, error) {
+	commitSHA := knownSHA
+	if commitSHA == "" {
+		var err error
+		commitSHA, _, err = client.Repositories.GetCommitSHA1(context.Background(), owner, repo, tagOrBranch, "")
+		if err != nil {
+			return "", "", err
+		}
+	}
+	if semanticTagRegex.MatchString(tagOrBranch) {
+		return commitSHA, tagOrBranch, nil
+	}
+	version, err := getSemanticVersion(client, owner, repo, tagOrBranch, commitSHA)
+	if err != nil {
+		return "", "", err
+	}
+	return commitSHA, version, nil
+}
+
 // It may be that there was already a comment next to the action
 // In this case we want to remove the earlier comment
 // we add a comment with the Action version so dependabot/ renovatebot can update it
@@ -251,8 +264,13 @@ func IsAllHex(s string) bool {
 }
 
 func getSemanticVersion(client *github.Client, owner, repo, tagOrBranch, commitSHA string) (string, error) {
+	refPrefix := fmt.Sprintf("tags/%s.", tagOrBranch)
+	if tagOrBranch == "" {
+		// no version to narrow the listing to
+		refPrefix = "tags/"
+	}
 	tags, _, err := client.Git.ListMatchingRefs(context.Background(), owner, repo, &github.ReferenceListOptions{
-		Ref: fmt.Sprintf("tags/%s.", tagOrBranch),
+		Ref: refPrefix,
 		ListOptions: github.ListOptions{
 			PerPage: 100,
 		},
@@ -307,3 +325,18 @@ func ActionExists(actionName string, patterns []string) bool {
 func UsingSecureRepoPAT() bool {
 	return os.Getenv("SECURE_REPO_PAT") != ""
 }
+
+// getPAT returns the secure repo token, falling back to PAT when it is not set
+func getPAT() string {
+	if UsingSecureRepoPAT() {
+		return os.Getenv("SECURE_REPO_PAT")
+	}
+	return os.Getenv("PAT")
+}
+
+func newGitHubClient(PAT string) *github.Client {
+	ts := oauth2.StaticTokenSource(
+		&oauth2.Token{AccessToken: PAT},
+	)
+	return github.NewClient(oauth2.NewClient(context.Background(), ts))
+}
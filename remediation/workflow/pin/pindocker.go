@@ -2,6 +2,7 @@ package pin
 
 import (
 	"fmt"
+	"log"
 	"net/http"
 	"strings"
 
@@ -14,13 +15,24 @@ import (
 
 var Tr http.RoundTripper = remote.DefaultTransport
 
+// Keychain resolves registry credentials, see registry.NewKeychain
+var Keychain authn.Keychain = authn.DefaultKeychain
+
 func PinDocker(inputYaml string) (string, bool, error) {
+	out, updated, _, err := PinDockerWithReport(inputYaml)
+	return out, updated, err
+}
+
+// PinDockerWithReport is PinDocker that also returns the images the registry could not
+// resolve, as "image: error". Those images are left unpinned.
+func PinDockerWithReport(inputYaml string) (string, bool, []string, error) {
 	updated := false
+	var unresolved []string
 	workflow := metadata.Workflow{}
 
 	err := yaml.Unmarshal([]byte(inputYaml), &workflow)
 	if err != nil {
-		return inputYaml, updated, fmt.Errorf("unable to parse yaml %v", err)
+		return inputYaml, updated, unresolved, fmt.Errorf("unable to parse yaml %v", err)
 	}
 
 	out := inputYaml
@@ -30,16 +42,169 @@ func PinDocker(inputYaml string) (string, bool, error) {
 		for _, step := range job.Steps {
 			if len(step.Uses) > 0 && strings.HasPrefix(step.Uses, "docker://") && !strings.Contains(step.Uses, "@") {
 				localUpdated := false
-				out, localUpdated = pinDocker(step.Uses, jobName, out)
+				out, localUpdated, err = pinDocker(step.Uses, jobName, out)
+				if err != nil {
+					unresolved = append(unresolved, fmt.Sprintf("%s: %v", strings.TrimPrefix(step.Uses, "docker://"), err))
+				}
 				updated = updated || localUpdated
 			}
 		}
 	}
 
-	return out, updated, nil
+	// For docker actions
+	if workflow.Runs.Using == "docker" && strings.HasPrefix(workflow.Runs.Image, "docker://") && !strings.Contains(workflow.Runs.Image, "@") {
+		localUpdated := false
+		out, localUpdated, err = pinDocker(workflow.Runs.Image, "", out)
+		if err != nil {
+			unresolved = append(unresolved, fmt.Sprintf("%s: %v", strings.TrimPrefix(workflow.Runs.Image, "docker://"), err))
+		}
+		updated = updated || localUpdated
+	}
+
+	out, containersUpdated, containersUnresolved, err := pinContainerImages(out)
+	unresolved = append(unresolved, containersUnresolved...)
+	if err != nil {
+		return out, updated, unresolved, err
+	}
+	updated = updated || containersUpdated
+
+	return out, updated, unresolved, nil
+}
+
+// pinContainerImages pins the images of jobs.<id>.container and jobs.<id>.services.<name>
+// to digests, in both the scalar (container: node:18) and mapping (container: {image: node:18}) forms.
+// The image is written as repository@digest with the tag kept in the trailing comment.
+// Images the registry can not resolve are left as is and returned as "image: error".
+func pinContainerImages(inputYaml string) (string, bool, []string, error) {
+	t := yaml.Node{}
+	err := yaml.Unmarshal([]byte(inputYaml), &t)
+	if err != nil {
+		return inputYaml, false, nil, fmt.Errorf("unable to parse yaml %v", err)
+	}
+	if len(t.Content) == 0 {
+		return inputYaml, false, nil, nil
+	}
+
+	imageNodes := getContainerImageNodes(t.Content[0])
+	if len(imageNodes) == 0 {
+		return inputYaml, false, nil, nil
+	}
+
+	inputLines := strings.Split(inputYaml, "\n")
+	updated := false
+	var unresolved []string
+	for _, imageNode := range imageNodes {
+		image := imageNode.Value
+		if image == "" || strings.Contains(image, "${{") || strings.Contains(image, "@") {
+			// expressions can't be resolved statically, and digests are already pinned
+			continue
+		}
+
+		digest, err := getImageDigest(image)
+		if err != nil {
+			log.Printf("unable to pin container image %s: %v", image, err)
+			unresolved = append(unresolved, fmt.Sprintf("%s: %v", image, err))
+			continue
+		}
+
+		repository, tag := SplitImageTag(image)
+		lineNum := imageNode.Line - 1
+		column := imageNode.Column - 1
+		line := inputLines[lineNum]
+		line = line[:column] + strings.Replace(line[column:], image, repository+"@"+digest, 1)
+		inputLines[lineNum] = AppendLineComment(line, column, tag)
+		updated = true
+	}
+
+	return strings.Join(inputLines, "\n"), updated, unresolved, nil
+}
+
+// AppendLineComment appends text to the trailing comment of line, or adds a comment, keeping
+// whatever the comment already says. valueColumn is the 0-based column at which the value starts.
+func AppendLineComment(line string, valueColumn int, text string) string {
+	if valueColumn > len(line) {
+		valueColumn = len(line)
+	}
+	rest := line[valueColumn:]
+	comment := ""
+	if idx := strings.Index(rest, " #"); idx >= 0 {
+		comment = strings.TrimSpace(rest[idx+2:])
+		rest = rest[:idx]
+	}
+	if comment != "" {
+		text = comment + " " + text
+	}
+	return strings.TrimRight(line[:valueColumn]+rest, " \t") + " # " + text
+}
+
+// getContainerImageNodes returns the image nodes of every job container and service in a workflow
+func getContainerImageNodes(root *yaml.Node) []*yaml.Node {
+	var imageNodes []*yaml.Node
+	jobsNode := metadata.GetMappingValue(root, "jobs")
+	if jobsNode == nil || jobsNode.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 1; i < len(jobsNode.Content); i += 2 {
+		jobNode := jobsNode.Content[i]
+		if jobNode.Kind != yaml.MappingNode {
+			continue
+		}
+		if containerNode := metadata.GetMappingValue(jobNode, "container"); containerNode != nil {
+			if imageNode := getImageNode(containerNode); imageNode != nil {
+				imageNodes = append(imageNodes, imageNode)
+			}
+		}
+		if servicesNode := metadata.GetMappingValue(jobNode, "services"); servicesNode != nil && servicesNode.Kind == yaml.MappingNode {
+			for j := 1; j < len(servicesNode.Content); j += 2 {
+				if imageNode := getImageNode(servicesNode.Content[j]); imageNode != nil {
+					imageNodes = append(imageNodes, imageNode)
+				}
+			}
+		}
+	}
+	return imageNodes
+}
+
+// getImageNode returns the scalar node holding the image of a container or service,
+// which is either the node itself (scalar form) or its image key (mapping form).
+func getImageNode(containerNode *yaml.Node) *yaml.Node {
+	switch containerNode.Kind {
+	case yaml.ScalarNode:
+		return containerNode
+	case yaml.MappingNode:
+		if imageNode := metadata.GetMappingValue(containerNode, "image"); imageNode != nil && imageNode.Kind == yaml.ScalarNode {
+			return imageNode
+		}
+	}
+	return nil
+}
+
+// SplitImageTag splits node:18 into node and 18. Images without a tag get "latest",
+// which is what the runner pulls. A port in the registry host is not mistaken for a tag.
+func SplitImageTag(image string) (string, string) {
+	lastColon := strings.LastIndex(image, ":")
+	if lastColon > strings.LastIndex(image, "/") {
+		return image[:lastColon], image[lastColon+1:]
+	}
+	return image, "latest"
+}
+
+// getImageDigest returns the digest the registry serves for image.
+// For multi-platform images this is the digest of the index, so the pin covers every platform.
+func getImageDigest(image string) (string, error) {
+	ref, err := name.ParseReference(image)
+	if err != nil {
+		return "", err
+	}
+	desc, err := remote.Get(ref, remote.WithAuthFromKeychain(Keychain), remote.WithTransport(Tr))
+	if err != nil {
+		return "", err
+	}
+	return desc.Digest.String(), nil
 }
 
-func pinDocker(action, jobName, inputYaml string) (string, bool) {
+// pinDocker pins a docker:// image to its digest. The error says why the image could not be resolved.
+func pinDocker(action, jobName, inputYaml string) (string, bool, error) {
 	updated := false
 	leftOfAt := strings.Split(action, ":")
 	tag := "latest"
@@ -51,19 +216,19 @@ func pinDocker(action, jobName, inputYaml string) (string, bool) {
 
 	ref, err := name.ParseReference(image, name.WithDefaultTag(tag))
 	if err != nil {
-		return inputYaml, updated
+		return inputYaml, updated, err
 	}
 
-	img, err := remote.Image(ref, remote.WithAuthFromKeychain(authn.DefaultKeychain), remote.WithTransport(Tr))
+	img, err := remote.Image(ref, remote.WithAuthFromKeychain(Keychain), remote.WithTransport(Tr))
 	if err != nil {
-		//TODO: Log the error
-		return inputYaml, updated
+		log.Printf("unable to pin docker image %s: %v", image, err)
+		return inputYaml, updated, err
 	}
 
 	// Getting image digest
 	imghash, err := img.Digest()
 	if err != nil {
-		return inputYaml, updated
+		return inputYaml, updated, err
 	}
 
 	pinnedAction := fmt.Sprintf("%s:%s:%s@%s", leftOfAt[0], leftOfAt[1], tag, imghash.String())
@@ -72,5 +237,5 @@ func pinDocker(action, jobName, inputYaml string) (string, bool) {
 	inputYaml = strings.ReplaceAll(inputYaml, pinnedAction+"@", action+"@")
 	inputYaml = strings.ReplaceAll(inputYaml, pinnedAction+":", action+":")
 	updated = !strings.EqualFold(action, pinnedAction)
-	return inputYaml, updated
+	return inputYaml, updated, nil
 }
@@ -5,6 +5,7 @@ import (
 	"log"
 	"os"
 	"path"
+	"strings"
 	"testing"
 
 	"github.com/jarcoal/httpmock"
@@ -84,3 +85,77 @@ func TestDockerActions(t *testing.T) {
 		}
 	}
 }
+
+func TestSplitImageTag(t *testing.T) {
+	tests := []struct {
+		image          string
+		wantRepository string
+		wantTag        string
+	}{
+		{image: "node:18", wantRepository: "node", wantTag: "18"},
+		{image: "redis", wantRepository: "redis", wantTag: "latest"},
+		{image: "ghcr.io/owner/image:v1.2.3", wantRepository: "ghcr.io/owner/image", wantTag: "v1.2.3"},
+		{image: "registry.example.com:5000/app", wantRepository: "registry.example.com:5000/app", wantTag: "latest"},
+		{image: "registry.example.com:5000/app:1.2", wantRepository: "registry.example.com:5000/app", wantTag: "1.2"},
+	}
+	for _, tt := range tests {
+		repository, tag := SplitImageTag(tt.image)
+		if repository != tt.wantRepository || tag != tt.wantTag {
+			t.Errorf("SplitImageTag(%q) = %q, %q, want %q, %q", tt.image, repository, tag, tt.wantRepository, tt.wantTag)
+		}
+	}
+}
+
+func TestAppendLineComment(t *testing.T) {
+	tests := []struct {
+		line   string
+		column int
+		want   string
+	}{
+		{line: "    container: node@sha256:abc", column: 15, want: "    container: node@sha256:abc # 18"},
+		{line: "      image: node@sha256:abc   # internal cache", column: 13, want: "      image: node@sha256:abc # internal cache 18"},
+		{line: "      image: 'node@sha256:abc' # 3 replicas", column: 13, want: "      image: 'node@sha256:abc' # 3 replicas 18"},
+	}
+	for _, tt := range tests {
+		if got := AppendLineComment(tt.line, tt.column, "18"); got != tt.want {
+			t.Errorf("AppendLineComment(%q) = %q, want %q", tt.line, got, tt.want)
+		}
+	}
+}
+
+func TestPinDockerWithReport(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	saveTr := Tr
+	defer func() { Tr = saveTr }()
+	Tr = httpmock.DefaultTransport
+
+	httpmock.RegisterResponder("GET", "https://ghcr.io/v2/",
+		httpmock.NewStringResponder(200, `{
+	}`))
+	httpmock.RegisterNoResponder(httpmock.NewStringResponder(404, `{"errors":[{"code":"MANIFEST_UNKNOWN"}]}`))
+
+	const input = `name: Unresolvable images
+on: [push]
+jobs:
+  build:
+    runs-on: ubuntu-latest
+    container: ghcr.io/step-security/private:1.0
+    steps:
+    - uses: docker://ghcr.io/step-security/missing:2.0
+    - uses: actions/checkout@v4
+`
+
+	output, updated, unresolved, err := PinDockerWithReport(input)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if updated || output != input {
+		t.Errorf("unresolvable images should be left as is, got:\n%s", output)
+	}
+	if len(unresolved) != 2 || !strings.HasPrefix(unresolved[0], "ghcr.io/step-security/missing:2.0: ") ||
+		!strings.HasPrefix(unresolved[1], "ghcr.io/step-security/private:1.0: ") {
+		t.Errorf("unexpected unresolved images %v", unresolved)
+	}
+}
@@ -0,0 +1,250 @@
+package pin
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/go-github/v40/github"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	UpdateLevelPatch = "patch"
+	UpdateLevelMinor = "minor"
+	UpdateLevelMajor = "major"
+)
+
+// releaseVersionRegex matches v1.2.3 as well as release tags that leave out trailing components, like v4
+var releaseVersionRegex = regexp.MustCompile(`^v?([0-9]+)(?:\.([0-9]+))?(?:\.([0-9]+))?$`)
+
+// UpdatePolicy limits how far UpdatePins may move a pinned action.
+type UpdatePolicy struct {
+	// Level is the most significant version component allowed to change:
+	// "patch", "minor" or "major". Defaults to "minor".
+	Level string `json:"level"`
+	// MinAgeDays skips releases published less than this many days ago.
+	MinAgeDays int `json:"minAgeDays"`
+}
+
+// ActionUpdatePolicy applies Policy to actions matching Action,
+// which accepts the same patterns as exempted actions (e.g. "actions/*").
+type ActionUpdatePolicy struct {
+	Action string       `json:"action"`
+	Policy UpdatePolicy `json:"policy"`
+}
+
+type UpdatePinsConfig struct {
+	DefaultPolicy UpdatePolicy `json:"defaultPolicy"`
+	// Policies are checked in order; the first matching entry wins.
+	Policies []ActionUpdatePolicy `json:"policies"`
+}
+
+// PinUpdate describes an action moved to a newer release by UpdatePins.
+type PinUpdate struct {
+	Action       string
+	FromVersion  string
+	ToVersion    string
+	FromSHA      string
+	ToSHA        string
+	ChangelogURL string
+}
+
+func (u PinUpdate) String() string {
+	return fmt.Sprintf("%s %s -> %s (%s)", u.Action, u.FromVersion, u.ToVersion, u.ChangelogURL)
+}
+
+// now is overridden in tests
+var now = time.Now
+
+// UpdatePins moves every action pinned to a commit SHA to the newest release allowed by its policy,
+// updating both the SHA and the version comment. Actions pinned to tags or branches are left alone;
+// PinActions takes care of those. Like PinActions, exempted actions are skipped.
+func UpdatePins(inputYaml string, exemptedActions []string, config UpdatePinsConfig) (string, bool, []PinUpdate, error) {
+	t := yaml.Node{}
+	err := yaml.Unmarshal([]byte(inputYaml), &t)
+	if err != nil {
+		return inputYaml, false, nil, fmt.Errorf("unable to parse yaml %v", err)
+	}
+
+	client := newGitHubClient(getPAT())
+
+	inputLines := strings.Split(inputYaml, "\n")
+	updates := []PinUpdate{}
+	resolved := make(map[string]*PinUpdate)
+
+	for _, usesNode := range collectUsesNodes(&t) {
+		action := usesNode.Value
+		if !strings.Contains(action, "@") || strings.HasPrefix(action, "docker://") {
+			continue
+		}
+		leftOfAt := strings.Split(action, "@")
+		commitSHA := leftOfAt[1]
+		if len(commitSHA) != 40 || !IsAllHex(commitSHA) {
+			continue
+		}
+		splitOnSlash := strings.Split(leftOfAt[0], "/")
+		if len(splitOnSlash) < 2 {
+			continue
+		}
+		owner := splitOnSlash[0]
+		repo := splitOnSlash[1]
+		if ActionExists(leftOfAt[0], exemptedActions) {
+			continue
+		}
+
+		update, ok := resolved[action]
+		if !ok {
+			// the comment may be stale, so the version is resolved from the SHA and the comment is only a hint
+			comment := strings.TrimSpace(strings.TrimPrefix(usesNode.LineComment, "#"))
+			currentVersion, err := getCommentTag(client, owner, repo, comment, commitSHA)
+			if err != nil {
+				return inputYaml, false, updates, err
+			}
+
+			update, err = getPinUpdate(client, owner, repo, currentVersion, commitSHA, getUpdatePolicy(leftOfAt[0], config))
+			if err != nil {
+				return inputYaml, false, updates, err
+			}
+			if update != nil {
+				update.Action = leftOfAt[0]
+				updates = append(updates, *update)
+			}
+			resolved[action] = update
+		}
+		if update == nil {
+			continue
+		}
+
+		lineNum := usesNode.Line - 1
+		line := inputLines[lineNum]
+		column := usesNode.Column - 1
+		line = line[:column] + strings.Replace(line[column:], commitSHA, update.ToSHA, 1)
+		inputLines[lineNum] = ReplaceLineComment(line, column, update.ToVersion)
+	}
+
+	return strings.Join(inputLines, "\n"), len(updates) > 0, updates, nil
+}
+
+func getUpdatePolicy(action string, config UpdatePinsConfig) UpdatePolicy {
+	for _, actionPolicy := range config.Policies {
+		if ActionExists(action, []string{actionPolicy.Action}) {
+			return actionPolicy.Policy
+		}
+	}
+	return config.DefaultPolicy
+}
+
+// getPinUpdate returns the newest release of owner/repo allowed by policy,
+// or nil when currentVersion is not a release version or is already the newest allowed.
+func getPinUpdate(client *github.Client, owner, repo, currentVersion, commitSHA string, policy UpdatePolicy) (*PinUpdate, error) {
+	current, ok := parseReleaseVersion(currentVersion)
+	if !ok {
+		return nil, nil
+	}
+
+	var bestTag string
+	var best []int
+	opts := &github.ListOptions{PerPage: 100}
+	for {
+		releases, resp, err := client.Repositories.ListReleases(context.Background(), owner, repo, opts)
+		if err != nil {
+			return nil, err
+		}
+		for _, release := range releases {
+			if release.GetDraft() || release.GetPrerelease() {
+				continue
+			}
+			version, ok := parseReleaseVersion(release.GetTagName())
+			if !ok || compareReleaseVersions(version, current) <= 0 || !isAllowedByPolicy(current, version, release.GetPublishedAt().Time, policy) {
+				continue
+			}
+			if best == nil || compareReleaseVersions(version, best) > 0 {
+				best = version
+				bestTag = release.GetTagName()
+			}
+		}
+		if resp == nil || resp.NextPage == 0 {
+			break
+		}
+		opts.Page = resp.NextPage
+	}
+
+	if bestTag == "" {
+		return nil, nil
+	}
+
+	newSHA, _, err := client.Repositories.GetCommitSHA1(context.Background(), owner, repo, bestTag, "")
+	if err != nil {
+		return nil, err
+	}
+	if strings.EqualFold(newSHA, commitSHA) {
+		return nil, nil
+	}
+
+	return &PinUpdate{
+		FromVersion:  currentVersion,
+		ToVersion:    bestTag,
+		FromSHA:      commitSHA,
+		ToSHA:        newSHA,
+		ChangelogURL: fmt.Sprintf("https://github.com/%s/%s/compare/%s...%s", owner, repo, currentVersion, bestTag),
+	}, nil
+}
+
+func isAllowedByPolicy(current, candidate []int, publishedAt time.Time, policy UpdatePolicy) bool {
+	switch policy.Level {
+	case UpdateLevelPatch:
+		if candidate[0] != current[0] || candidate[1] != current[1] {
+			return false
+		}
+	case UpdateLevelMajor:
+		// any newer release
+	default:
+		if candidate[0] != current[0] {
+			return false
+		}
+	}
+
+	if policy.MinAgeDays > 0 {
+		if publishedAt.IsZero() || now().Sub(publishedAt) < time.Duration(policy.MinAgeDays)*24*time.Hour {
+			return false
+		}
+	}
+	return true
+}
+
+// parseReleaseVersion parses v1.2.3 or 1.2.3 into its major, minor and patch components.
+// Components left out, as in v4 or v4.1, are 0.
+func parseReleaseVersion(version string) ([]int, bool) {
+	matches := releaseVersionRegex.FindStringSubmatch(version)
+	if matches == nil {
+		return nil, false
+	}
+	parsed := make([]int, 3)
+	for i := range parsed {
+		if matches[i+1] == "" {
+			continue
+		}
+		n, err := strconv.Atoi(matches[i+1])
+		if err != nil {
+			return nil, false
+		}
+		parsed[i] = n
+	}
+	return parsed, true
+}
+
+func compareReleaseVersions(a, b []int) int {
+	for i := range a {
+		if a[i] != b[i] {
+			if a[i] > b[i] {
+				return 1
+			}
+			return -1
+		}
+	}
+	return 0
+}
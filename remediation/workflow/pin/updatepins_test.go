@@ -0,0 +1,172 @@
+package pin
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jarcoal/httpmock"
+)
+
+func TestUpdatePins(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	saveNow := now
+	defer func() { now = saveNow }()
+	now = func() time.Time { return time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC) }
+
+	const input = `name: Update pins
+on: [push]
+jobs:
+  build:
+    runs-on: ubuntu-latest
+    steps:
+    - uses: actions/checkout@8ade135a41bc03ea155e62e844d188df1ea18608 # v4.1.0
+    - uses: actions/setup-node@5e21ff4d9bc1a8cf6de233a3057d20ec6b3fb69d # v3.8.0
+    - uses: actions/cache@704facf57e6136b1bc63b828d79edcd491f0ee84 # v3.3.2
+    - uses: actions/upload-artifact@v3
+    - uses: actions/download-artifact@9bc31d5ccc31df68ecc42ccf4149144866c47d8a # v3.0.2
+    - uses: peter-evans/create-pull-request@153407881ec5c347639a548ade7d8ad1d6740e38 # v5.0.2
+  test:
+    runs-on: ubuntu-latest
+    steps:
+    - uses: actions/checkout@8ade135a41bc03ea155e62e844d188df1ea18608 # v4.1.0
+`
+
+	const expected = `name: Update pins
+on: [push]
+jobs:
+  build:
+    runs-on: ubuntu-latest
+    steps:
+    - uses: actions/checkout@b4ffde65f46336ab88eb53be808477a3936bae11 # v4.1.1
+    - uses: actions/setup-node@60edb5dd545a775178f52524783378180af0d1f8 # v4.0.2
+    - uses: actions/cache@704facf57e6136b1bc63b828d79edcd491f0ee84 # v3.3.2
+    - uses: actions/upload-artifact@v3
+    - uses: actions/download-artifact@9bc31d5ccc31df68ecc42ccf4149144866c47d8a # v3.0.2
+    - uses: peter-evans/create-pull-request@c5a7806660adbe173f04e3e038b0ccdcd758773c # v6
+  test:
+    runs-on: ubuntu-latest
+    steps:
+    - uses: actions/checkout@b4ffde65f46336ab88eb53be808477a3936bae11 # v4.1.1
+`
+
+	// the current version is resolved from the SHA, the comment only narrows the tag listing
+	httpmock.RegisterResponder("GET", "https://api.github.com/repos/actions/checkout/git/matching-refs/tags/v4.",
+		httpmock.NewStringResponder(200, `[{"ref": "refs/tags/v4.1.0", "object": {"sha": "8ade135a41bc03ea155e62e844d188df1ea18608", "type": "commit"}}]`))
+	httpmock.RegisterResponder("GET", "https://api.github.com/repos/actions/cache/git/matching-refs/tags/v3.",
+		httpmock.NewStringResponder(200, `[{"ref": "refs/tags/v3.3.2", "object": {"sha": "704facf57e6136b1bc63b828d79edcd491f0ee84", "type": "commit"}}]`))
+	httpmock.RegisterResponder("GET", "https://api.github.com/repos/peter-evans/create-pull-request/git/matching-refs/tags/v5.",
+		httpmock.NewStringResponder(200, `[{"ref": "refs/tags/v5.0.2", "object": {"sha": "153407881ec5c347639a548ade7d8ad1d6740e38", "type": "commit"}}]`))
+	// the comment of setup-node is stale, the SHA is v3.8.1
+	httpmock.RegisterResponder("GET", "https://api.github.com/repos/actions/setup-node/git/matching-refs/tags/v3.",
+		httpmock.NewStringResponder(200, `[
+			{"ref": "refs/tags/v3.8.0", "object": {"sha": "e33196f7422957bea03ed53f6fbb155025ffc7b8", "type": "commit"}},
+			{"ref": "refs/tags/v3.8.1", "object": {"sha": "5e21ff4d9bc1a8cf6de233a3057d20ec6b3fb69d", "type": "commit"}}
+		]`))
+
+	// patch policy: v4.2.0 is a minor bump and v4.1.2 is a prerelease
+	httpmock.RegisterResponder("GET", "https://api.github.com/repos/actions/checkout/releases",
+		httpmock.NewStringResponder(200, `[
+			{"tag_name": "v4.2.0", "published_at": "2024-01-10T00:00:00Z"},
+			{"tag_name": "v4.1.2", "prerelease": true, "published_at": "2024-01-05T00:00:00Z"},
+			{"tag_name": "v4.1.1", "published_at": "2023-10-17T00:00:00Z"},
+			{"tag_name": "v4.1.0", "published_at": "2023-10-01T00:00:00Z"}
+		]`))
+	httpmock.RegisterResponder("GET", "https://api.github.com/repos/actions/checkout/commits/v4.1.1",
+		httpmock.NewStringResponder(200, `b4ffde65f46336ab88eb53be808477a3936bae11`))
+
+	// major policy with minimum age: v4.1.0 is too recent
+	httpmock.RegisterResponder("GET", "https://api.github.com/repos/actions/setup-node/releases",
+		httpmock.NewStringResponder(200, `[
+			{"tag_name": "v4.1.0", "published_at": "2024-02-27T00:00:00Z"},
+			{"tag_name": "v4.0.2", "published_at": "2024-02-01T00:00:00Z"},
+			{"tag_name": "v3.8.2", "published_at": "2023-12-01T00:00:00Z"}
+		]`))
+	httpmock.RegisterResponder("GET", "https://api.github.com/repos/actions/setup-node/commits/v4.0.2",
+		httpmock.NewStringResponder(200, `60edb5dd545a775178f52524783378180af0d1f8`))
+
+	// default minor policy: only a new major release exists
+	httpmock.RegisterResponder("GET", "https://api.github.com/repos/actions/cache/releases",
+		httpmock.NewStringResponder(200, `[
+			{"tag_name": "v4.0.0", "published_at": "2024-01-16T00:00:00Z"},
+			{"tag_name": "v3.3.2", "published_at": "2023-09-01T00:00:00Z"}
+		]`))
+
+	// major policy: the newest release is tagged with the major version only
+	httpmock.RegisterResponder("GET", "https://api.github.com/repos/peter-evans/create-pull-request/releases",
+		httpmock.NewStringResponder(200, `[
+			{"tag_name": "v6", "published_at": "2024-01-20T00:00:00Z"},
+			{"tag_name": "v5.0.2", "published_at": "2023-06-01T00:00:00Z"}
+		]`))
+	httpmock.RegisterResponder("GET", "https://api.github.com/repos/peter-evans/create-pull-request/commits/v6",
+		httpmock.NewStringResponder(200, `c5a7806660adbe173f04e3e038b0ccdcd758773c`))
+
+	config := UpdatePinsConfig{
+		DefaultPolicy: UpdatePolicy{Level: UpdateLevelMinor},
+		Policies: []ActionUpdatePolicy{
+			{Action: "actions/checkout", Policy: UpdatePolicy{Level: UpdateLevelPatch}},
+			{Action: "actions/setup-*", Policy: UpdatePolicy{Level: UpdateLevelMajor, MinAgeDays: 7}},
+			{Action: "peter-evans/*", Policy: UpdatePolicy{Level: UpdateLevelMajor}},
+		},
+	}
+
+	// download-artifact is exempted, so it has no responders and must not be looked up
+	output, updated, updates, err := UpdatePins(input, []string{"actions/download-artifact"}, config)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !updated {
+		t.Errorf("expected pins to be updated")
+	}
+	if output != expected {
+		t.Errorf("UpdatePins() output did not match expected output\n%s", output)
+	}
+
+	want := []string{
+		"actions/checkout v4.1.0 -> v4.1.1 (https://github.com/actions/checkout/compare/v4.1.0...v4.1.1)",
+		"actions/setup-node v3.8.1 -> v4.0.2 (https://github.com/actions/setup-node/compare/v3.8.1...v4.0.2)",
+		"peter-evans/create-pull-request v5.0.2 -> v6 (https://github.com/peter-evans/create-pull-request/compare/v5.0.2...v6)",
+	}
+	if len(updates) != len(want) {
+		t.Fatalf("got %d updates %v, want %d", len(updates), updates, len(want))
+	}
+	for i := range want {
+		if updates[i].String() != want[i] {
+			t.Errorf("update %d = %s, want %s", i, updates[i].String(), want[i])
+		}
+	}
+}
+
+func TestIsAllowedByPolicy(t *testing.T) {
+	saveNow := now
+	defer func() { now = saveNow }()
+	now = func() time.Time { return time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC) }
+
+	old := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	recent := time.Date(2024, 2, 28, 0, 0, 0, 0, time.UTC)
+	current := []int{1, 2, 3}
+
+	tests := []struct {
+		name        string
+		candidate   []int
+		publishedAt time.Time
+		policy      UpdatePolicy
+		want        bool
+	}{
+		{name: "patch allows patch", candidate: []int{1, 2, 4}, publishedAt: old, policy: UpdatePolicy{Level: UpdateLevelPatch}, want: true},
+		{name: "patch rejects minor", candidate: []int{1, 3, 0}, publishedAt: old, policy: UpdatePolicy{Level: UpdateLevelPatch}, want: false},
+		{name: "default allows minor", candidate: []int{1, 3, 0}, publishedAt: old, policy: UpdatePolicy{}, want: true},
+		{name: "default rejects major", candidate: []int{2, 0, 0}, publishedAt: old, policy: UpdatePolicy{}, want: false},
+		{name: "major allows major", candidate: []int{2, 0, 0}, publishedAt: old, policy: UpdatePolicy{Level: UpdateLevelMajor}, want: true},
+		{name: "too recent", candidate: []int{1, 2, 4}, publishedAt: recent, policy: UpdatePolicy{MinAgeDays: 7}, want: false},
+		{name: "unknown publish date", candidate: []int{1, 2, 4}, policy: UpdatePolicy{MinAgeDays: 7}, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isAllowedByPolicy(current, tt.candidate, tt.publishedAt, tt.policy); got != tt.want {
+				t.Errorf("isAllowedByPolicy() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
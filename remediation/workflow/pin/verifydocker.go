@@ -0,0 +1,66 @@
+package pin
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/step-security/secure-repo/remediation/registry"
+	metadata "github.com/step-security/secure-repo/remediation/workflow/metadata"
+	"gopkg.in/yaml.v3"
+)
+
+// PinDockerAndVerify pins docker images like PinDocker, then verifies the signatures and
+// provenance of every image pinned to a digest: docker:// steps, runs.image of docker actions,
+// job containers and services. Images that fail verification are reported, not unpinned.
+// Images the registry can not resolve are returned like PinDockerWithReport does.
+func PinDockerAndVerify(inputYaml string, policy registry.VerificationPolicy) (string, bool, []string, []registry.VerificationResult, error) {
+	out, updated, unresolved, err := PinDockerWithReport(inputYaml)
+	if err != nil {
+		return out, updated, unresolved, nil, err
+	}
+
+	t := yaml.Node{}
+	err = yaml.Unmarshal([]byte(out), &t)
+	if err != nil {
+		return out, updated, unresolved, nil, fmt.Errorf("unable to parse yaml %v", err)
+	}
+	if len(t.Content) == 0 {
+		return out, updated, unresolved, nil, nil
+	}
+
+	var images []string
+	for _, usesNode := range collectUsesNodes(&t) {
+		if strings.HasPrefix(usesNode.Value, "docker://") {
+			images = append(images, strings.TrimPrefix(usesNode.Value, "docker://"))
+		}
+	}
+	if runsNode := metadata.GetMappingValue(t.Content[0], "runs"); runsNode != nil {
+		if imageNode := metadata.GetMappingValue(runsNode, "image"); imageNode != nil && strings.HasPrefix(imageNode.Value, "docker://") {
+			images = append(images, strings.TrimPrefix(imageNode.Value, "docker://"))
+		}
+	}
+	for _, imageNode := range getContainerImageNodes(t.Content[0]) {
+		images = append(images, imageNode.Value)
+	}
+
+	results := []registry.VerificationResult{}
+	verified := make(map[string]bool)
+	for _, image := range images {
+		if !strings.Contains(image, "@") || verified[image] {
+			continue
+		}
+		verified[image] = true
+
+		ref, err := name.NewDigest(image)
+		if err != nil {
+			continue
+		}
+		result := registry.VerifyImage(ref, policy, remote.WithAuthFromKeychain(Keychain), remote.WithTransport(Tr))
+		result.Image = strings.Split(image, "@")[0]
+		results = append(results, result)
+	}
+
+	return out, updated, unresolved, results, nil
+}
@@ -0,0 +1,52 @@
+package pin
+
+import (
+	"testing"
+
+	"github.com/jarcoal/httpmock"
+	"github.com/step-security/secure-repo/remediation/registry"
+)
+
+func TestPinDockerAndVerify(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	saveTr := Tr
+	defer func() { Tr = saveTr }()
+	Tr = httpmock.DefaultTransport
+
+	httpmock.RegisterResponder("GET", "https://ghcr.io/v2/",
+		httpmock.NewStringResponder(200, `{
+	}`))
+	// no .sig or .att tags
+	httpmock.RegisterNoResponder(httpmock.NewStringResponder(404, `{"errors":[{"code":"MANIFEST_UNKNOWN"}]}`))
+
+	const input = `name: Verify
+on: [push]
+jobs:
+  build:
+    runs-on: ubuntu-latest
+    container: ghcr.io/step-security/app@sha256:1efef3bbdd297d1b321b9b4559092d3131961913bc68b7c92b681b4783d563f0 # 1.0
+    steps:
+    - uses: docker://ghcr.io/step-security/app@sha256:1efef3bbdd297d1b321b9b4559092d3131961913bc68b7c92b681b4783d563f0
+    - uses: actions/checkout@v4
+`
+
+	output, updated, unresolved, results, err := PinDockerAndVerify(input, registry.VerificationPolicy{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if updated || output != input {
+		t.Errorf("pinned images should not change")
+	}
+	if len(unresolved) != 0 {
+		t.Errorf("unexpected unresolved images %v", unresolved)
+	}
+	if len(results) != 1 {
+		t.Fatalf("expected the image to be verified once, got %v", results)
+	}
+	want := "ghcr.io/step-security/app@sha256:1efef3bbdd297d1b321b9b4559092d3131961913bc68b7c92b681b4783d563f0: image is not signed"
+	if results[0].Verified || results[0].String() != want {
+		t.Errorf("got %s, want %s", results[0].String(), want)
+	}
+}
@@ -0,0 +1,165 @@
+package pin
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/google/go-github/v40/github"
+	"gopkg.in/yaml.v3"
+)
+
+var versionInCommentRegex = regexp.MustCompile(`v?[0-9]+(\.[0-9]+)*`)
+
+// leadingVersionRegex matches a version written as the first word of a comment, e.g. v4.1.1 or v3
+var leadingVersionRegex = regexp.MustCompile(`^v?[0-9]+(\.[0-9]+)*$`)
+
+// VersionCommentMismatch describes an action pinned to a SHA whose trailing version comment
+// is missing or does not name the tag getSemanticVersion resolves for that SHA.
+// Tag is empty when the comment names a version but no tag points at the SHA.
+type VersionCommentMismatch struct {
+	Action  string // owner/repo@sha as written in the workflow
+	Comment string // existing comment without the leading #, empty when there is none
+	Tag     string // tag pointing at the SHA, empty when there is none
+}
+
+func (m VersionCommentMismatch) String() string {
+	comment := m.Comment
+	if comment == "" {
+		comment = "<none>"
+	}
+	if m.Tag == "" {
+		return fmt.Sprintf("%s: comment %s names a version but no tag points at the commit", m.Action, comment)
+	}
+	return fmt.Sprintf("%s: comment %s does not match tag %s", m.Action, comment, m.Tag)
+}
+
+// UpdateVersionComments checks the version comment of every action pinned to a commit SHA.
+// PinAction writes "owner/repo@<sha> # <tag>", but once pinned the step is never revisited,
+// so hand edits or tools that update only the SHA leave the comment stale.
+// When fix is true, the version in mismatched comments is rewritten to the tag of the SHA.
+// Comments naming a version on a SHA no tag points at are reported but never rewritten.
+func UpdateVersionComments(inputYaml string, fix bool) (string, bool, []VersionCommentMismatch, error) {
+	t := yaml.Node{}
+	err := yaml.Unmarshal([]byte(inputYaml), &t)
+	if err != nil {
+		return inputYaml, false, nil, fmt.Errorf("unable to parse yaml %v", err)
+	}
+
+	client := newGitHubClient(getPAT())
+
+	inputLines := strings.Split(inputYaml, "\n")
+	updated := false
+	mismatches := []VersionCommentMismatch{}
+	resolved := make(map[string]string)
+
+	for _, usesNode := range collectUsesNodes(&t) {
+		action := usesNode.Value
+		if !strings.Contains(action, "@") || strings.HasPrefix(action, "docker://") {
+			continue
+		}
+		leftOfAt := strings.Split(action, "@")
+		commitSHA := leftOfAt[1]
+		if len(commitSHA) != 40 || !IsAllHex(commitSHA) {
+			continue
+		}
+		splitOnSlash := strings.Split(leftOfAt[0], "/")
+		if len(splitOnSlash) < 2 {
+			continue
+		}
+
+		comment := strings.TrimSpace(strings.TrimPrefix(usesNode.LineComment, "#"))
+
+		tag, ok := resolved[action]
+		if !ok {
+			tag, err = getCommentTag(client, splitOnSlash[0], splitOnSlash[1], comment, commitSHA)
+			if err != nil {
+				return inputYaml, false, mismatches, err
+			}
+			resolved[action] = tag
+		}
+		version := LeadingVersion(comment)
+		if version == tag {
+			// the comment is already correct, or there is neither a version nor a tag
+			continue
+		}
+		if tag == "" {
+			// the comment claims a version for a SHA no tag points at, so there is nothing to fix it to
+			mismatches = append(mismatches, VersionCommentMismatch{Action: action, Comment: comment})
+			continue
+		}
+
+		mismatches = append(mismatches, VersionCommentMismatch{Action: action, Comment: comment, Tag: tag})
+		if fix {
+			lineNum := usesNode.Line - 1
+			inputLines[lineNum] = ReplaceLineComment(inputLines[lineNum], usesNode.Column-1, tag)
+			updated = true
+		}
+	}
+
+	return strings.Join(inputLines, "\n"), updated, mismatches, nil
+}
+
+// collectUsesNodes returns the scalar value nodes of every "uses" key in the document,
+// covering job steps, composite action steps and reusable workflow calls.
+func collectUsesNodes(node *yaml.Node) []*yaml.Node {
+	var usesNodes []*yaml.Node
+	if node.Kind == yaml.MappingNode {
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			if node.Content[i].Value == "uses" && node.Content[i+1].Kind == yaml.ScalarNode {
+				usesNodes = append(usesNodes, node.Content[i+1])
+			}
+		}
+	}
+	for _, n := range node.Content {
+		usesNodes = append(usesNodes, collectUsesNodes(n)...)
+	}
+	return usesNodes
+}
+
+// ReplaceLineComment sets the version in the trailing comment of line to tag, or appends a
+// comment, leaving everything before the comment as is. A version at the start of the comment is
+// replaced, any other text in the comment is kept after the tag. valueColumn is the 0-based
+// column at which the uses: value starts.
+func ReplaceLineComment(line string, valueColumn int, tag string) string {
+	if valueColumn > len(line) {
+		valueColumn = len(line)
+	}
+	rest := line[valueColumn:]
+	comment := ""
+	if idx := strings.Index(rest, " #"); idx >= 0 {
+		comment = strings.TrimSpace(rest[idx+2:])
+		rest = rest[:idx]
+	}
+	comment = strings.TrimSpace(strings.TrimPrefix(comment, LeadingVersion(comment)))
+	line = strings.TrimRight(line[:valueColumn]+rest, " \t") + " # " + tag
+	if comment != "" {
+		line += " " + comment
+	}
+	return line
+}
+
+// LeadingVersion returns the version at the start of comment, or "" if it does not start with one
+func LeadingVersion(comment string) string {
+	if fields := strings.Fields(comment); len(fields) > 0 && leadingVersionRegex.MatchString(fields[0]) {
+		return fields[0]
+	}
+	return ""
+}
+
+// getCommentTag returns the tag the version comment of an action pinned to commitSHA should name,
+// or "" if no tag points at it. It uses getSemanticVersion like PinAction does, first within the
+// major version of the existing comment, then over all tags, since the comment may be stale.
+func getCommentTag(client *github.Client, owner, repo, comment, commitSHA string) (string, error) {
+	if hint := versionInCommentRegex.FindString(comment); hint != "" {
+		majorVersion := strings.Split(hint, ".")[0]
+		tag, err := getSemanticVersion(client, owner, repo, majorVersion, commitSHA)
+		if err != nil {
+			return "", err
+		}
+		if tag != majorVersion {
+			return tag, nil
+		}
+	}
+	return getSemanticVersion(client, owner, repo, "", commitSHA)
+}
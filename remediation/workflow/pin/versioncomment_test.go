@@ -0,0 +1,146 @@
+package pin
+
+import (
+	"testing"
+
+	"github.com/jarcoal/httpmock"
+)
+
+func TestUpdateVersionComments(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	const input = `name: Version comments
+on: [push]
+jobs:
+  build:
+    runs-on: ubuntu-latest
+    steps:
+    - uses: actions/checkout@b4ffde65f46336ab88eb53be808477a3936bae11 # v4.1.0
+    - uses: actions/setup-node@60edb5dd545a775178f52524783378180af0d1f8
+    - uses: "actions/cache@13aacd865c20de90d75de3b17ebe84f7a17d57d2" # v4.0.0 shared cache
+    - uses: actions/upload-artifact@a8a3f3ad30e3422c9c7b888a15615d19a852ae32 # v3 keep until #123 is fixed
+    - uses: actions/download-artifact@65a9edc5881444af0b9093a5e628f2fe47ea3b2e # v3.0.2
+    - uses: actions/labeler@ac9175f8a1f3625fd0d4fb234536d26811351594 # v5.0.0
+    - uses: actions/download-artifact@v4
+`
+
+	const expected = `name: Version comments
+on: [push]
+jobs:
+  build:
+    runs-on: ubuntu-latest
+    steps:
+    - uses: actions/checkout@b4ffde65f46336ab88eb53be808477a3936bae11 # v4.1.1
+    - uses: actions/setup-node@60edb5dd545a775178f52524783378180af0d1f8 # v4.0.2
+    - uses: "actions/cache@13aacd865c20de90d75de3b17ebe84f7a17d57d2" # v4.0.0 shared cache
+    - uses: actions/upload-artifact@a8a3f3ad30e3422c9c7b888a15615d19a852ae32 # v3.1.3 keep until #123 is fixed
+    - uses: actions/download-artifact@65a9edc5881444af0b9093a5e628f2fe47ea3b2e # v4.1.7
+    - uses: actions/labeler@ac9175f8a1f3625fd0d4fb234536d26811351594 # v5.0.0
+    - uses: actions/download-artifact@v4
+`
+
+	// comment names the wrong patch version
+	httpmock.RegisterResponder("GET", "https://api.github.com/repos/actions/checkout/git/matching-refs/tags/v4.",
+		httpmock.NewStringResponder(200, `[
+			{"ref": "refs/tags/v4.1.0", "object": {"sha": "8ade135a41bc03ea155e62e844d188df1ea18608", "type": "commit"}},
+			{"ref": "refs/tags/v4.1.1", "object": {"sha": "b4ffde65f46336ab88eb53be808477a3936bae11", "type": "commit"}}
+		]`))
+
+	// no comment, so every tag is listed; v4.0.2 is an annotated tag
+	httpmock.RegisterResponder("GET", "https://api.github.com/repos/actions/setup-node/git/matching-refs/tags/",
+		httpmock.NewStringResponder(200, `[
+			{"ref": "refs/tags/v3.8.1", "object": {"sha": "5e21ff4d9bc1a8cf6de233a3057d20ec6b3fb69d", "type": "commit"}},
+			{"ref": "refs/tags/v4", "object": {"sha": "60edb5dd545a775178f52524783378180af0d1f8", "type": "commit"}},
+			{"ref": "refs/tags/v4.0.2", "object": {"sha": "d4c9e8bc50a2c4ee2c8c4b2c7b2c1b95c0d8b1aa", "type": "tag"}}
+		]`))
+	httpmock.RegisterResponder("GET", "https://api.github.com/repos/actions/setup-node/commits/v4.0.2",
+		httpmock.NewStringResponder(200, `60edb5dd545a775178f52524783378180af0d1f8`))
+
+	// comment is already correct
+	httpmock.RegisterResponder("GET", "https://api.github.com/repos/actions/cache/git/matching-refs/tags/v4.",
+		httpmock.NewStringResponder(200, `[
+			{"ref": "refs/tags/v4.0.0", "object": {"sha": "13aacd865c20de90d75de3b17ebe84f7a17d57d2", "type": "commit"}}
+		]`))
+
+	// comment names only the major version, and the text after it is kept
+	httpmock.RegisterResponder("GET", "https://api.github.com/repos/actions/upload-artifact/git/matching-refs/tags/v3.",
+		httpmock.NewStringResponder(200, `[
+			{"ref": "refs/tags/v3.1.2", "object": {"sha": "c7d193f32edcb7bfad88892161225aeda64e9392", "type": "commit"}},
+			{"ref": "refs/tags/v3.1.3", "object": {"sha": "a8a3f3ad30e3422c9c7b888a15615d19a852ae32", "type": "commit"}}
+		]`))
+
+	// comment is from another major version, so every tag is listed
+	httpmock.RegisterResponder("GET", "https://api.github.com/repos/actions/download-artifact/git/matching-refs/tags/v3.",
+		httpmock.NewStringResponder(200, `[
+			{"ref": "refs/tags/v3.0.2", "object": {"sha": "9bc31d5ccc31df68ecc42ccf4149144866c47d8a", "type": "commit"}}
+		]`))
+	httpmock.RegisterResponder("GET", "https://api.github.com/repos/actions/download-artifact/git/matching-refs/tags/",
+		httpmock.NewStringResponder(200, `[
+			{"ref": "refs/tags/v3.0.2", "object": {"sha": "9bc31d5ccc31df68ecc42ccf4149144866c47d8a", "type": "commit"}},
+			{"ref": "refs/tags/v4.1.7", "object": {"sha": "65a9edc5881444af0b9093a5e628f2fe47ea3b2e", "type": "commit"}}
+		]`))
+
+	// comment names a version but no tag points at the SHA
+	httpmock.RegisterResponder("GET", "https://api.github.com/repos/actions/labeler/git/matching-refs/tags/v5.",
+		httpmock.NewStringResponder(200, `[
+			{"ref": "refs/tags/v5.0.0", "object": {"sha": "8558fd74291d67161a8a78ce36a881fa63b766a9", "type": "commit"}}
+		]`))
+	httpmock.RegisterResponder("GET", "https://api.github.com/repos/actions/labeler/git/matching-refs/tags/",
+		httpmock.NewStringResponder(200, `[
+			{"ref": "refs/tags/v4.3.0", "object": {"sha": "f1fa0b3e0e6b4a0b6e2a5d8b1d1e1b5b8b0e6c4f", "type": "commit"}},
+			{"ref": "refs/tags/v5.0.0", "object": {"sha": "8558fd74291d67161a8a78ce36a881fa63b766a9", "type": "commit"}}
+		]`))
+
+	output, updated, mismatches, err := UpdateVersionComments(input, false)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if updated || output != input {
+		t.Errorf("report mode should not modify the workflow, got:\n%s", output)
+	}
+	want := []VersionCommentMismatch{
+		{Action: "actions/checkout@b4ffde65f46336ab88eb53be808477a3936bae11", Comment: "v4.1.0", Tag: "v4.1.1"},
+		{Action: "actions/setup-node@60edb5dd545a775178f52524783378180af0d1f8", Comment: "", Tag: "v4.0.2"},
+		{Action: "actions/upload-artifact@a8a3f3ad30e3422c9c7b888a15615d19a852ae32", Comment: "v3 keep until #123 is fixed", Tag: "v3.1.3"},
+		{Action: "actions/download-artifact@65a9edc5881444af0b9093a5e628f2fe47ea3b2e", Comment: "v3.0.2", Tag: "v4.1.7"},
+		{Action: "actions/labeler@ac9175f8a1f3625fd0d4fb234536d26811351594", Comment: "v5.0.0", Tag: ""},
+	}
+	if len(mismatches) != len(want) {
+		t.Fatalf("got %d mismatches %v, want %d", len(mismatches), mismatches, len(want))
+	}
+	for i := range want {
+		if mismatches[i] != want[i] {
+			t.Errorf("mismatch %d = %+v, want %+v", i, mismatches[i], want[i])
+		}
+	}
+
+	output, updated, _, err = UpdateVersionComments(input, true)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !updated {
+		t.Errorf("expected comments to be updated")
+	}
+	if output != expected {
+		t.Errorf("UpdateVersionComments() output did not match expected output\n%s", output)
+	}
+}
+
+func TestReplaceLineComment(t *testing.T) {
+	tests := []struct {
+		line   string
+		column int
+		want   string
+	}{
+		{line: "    - uses: a/b@sha # v1", column: 12, want: "    - uses: a/b@sha # v1.2.3"},
+		{line: "    - uses: a/b@sha", column: 12, want: "    - uses: a/b@sha # v1.2.3"},
+		{line: "      uses: 'a/b@sha'   #v1 pinned", column: 12, want: "      uses: 'a/b@sha' # v1.2.3 pinned"},
+		{line: "    - uses: a/b@sha # pinned for #42", column: 12, want: "    - uses: a/b@sha # v1.2.3 pinned for #42"},
+	}
+	for _, tt := range tests {
+		if got := ReplaceLineComment(tt.line, tt.column, "v1.2.3"); got != tt.want {
+			t.Errorf("ReplaceLineComment(%q) = %q, want %q", tt.line, got, tt.want)
+		}
+	}
+}
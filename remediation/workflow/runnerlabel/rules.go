@@ -0,0 +1,133 @@
+package runnerlabel
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// LabelRule replaces runner labels matching Source with Targets
+type LabelRule struct {
+	// Source is a glob, where each * and ? is a capture group, e.g. ubuntu-2*.
+	// If Regex is set it is a regular expression instead. Either way it has to
+	// match the whole label, and case is ignored like GitHub does for labels.
+	Source string `json:"source"`
+	Regex  bool   `json:"regex"`
+	// Targets are the labels to run on instead, e.g. [self-hosted, linux, x64].
+	// $1, ${1} or ${name} are replaced with the captures of Source.
+	Targets []string `json:"targets"`
+	// Workflows limits the rule to workflow paths matching one of these globs,
+	// e.g. .github/workflows/release-*.yml. A glob without / matches the file name.
+	Workflows []string `json:"workflows"`
+	// Jobs limits the rule to job ids matching one of these globs
+	Jobs []string `json:"jobs"`
+}
+
+type compiledRule struct {
+	LabelRule
+	re *regexp.Regexp
+}
+
+// RulesFromMap converts an exact old label to new label map to rules, sorted by old label
+func RulesFromMap(labelMap map[string]string) []LabelRule {
+	var oldLabels []string
+	for oldLabel := range labelMap {
+		oldLabels = append(oldLabels, oldLabel)
+	}
+	sort.Strings(oldLabels)
+
+	var rules []LabelRule
+	for _, oldLabel := range oldLabels {
+		rules = append(rules, LabelRule{
+			Source:  regexp.QuoteMeta(oldLabel),
+			Regex:   true,
+			Targets: []string{strings.ReplaceAll(labelMap[oldLabel], "$", "$$")},
+		})
+	}
+	return rules
+}
+
+func compileRules(rules []LabelRule) ([]compiledRule, error) {
+	var compiled []compiledRule
+	for _, rule := range rules {
+		if len(rule.Targets) == 0 {
+			return nil, fmt.Errorf("runner label rule %s has no targets", rule.Source)
+		}
+		expression := rule.Source
+		if !rule.Regex {
+			expression = globToRegex(rule.Source)
+		}
+		re, err := regexp.Compile("(?i)^(?:" + expression + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("invalid runner label rule %s: %v", rule.Source, err)
+		}
+		compiled = append(compiled, compiledRule{LabelRule: rule, re: re})
+	}
+	return compiled, nil
+}
+
+// globToRegex turns * and ? into capture groups and escapes everything else
+func globToRegex(glob string) string {
+	var sb strings.Builder
+	for _, r := range glob {
+		switch r {
+		case '*':
+			sb.WriteString("(.*)")
+		case '?':
+			sb.WriteString("(.)")
+		default:
+			sb.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	return sb.String()
+}
+
+// appliesTo reports whether the rule is in scope for the job of the workflow
+func (r compiledRule) appliesTo(workflowPath, jobName string) bool {
+	if len(r.Workflows) > 0 {
+		matched := false
+		for _, pattern := range r.Workflows {
+			name := workflowPath
+			if !strings.Contains(pattern, "/") {
+				name = path.Base(workflowPath)
+			}
+			if ok, _ := path.Match(pattern, name); ok {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	if len(r.Jobs) > 0 {
+		for _, pattern := range r.Jobs {
+			if ok, _ := path.Match(pattern, jobName); ok {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// replaceLabel returns the labels the first matching rule replaces label with
+func replaceLabel(rules []compiledRule, workflowPath, jobName, label string) ([]string, bool) {
+	for _, rule := range rules {
+		if !rule.appliesTo(workflowPath, jobName) {
+			continue
+		}
+		match := rule.re.FindStringSubmatchIndex(label)
+		if match == nil {
+			continue
+		}
+		var targets []string
+		for _, target := range rule.Targets {
+			targets = append(targets, string(rule.re.ExpandString(nil, target, label, match)))
+		}
+		return targets, true
+	}
+	return nil, false
+}
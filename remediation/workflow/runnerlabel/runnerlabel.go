@@ -2,136 +2,398 @@ package runnerlabel
 
 import (
 	"fmt"
+	"regexp"
+	"sort"
 	"strings"
 
+	metadata "github.com/step-security/secure-repo/remediation/workflow/metadata"
 	"github.com/step-security/secure-repo/remediation/workflow/permissions"
+	"github.com/step-security/secure-repo/remediation/workflow/runson"
 	"gopkg.in/yaml.v3"
 )
 
 // RunnerLabelMapping represents the replacement to be performed
 type RunnerLabelMapping struct {
-	jobName    string
-	oldLabel   string
-	newLabel   string
-	lineNum    int
-	columnNum  int
-	isArray    bool
-	arrayIndex int
+	jobName   string
+	oldLabel  string
+	newLabels []string
+	lineNum   int
+	columnNum int
+	// position is where the label is written, which decides how several labels are written
+	position labelPosition
 }
 
-// findRunsOnNode finds the runs-on node for a job, handling both string and array formats
-func findRunsOnNode(jobNode *yaml.Node) *yaml.Node {
-	for i := 0; i < len(jobNode.Content); i += 2 {
-		keyNode := jobNode.Content[i]
-		if keyNode.Value == "runs-on" && i+1 < len(jobNode.Content) {
-			return jobNode.Content[i+1]
-		}
-	}
-	return nil
+type labelPosition int
+
+const (
+	// scalarPosition is runs-on: label, labels: label or a strategy.matrix value;
+	// several labels are written as a flow sequence
+	scalarPosition labelPosition = iota
+	// flowItemPosition is an item of runs-on: [a, b]
+	flowItemPosition
+	// blockItemPosition is an item of a block sequence under runs-on
+	blockItemPosition
+)
+
+// JobLabels are the labels of a job before and after the replacement
+type JobLabels struct {
+	JobName string
+	Before  []string
+	After   []string
+}
+
+func (j JobLabels) String() string {
+	return fmt.Sprintf("%s: [%s] -> [%s]", j.JobName, strings.Join(j.Before, ", "), strings.Join(j.After, ", "))
+}
+
+type ReplaceRunnerLabelsResponse struct {
+	FinalOutput string
+	IsChanged   bool
+	// Jobs lists the labels of every job with runs-on before and after the replacement
+	Jobs []JobLabels
+	// Unresolved are runs-on expressions that could not be traced to strategy.matrix
+	// values, as "job: expression", and comparisons of a matrix value with a label
+	// that was replaced by several labels, which can not be rewritten
+	Unresolved []string
 }
 
 // ReplaceRunnerLabels replaces runner labels in a workflow based on the provided label map
 // labelMap: map of old labels to new labels (e.g., "ubuntu-latest" -> "step-ubuntu-24")
 // Returns: updated YAML string, bool indicating if changes were made, error if any
 func ReplaceRunnerLabels(inputYaml string, labelMap map[string]string) (string, bool, error) {
+	output, updated, _, err := ReplaceRunnerLabelsWithReport(inputYaml, labelMap)
+	return output, updated, err
+}
+
+// ReplaceRunnerLabelsWithReport is ReplaceRunnerLabels that also returns the runs-on
+// expressions that could not be traced to strategy.matrix values, as "job: expression".
+// Labels of those jobs are left for the caller to migrate by hand.
+func ReplaceRunnerLabelsWithReport(inputYaml string, labelMap map[string]string) (string, bool, []string, error) {
 	if len(labelMap) == 0 {
-		return inputYaml, false, nil
+		return inputYaml, false, nil, nil
+	}
+	response, err := ReplaceRunnerLabelsWithRules(inputYaml, "", RulesFromMap(labelMap), false)
+	if err != nil {
+		return "", false, nil, err
+	}
+	return response.FinalOutput, response.IsChanged, response.Unresolved, nil
+}
+
+// ReplaceRunnerLabelsWithRules replaces runner labels using rules, in order, the first
+// matching rule wins. workflowPath is matched against the rules' Workflows scope.
+// With dryRun the workflow is not changed and only the report is filled in.
+func ReplaceRunnerLabelsWithRules(inputYaml, workflowPath string, rules []LabelRule, dryRun bool) (*ReplaceRunnerLabelsResponse, error) {
+	response := &ReplaceRunnerLabelsResponse{FinalOutput: inputYaml}
+	compiled, err := compileRules(rules)
+	if err != nil {
+		return nil, err
 	}
 
 	// Parse the YAML into a tree structure
 	t := yaml.Node{}
-	err := yaml.Unmarshal([]byte(inputYaml), &t)
+	err = yaml.Unmarshal([]byte(inputYaml), &t)
 	if err != nil {
-		return "", false, fmt.Errorf("unable to parse yaml: %v", err)
+		return nil, fmt.Errorf("unable to parse yaml: %v", err)
 	}
 
 	// Find all jobs node
 	jobsNode := permissions.IterateNode(&t, "jobs", "!!map", 0)
 	if jobsNode == nil {
 		// No jobs found
-		return inputYaml, false, nil
+		return response, nil
 	}
 
 	// Collect all the replacements we need to make
 	var replacements []RunnerLabelMapping
 
+	inputLines := strings.Split(inputYaml, "\n")
+
 	// Iterate through each job
 	for i := 0; i < len(jobsNode.Content); i += 2 {
-		jobNameNode := jobsNode.Content[i]
+		jobName := jobsNode.Content[i].Value
 		jobNode := jobsNode.Content[i+1]
 
-		jobName := jobNameNode.Value
-
-		// Find the runs-on node for this job
-		runsOnNode := findRunsOnNode(jobNode)
-		if runsOnNode == nil {
+		runsOn := runson.Resolve(jobNode)
+		for _, expression := range runsOn.Unresolved {
+			response.Unresolved = append(response.Unresolved, fmt.Sprintf("%s: %s", jobName, expression))
+		}
+		if len(runsOn.Labels) == 0 && len(runsOn.Unresolved) == 0 {
 			continue
 		}
+		positions := getItemPositions(jobNode)
+		addMatrixListPositions(positions, jobNode)
 
-		// Handle both string and array formats
-		switch runsOnNode.Kind {
-		case yaml.ScalarNode:
-			// Single runner label
-			oldLabel := runsOnNode.Value
-			if newLabel, ok := labelMap[oldLabel]; ok {
+		// Labels set through ${{ matrix.* }} are replaced in strategy.matrix, where
+		// the value is written, so flow and block style and comments are kept
+		seen := map[*yaml.Node]bool{}
+		addReplacement := func(node *yaml.Node) ([]string, bool) {
+			newLabels, ok := replaceLabel(compiled, workflowPath, jobName, node.Value)
+			if !ok || (len(newLabels) == 1 && newLabels[0] == node.Value) {
+				return nil, false
+			}
+			if !seen[node] {
+				seen[node] = true
 				replacements = append(replacements, RunnerLabelMapping{
 					jobName:   jobName,
-					oldLabel:  oldLabel,
-					newLabel:  newLabel,
-					lineNum:   runsOnNode.Line - 1, // Convert to 0-based
-					columnNum: runsOnNode.Column - 1,
-					isArray:   false,
+					oldLabel:  node.Value,
+					newLabels: newLabels,
+					lineNum:   node.Line - 1, // Convert to 0-based
+					columnNum: node.Column - 1,
+					position:  positions[node],
 				})
 			}
-		case yaml.SequenceNode:
-			// Array of runner labels
-			for idx, labelNode := range runsOnNode.Content {
-				oldLabel := labelNode.Value
-				if newLabel, ok := labelMap[oldLabel]; ok {
-					replacements = append(replacements, RunnerLabelMapping{
-						jobName:    jobName,
-						oldLabel:   oldLabel,
-						newLabel:   newLabel,
-						lineNum:    labelNode.Line - 1, // Convert to 0-based
-						columnNum:  labelNode.Column - 1,
-						isArray:    true,
-						arrayIndex: idx,
-					})
+			return newLabels, true
+		}
+
+		jobLabels := JobLabels{JobName: jobName}
+		var matrixReplacements []matrixReplacement
+		for _, label := range runsOn.Labels {
+			jobLabels.Before = append(jobLabels.Before, label.Value)
+			if newLabels, ok := addReplacement(label.Node); ok {
+				jobLabels.After = append(jobLabels.After, newLabels...)
+				if m := (matrixReplacement{strings.Join(label.MatrixPath, "."), label.Value, newLabels}); label.FromMatrix && !containsReplacement(matrixReplacements, m) {
+					matrixReplacements = append(matrixReplacements, m)
 				}
+			} else {
+				jobLabels.After = append(jobLabels.After, label.Value)
+			}
+			if label.FromMatrix {
+				// exclude entries must keep matching the renamed values
+				for _, excludeNode := range runson.GetMatrixExcludeValues(jobNode, label.MatrixPath) {
+					addReplacement(excludeNode)
+				}
+			}
+		}
+
+		// expressions comparing the matrix value with a replaced label, e.g.
+		// if: matrix.os == 'ubuntu-latest', have to compare with the new label
+		startLine, endLine := getJobLines(&t, jobsNode, i, len(inputLines))
+		for _, m := range matrixReplacements {
+			for _, comparison := range findMatrixComparisons(inputLines, startLine, endLine, m) {
+				if len(m.newLabels) > 1 {
+					response.Unresolved = append(response.Unresolved, fmt.Sprintf("%s: %s compares with %s, which is replaced by [%s]",
+						jobName, comparison.text, m.oldLabel, strings.Join(m.newLabels, ", ")))
+					continue
+				}
+				replacements = append(replacements, RunnerLabelMapping{
+					jobName:   jobName,
+					oldLabel:  m.oldLabel,
+					newLabels: m.newLabels,
+					lineNum:   comparison.lineNum,
+					columnNum: comparison.columnNum,
+				})
 			}
 		}
+		jobLabels.Before = append(jobLabels.Before, runsOn.Unresolved...)
+		jobLabels.After = append(jobLabels.After, runsOn.Unresolved...)
+		response.Jobs = append(response.Jobs, jobLabels)
 	}
 
-	if len(replacements) == 0 {
+	if len(replacements) == 0 || dryRun {
 		// No changes needed
-		return inputYaml, false, nil
+		return response, nil
 	}
 
-	// Apply the replacements
-	inputLines := strings.Split(inputYaml, "\n")
-	updated := false
-
+	// Apply the replacements from the end of the file, so replacing a label does not
+	// move the labels before it in a flow sequence, or the lines after it when a
+	// block sequence item becomes several items
+	sort.SliceStable(replacements, func(i, j int) bool {
+		if replacements[i].lineNum != replacements[j].lineNum {
+			return replacements[i].lineNum > replacements[j].lineNum
+		}
+		return replacements[i].columnNum > replacements[j].columnNum
+	})
 	for _, r := range replacements {
 		if r.lineNum >= len(inputLines) {
 			continue
 		}
-
 		oldLine := inputLines[r.lineNum]
-
 		// Get the prefix (indentation + key)
 		prefix := oldLine[:r.columnNum]
+		token, quote := scalarToken(oldLine[r.columnNum:], r.oldLabel)
+		if token == "" {
+			continue
+		}
+		// Keep quotes, comments, etc. after the label
+		suffix := oldLine[r.columnNum+len(token):]
 
-		// Replace the old label with the new one
-		// We need to preserve any quotes, comments, etc.
-		oldLineAfterColumn := oldLine[r.columnNum:]
+		var quoted []string
+		for _, label := range r.newLabels {
+			quoted = append(quoted, quote+label+quote)
+		}
 
-		// Simple replacement - replace the first occurrence of the old label
-		newLineAfterColumn := strings.Replace(oldLineAfterColumn, r.oldLabel, r.newLabel, 1)
+		switch {
+		case len(quoted) == 1:
+			inputLines[r.lineNum] = prefix + quoted[0] + suffix
+		case r.position == flowItemPosition:
+			inputLines[r.lineNum] = prefix + strings.Join(quoted, ", ") + suffix
+		case r.position == blockItemPosition:
+			// the item is preceded by "- ", which may follow the "- " of an outer item
+			newLines := []string{prefix + quoted[0] + suffix}
+			itemPrefix := strings.Repeat(" ", r.columnNum-2) + "- "
+			for _, label := range quoted[1:] {
+				newLines = append(newLines, itemPrefix+label)
+			}
+			inputLines = append(inputLines[:r.lineNum], append(newLines, inputLines[r.lineNum+1:]...)...)
+		default:
+			inputLines[r.lineNum] = prefix + "[" + strings.Join(quoted, ", ") + "]" + suffix
+		}
+		response.IsChanged = true
+	}
 
-		inputLines[r.lineNum] = prefix + newLineAfterColumn
-		updated = true
+	response.FinalOutput = strings.Join(inputLines, "\n")
+	return response, nil
+}
+
+// getItemPositions returns the positions of the items of runs-on sequences,
+// either runs-on: [...] or labels: [...] of the group form
+func getItemPositions(jobNode *yaml.Node) map[*yaml.Node]labelPosition {
+	positions := map[*yaml.Node]labelPosition{}
+	for i := 0; i+1 < len(jobNode.Content); i += 2 {
+		if jobNode.Content[i].Value != "runs-on" {
+			continue
+		}
+		sequenceNode := jobNode.Content[i+1]
+		if sequenceNode.Kind == yaml.MappingNode {
+			for j := 0; j+1 < len(sequenceNode.Content); j += 2 {
+				if sequenceNode.Content[j].Value == "labels" {
+					sequenceNode = sequenceNode.Content[j+1]
+					break
+				}
+			}
+		}
+		if sequenceNode.Kind != yaml.SequenceNode {
+			break
+		}
+		position := blockItemPosition
+		if sequenceNode.Style == yaml.FlowStyle {
+			position = flowItemPosition
+		}
+		for _, item := range sequenceNode.Content {
+			positions[item] = position
+		}
+	}
+	return positions
+}
+
+// addMatrixListPositions adds the positions of labels in strategy.matrix values that are
+// lists of labels, e.g. os: [[self-hosted, linux]] or include: [{os: [self-hosted, linux]}],
+// so several labels are written into the list instead of as a nested list
+func addMatrixListPositions(positions map[*yaml.Node]labelPosition, jobNode *yaml.Node) {
+	matrixNode := metadata.GetMappingValue(metadata.GetMappingValue(jobNode, "strategy"), "matrix")
+	if matrixNode == nil || matrixNode.Kind != yaml.MappingNode {
+		return
+	}
+	for i := 1; i < len(matrixNode.Content); i += 2 {
+		if matrixNode.Content[i].Kind != yaml.SequenceNode {
+			continue
+		}
+		// the items are values, or include and exclude entries
+		for _, valueNode := range matrixNode.Content[i].Content {
+			addListPositions(positions, valueNode)
+		}
+	}
+}
+
+func addListPositions(positions map[*yaml.Node]labelPosition, node *yaml.Node) {
+	switch node.Kind {
+	case yaml.SequenceNode:
+		position := blockItemPosition
+		if node.Style == yaml.FlowStyle {
+			position = flowItemPosition
+		}
+		for _, item := range node.Content {
+			if item.Kind == yaml.ScalarNode {
+				positions[item] = position
+			}
+		}
+	case yaml.MappingNode:
+		for i := 1; i < len(node.Content); i += 2 {
+			addListPositions(positions, node.Content[i])
+		}
+	}
+}
+
+// matrixReplacement is a label set through strategy.matrix.<path> that was replaced
+type matrixReplacement struct {
+	path      string
+	oldLabel  string
+	newLabels []string
+}
+
+func containsReplacement(replacements []matrixReplacement, m matrixReplacement) bool {
+	for _, r := range replacements {
+		if r.path == m.path && strings.EqualFold(r.oldLabel, m.oldLabel) {
+			return true
+		}
 	}
+	return false
+}
 
-	output := strings.Join(inputLines, "\n")
-	return output, updated, nil
+// matrixComparison is a quoted label compared with a matrix value in an expression
+type matrixComparison struct {
+	text      string
+	lineNum   int
+	columnNum int
+}
+
+// findMatrixComparisons returns the comparisons of matrix.<path> with the old label in
+// lines [startLine, endLine), pointing at the quoted label. Expressions compare strings
+// case-insensitively.
+func findMatrixComparisons(lines []string, startLine, endLine int, m matrixReplacement) []matrixComparison {
+	matrix := `matrix\.` + regexp.QuoteMeta(m.path) + `\b`
+	label := `('` + regexp.QuoteMeta(m.oldLabel) + `')`
+	comparisonRegex := regexp.MustCompile(`(?i)` + matrix + `\s*[!=]=\s*` + label + `|` + label + `\s*[!=]=\s*` + matrix)
+
+	var comparisons []matrixComparison
+	for lineNum := startLine; lineNum < endLine && lineNum < len(lines); lineNum++ {
+		for _, match := range comparisonRegex.FindAllStringSubmatchIndex(lines[lineNum], -1) {
+			column := match[2]
+			if column < 0 {
+				column = match[4]
+			}
+			comparisons = append(comparisons, matrixComparison{
+				text:      lines[lineNum][match[0]:match[1]],
+				lineNum:   lineNum,
+				columnNum: column,
+			})
+		}
+	}
+	return comparisons
+}
+
+// getJobLines returns the 0-based lines [start, end) of the job at index i of jobsNode,
+// from its key to the next job, or to the next top-level key for the last job
+func getJobLines(root, jobsNode *yaml.Node, i, lineCount int) (int, int) {
+	start := jobsNode.Content[i].Line - 1
+	if i+2 < len(jobsNode.Content) {
+		return start, jobsNode.Content[i+2].Line - 1
+	}
+	end := lineCount
+	if len(root.Content) > 0 {
+		topLevel := root.Content[0]
+		for j := 0; j < len(topLevel.Content); j += 2 {
+			if line := topLevel.Content[j].Line - 1; line > start && line < end {
+				end = line
+			}
+		}
+	}
+	return start, end
+}
+
+// scalarToken returns the text of the scalar at the start of s, including its quotes,
+// and the quote character. It returns "" if s does not start with value.
+func scalarToken(s, value string) (string, string) {
+	if strings.HasPrefix(s, `"`) || strings.HasPrefix(s, "'") {
+		quote := s[:1]
+		end := strings.Index(s[1:], quote)
+		if end < 0 {
+			return "", ""
+		}
+		return s[:end+2], quote
+	}
+	if !strings.HasPrefix(s, value) {
+		return "", ""
+	}
+	return value, ""
 }
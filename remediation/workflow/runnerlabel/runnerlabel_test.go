@@ -3,6 +3,7 @@ package runnerlabel
 import (
 	"io/ioutil"
 	"path"
+	"strings"
 	"testing"
 )
 
@@ -105,6 +106,18 @@ func TestReplaceRunnerLabels(t *testing.T) {
 			wantUpdated: true,
 			wantErr:     false,
 		},
+		{
+			name:       "matrix expressions, group mapping and case-insensitive labels",
+			inputFile:  "matrixAndGroups.yml",
+			outputFile: "matrixAndGroups.yml",
+			labelMap: map[string]string{
+				"ubuntu-latest":  "step-ubuntu-24",
+				"ubuntu-22.04":   "step-ubuntu-22",
+				"windows-latest": "step-windows",
+			},
+			wantUpdated: true,
+			wantErr:     false,
+		},
 	}
 
 	for _, tt := range tests {
@@ -249,3 +262,143 @@ jobs:
 		})
 	}
 }
+
+func TestReplaceRunnerLabelsWithReport(t *testing.T) {
+	const inputDirectory = "../../../testfiles/runnerLabel/input"
+	const outputDirectory = "../../../testfiles/runnerLabel/output"
+
+	input, err := ioutil.ReadFile(path.Join(inputDirectory, "matrixInclude.yml"))
+	if err != nil {
+		t.Fatalf("error reading input file: %v", err)
+	}
+	labelMap := map[string]string{
+		"ubuntu-latest":    "step-ubuntu-24",
+		"ubuntu-24.04-arm": "step-ubuntu-24-arm",
+		"windows-latest":   "step-windows",
+	}
+	got, updated, unresolved, err := ReplaceRunnerLabelsWithReport(string(input), labelMap)
+	if err != nil {
+		t.Fatalf("ReplaceRunnerLabelsWithReport() error = %v", err)
+	}
+	if !updated {
+		t.Error("ReplaceRunnerLabelsWithReport() expected updated = true")
+	}
+
+	expectedOutput, err := ioutil.ReadFile(path.Join(outputDirectory, "matrixInclude.yml"))
+	if err != nil {
+		t.Fatalf("error reading expected output file: %v", err)
+	}
+	if got != string(expectedOutput) {
+		t.Errorf("ReplaceRunnerLabelsWithReport() output mismatch\nGot:\n%s\n\nWant:\n%s", got, string(expectedOutput))
+	}
+
+	want := []string{
+		"dynamic: ${{ matrix.os }}",
+		"input: ${{ inputs.runner }}",
+	}
+	if strings.Join(unresolved, "\n") != strings.Join(want, "\n") {
+		t.Errorf("ReplaceRunnerLabelsWithReport() unresolved = %v, want %v", unresolved, want)
+	}
+}
+
+func TestReplaceRunnerLabelsWithRules(t *testing.T) {
+	const inputDirectory = "../../../testfiles/runnerLabel/input"
+	const outputDirectory = "../../../testfiles/runnerLabel/output"
+
+	rules := []LabelRule{
+		{Source: "ubuntu-latest", Targets: []string{"old-runner"}, Jobs: []string{"legacy"}},
+		{Source: "ubuntu-22.04", Targets: []string{"release-runner"}, Workflows: []string{"release-*.yml"}},
+		{Source: "ubuntu-2*", Targets: []string{"our-ubuntu-2$1"}},
+		{Source: `ubuntu-(latest|\d+\.04)`, Regex: true, Targets: []string{"self-hosted", "linux", "x64"}},
+	}
+
+	input, err := ioutil.ReadFile(path.Join(inputDirectory, "labelRules.yml"))
+	if err != nil {
+		t.Fatalf("error reading input file: %v", err)
+	}
+	expectedOutput, err := ioutil.ReadFile(path.Join(outputDirectory, "labelRules.yml"))
+	if err != nil {
+		t.Fatalf("error reading expected output file: %v", err)
+	}
+	wantJobs := []string{
+		"build: [ubuntu-22.04] -> [our-ubuntu-22.04]",
+		"test: [ubuntu-latest] -> [self-hosted, linux, x64]",
+		"gpu-flow: [ubuntu-latest, gpu] -> [self-hosted, linux, x64, gpu]",
+		"gpu-block: [ubuntu-latest, gpu] -> [self-hosted, linux, x64, gpu]",
+		"matrix: [ubuntu-latest, windows-latest] -> [self-hosted, linux, x64, windows-latest]",
+		"legacy: [Ubuntu-Latest] -> [old-runner]",
+	}
+
+	for _, dryRun := range []bool{false, true} {
+		response, err := ReplaceRunnerLabelsWithRules(string(input), ".github/workflows/ci.yml", rules, dryRun)
+		if err != nil {
+			t.Fatalf("ReplaceRunnerLabelsWithRules() error = %v", err)
+		}
+
+		want := string(expectedOutput)
+		if dryRun {
+			want = string(input)
+		}
+		if response.FinalOutput != want {
+			t.Errorf("ReplaceRunnerLabelsWithRules(dryRun %v) output mismatch\nGot:\n%s\n\nWant:\n%s", dryRun, response.FinalOutput, want)
+		}
+		if response.IsChanged == dryRun {
+			t.Errorf("ReplaceRunnerLabelsWithRules(dryRun %v) IsChanged = %v", dryRun, response.IsChanged)
+		}
+
+		var jobs []string
+		for _, job := range response.Jobs {
+			jobs = append(jobs, job.String())
+		}
+		if strings.Join(jobs, "\n") != strings.Join(wantJobs, "\n") {
+			t.Errorf("ReplaceRunnerLabelsWithRules(dryRun %v) jobs =\n%s\nwant\n%s", dryRun, strings.Join(jobs, "\n"), strings.Join(wantJobs, "\n"))
+		}
+	}
+
+	// the workflow scope matches the file name
+	response, err := ReplaceRunnerLabelsWithRules("jobs:\n  build:\n    runs-on: ubuntu-22.04\n", ".github/workflows/release-npm.yml", rules, false)
+	if err != nil {
+		t.Fatalf("ReplaceRunnerLabelsWithRules() error = %v", err)
+	}
+	if response.FinalOutput != "jobs:\n  build:\n    runs-on: release-runner\n" {
+		t.Errorf("ReplaceRunnerLabelsWithRules() with workflow scope = %s", response.FinalOutput)
+	}
+
+	if _, err := ReplaceRunnerLabelsWithRules(string(input), "", []LabelRule{{Source: "(", Regex: true, Targets: []string{"x"}}}, false); err == nil {
+		t.Error("ReplaceRunnerLabelsWithRules() expected error for invalid regex")
+	}
+}
+
+func TestReplaceRunnerLabelsMatrixReferences(t *testing.T) {
+	const inputDirectory = "../../../testfiles/runnerLabel/input"
+	const outputDirectory = "../../../testfiles/runnerLabel/output"
+
+	rules := []LabelRule{
+		{Source: "ubuntu-latest", Targets: []string{"step-ubuntu-24"}},
+		{Source: "windows-latest", Targets: []string{"self-hosted", "windows"}},
+		{Source: "ubuntu-22.04", Targets: []string{"linux", "x64"}},
+	}
+
+	input, err := ioutil.ReadFile(path.Join(inputDirectory, "matrixReferences.yml"))
+	if err != nil {
+		t.Fatalf("error reading input file: %v", err)
+	}
+	expectedOutput, err := ioutil.ReadFile(path.Join(outputDirectory, "matrixReferences.yml"))
+	if err != nil {
+		t.Fatalf("error reading expected output file: %v", err)
+	}
+
+	response, err := ReplaceRunnerLabelsWithRules(string(input), "", rules, false)
+	if err != nil {
+		t.Fatalf("ReplaceRunnerLabelsWithRules() error = %v", err)
+	}
+	if response.FinalOutput != string(expectedOutput) {
+		t.Errorf("ReplaceRunnerLabelsWithRules() output mismatch\nGot:\n%s\n\nWant:\n%s", response.FinalOutput, string(expectedOutput))
+	}
+
+	// a comparison with a label replaced by several labels can not be rewritten
+	want := []string{"build: matrix.os == 'windows-latest' compares with windows-latest, which is replaced by [self-hosted, windows]"}
+	if strings.Join(response.Unresolved, "\n") != strings.Join(want, "\n") {
+		t.Errorf("ReplaceRunnerLabelsWithRules() unresolved = %v, want %v", response.Unresolved, want)
+	}
+}
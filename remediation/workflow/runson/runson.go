@@ -0,0 +1,207 @@
+package runson
+
+import (
+	"regexp"
+	"strings"
+
+	metadata "github.com/step-security/secure-repo/remediation/workflow/metadata"
+	"gopkg.in/yaml.v3"
+)
+
+// matrixExpressionRegex matches ${{ matrix.os }} and ${{ matrix.config.runner }}
+var matrixExpressionRegex = regexp.MustCompile(`^\$\{\{\s*matrix((?:\.[A-Za-z0-9_-]+)+)\s*\}\}$`)
+
+// Label is a runner label a job can run on
+type Label struct {
+	Value string
+	// Node is the scalar the label is written in: the runs-on value itself, or for
+	// runs-on: ${{ matrix.os }} the value in strategy.matrix
+	Node *yaml.Node
+	// FromMatrix is true if Node is in strategy.matrix
+	FromMatrix bool
+	// MatrixPath is the matrix key the label is read from, e.g. [config runner]
+	// for ${{ matrix.config.runner }}
+	MatrixPath []string
+}
+
+// RunsOn is the resolved runs-on of a job
+type RunsOn struct {
+	// Group is the runner group of the runs-on: {group: ..., labels: ...} form
+	Group string
+	// Labels are all the labels the job can run on. For matrix jobs this is
+	// the labels of every combination.
+	Labels []Label
+	// Unresolved are the expressions that can not be expanded statically,
+	// e.g. ${{ fromJSON(needs.setup.outputs.runners) }}
+	Unresolved []string
+}
+
+// Values returns the label values, and the group if one is set
+func (r RunsOn) Values() []string {
+	var values []string
+	if r.Group != "" {
+		values = append(values, r.Group)
+	}
+	for _, label := range r.Labels {
+		values = append(values, label.Value)
+	}
+	return values
+}
+
+// Matches reports whether any of the job's labels or its group is one of labels.
+// Runner labels are not case sensitive.
+func (r RunsOn) Matches(labels []string) bool {
+	for _, value := range r.Values() {
+		for _, label := range labels {
+			if Equal(value, label) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Equal compares runner labels, which GitHub matches case-insensitively
+func Equal(a, b string) bool {
+	return strings.EqualFold(strings.TrimSpace(a), strings.TrimSpace(b))
+}
+
+// Resolve resolves the runs-on of a job. It handles the scalar, sequence and
+// {group, labels} forms, and expands ${{ matrix.* }} against strategy.matrix,
+// including the values set by include entries.
+func Resolve(jobNode *yaml.Node) RunsOn {
+	runsOn := RunsOn{}
+	runsOnNode := metadata.GetMappingValue(jobNode, "runs-on")
+	if runsOnNode == nil {
+		return runsOn
+	}
+
+	switch runsOnNode.Kind {
+	case yaml.ScalarNode:
+		runsOn.addLabel(jobNode, runsOnNode)
+	case yaml.SequenceNode:
+		for _, labelNode := range runsOnNode.Content {
+			runsOn.addLabel(jobNode, labelNode)
+		}
+	case yaml.MappingNode:
+		if groupNode := metadata.GetMappingValue(runsOnNode, "group"); groupNode != nil && groupNode.Kind == yaml.ScalarNode {
+			runsOn.Group = groupNode.Value
+		}
+		if labelsNode := metadata.GetMappingValue(runsOnNode, "labels"); labelsNode != nil {
+			switch labelsNode.Kind {
+			case yaml.ScalarNode:
+				runsOn.addLabel(jobNode, labelsNode)
+			case yaml.SequenceNode:
+				for _, labelNode := range labelsNode.Content {
+					runsOn.addLabel(jobNode, labelNode)
+				}
+			}
+		}
+	}
+	return runsOn
+}
+
+func (r *RunsOn) addLabel(jobNode, labelNode *yaml.Node) {
+	if labelNode.Kind != yaml.ScalarNode {
+		return
+	}
+	if !strings.Contains(labelNode.Value, "${{") {
+		r.Labels = append(r.Labels, Label{Value: labelNode.Value, Node: labelNode})
+		return
+	}
+
+	matches := matrixExpressionRegex.FindStringSubmatch(strings.TrimSpace(labelNode.Value))
+	if matches == nil {
+		r.Unresolved = append(r.Unresolved, labelNode.Value)
+		return
+	}
+	matrixPath := strings.Split(matches[1][1:], ".")
+	valueNodes, ok := GetMatrixValues(jobNode, matrixPath)
+	if !ok {
+		r.Unresolved = append(r.Unresolved, labelNode.Value)
+		return
+	}
+	for _, valueNode := range valueNodes {
+		if strings.Contains(valueNode.Value, "${{") {
+			r.Unresolved = append(r.Unresolved, valueNode.Value)
+			continue
+		}
+		r.Labels = append(r.Labels, Label{Value: valueNode.Value, Node: valueNode, FromMatrix: true, MatrixPath: matrixPath})
+	}
+}
+
+// GetMatrixValues returns the scalar nodes strategy.matrix.<path> can take, from the
+// matrix key and from include entries. A value that is itself a list of labels,
+// e.g. os: [[self-hosted, linux]], contributes each of its items. It returns false
+// if the matrix is set by an expression or has no value for path.
+func GetMatrixValues(jobNode *yaml.Node, path []string) ([]*yaml.Node, bool) {
+	matrixNode := getMatrixNode(jobNode)
+	if matrixNode == nil {
+		return nil, false
+	}
+
+	var values []*yaml.Node
+	if valuesNode := metadata.GetMappingValue(matrixNode, path[0]); valuesNode != nil {
+		if valuesNode.Kind != yaml.SequenceNode {
+			// e.g. os: ${{ fromJSON(inputs.os) }}
+			return nil, false
+		}
+		for _, valueNode := range valuesNode.Content {
+			values = append(values, getPathScalars(valueNode, path[1:])...)
+		}
+	}
+	if includeNode := metadata.GetMappingValue(matrixNode, "include"); includeNode != nil && includeNode.Kind == yaml.SequenceNode {
+		for _, entryNode := range includeNode.Content {
+			values = append(values, getPathScalars(entryNode, path)...)
+		}
+	}
+	return values, len(values) > 0
+}
+
+// GetMatrixExcludeValues returns the scalar nodes strategy.matrix.exclude entries
+// set for path. They have to change along with the values GetMatrixValues returns,
+// or the entries stop excluding anything.
+func GetMatrixExcludeValues(jobNode *yaml.Node, path []string) []*yaml.Node {
+	matrixNode := getMatrixNode(jobNode)
+	if matrixNode == nil {
+		return nil
+	}
+	var values []*yaml.Node
+	if excludeNode := metadata.GetMappingValue(matrixNode, "exclude"); excludeNode != nil && excludeNode.Kind == yaml.SequenceNode {
+		for _, entryNode := range excludeNode.Content {
+			values = append(values, getPathScalars(entryNode, path)...)
+		}
+	}
+	return values
+}
+
+func getMatrixNode(jobNode *yaml.Node) *yaml.Node {
+	matrixNode := metadata.GetMappingValue(metadata.GetMappingValue(jobNode, "strategy"), "matrix")
+	if matrixNode == nil || matrixNode.Kind != yaml.MappingNode {
+		return nil
+	}
+	return matrixNode
+}
+
+// getPathScalars follows path through mappings and returns the scalars at its end
+func getPathScalars(node *yaml.Node, path []string) []*yaml.Node {
+	for _, key := range path {
+		node = metadata.GetMappingValue(node, key)
+		if node == nil {
+			return nil
+		}
+	}
+	switch node.Kind {
+	case yaml.ScalarNode:
+		return []*yaml.Node{node}
+	case yaml.SequenceNode:
+		var scalars []*yaml.Node
+		for _, item := range node.Content {
+			if item.Kind == yaml.ScalarNode {
+				scalars = append(scalars, item)
+			}
+		}
+		return scalars
+	}
+	return nil
+}
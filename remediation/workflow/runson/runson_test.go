@@ -0,0 +1,134 @@
+package runson
+
+import (
+	"reflect"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestResolve(t *testing.T) {
+	tests := []struct {
+		name           string
+		job            string
+		wantGroup      string
+		wantLabels     []string
+		wantFromMatrix []bool
+		wantUnresolved []string
+	}{
+		{
+			name:           "scalar",
+			job:            "runs-on: ubuntu-latest",
+			wantLabels:     []string{"ubuntu-latest"},
+			wantFromMatrix: []bool{false},
+		},
+		{
+			name:           "sequence",
+			job:            "runs-on: [self-hosted, linux]",
+			wantLabels:     []string{"self-hosted", "linux"},
+			wantFromMatrix: []bool{false, false},
+		},
+		{
+			name:           "group and labels",
+			job:            "runs-on:\n  group: large-runners\n  labels: ubuntu-latest",
+			wantGroup:      "large-runners",
+			wantLabels:     []string{"ubuntu-latest"},
+			wantFromMatrix: []bool{false},
+		},
+		{
+			name:      "group only",
+			job:       "runs-on:\n  group: large-runners",
+			wantGroup: "large-runners",
+		},
+		{
+			name:           "matrix with include",
+			job:            "runs-on: ${{ matrix.os }}\nstrategy:\n  matrix:\n    os: [ubuntu-latest, windows-latest]\n    include:\n      - os: macos-14\n      - node: 20",
+			wantLabels:     []string{"ubuntu-latest", "windows-latest", "macos-14"},
+			wantFromMatrix: []bool{true, true, true},
+		},
+		{
+			name:           "nested matrix value",
+			job:            "runs-on: ${{matrix.config.runner}}\nstrategy:\n  matrix:\n    config:\n      - runner: ubuntu-latest\n      - runner: [self-hosted, arm64]",
+			wantLabels:     []string{"ubuntu-latest", "self-hosted", "arm64"},
+			wantFromMatrix: []bool{true, true, true},
+		},
+		{
+			name:           "matrix and literal labels",
+			job:            "runs-on: [self-hosted, '${{ matrix.arch }}']\nstrategy:\n  matrix:\n    arch: [x64]",
+			wantLabels:     []string{"self-hosted", "x64"},
+			wantFromMatrix: []bool{false, true},
+		},
+		{
+			name:           "matrix from an expression",
+			job:            "runs-on: ${{ matrix.os }}\nstrategy:\n  matrix:\n    os: ${{ fromJSON(inputs.os) }}",
+			wantUnresolved: []string{"${{ matrix.os }}"},
+		},
+		{
+			name:           "not a matrix expression",
+			job:            "runs-on: ${{ inputs.runner }}",
+			wantUnresolved: []string{"${{ inputs.runner }}"},
+		},
+		{
+			name:           "partial interpolation",
+			job:            "runs-on: ubuntu-${{ matrix.version }}\nstrategy:\n  matrix:\n    version: [22.04]",
+			wantUnresolved: []string{"ubuntu-${{ matrix.version }}"},
+		},
+		{
+			name: "no runs-on",
+			job:  "uses: ./.github/workflows/build.yml",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			doc := yaml.Node{}
+			if err := yaml.Unmarshal([]byte(tt.job), &doc); err != nil {
+				t.Fatalf("error parsing job: %v", err)
+			}
+			got := Resolve(doc.Content[0])
+
+			if got.Group != tt.wantGroup {
+				t.Errorf("Resolve() group = %v, want %v", got.Group, tt.wantGroup)
+			}
+			var labels []string
+			var fromMatrix []bool
+			for _, label := range got.Labels {
+				labels = append(labels, label.Value)
+				fromMatrix = append(fromMatrix, label.FromMatrix)
+				if label.Node == nil || label.Node.Value != label.Value {
+					t.Errorf("Resolve() label %s does not point to its node", label.Value)
+				}
+			}
+			if !reflect.DeepEqual(labels, tt.wantLabels) {
+				t.Errorf("Resolve() labels = %v, want %v", labels, tt.wantLabels)
+			}
+			if !reflect.DeepEqual(fromMatrix, tt.wantFromMatrix) {
+				t.Errorf("Resolve() fromMatrix = %v, want %v", fromMatrix, tt.wantFromMatrix)
+			}
+			if !reflect.DeepEqual(got.Unresolved, tt.wantUnresolved) {
+				t.Errorf("Resolve() unresolved = %v, want %v", got.Unresolved, tt.wantUnresolved)
+			}
+		})
+	}
+}
+
+func TestMatches(t *testing.T) {
+	runsOn := RunsOn{
+		Group:  "Large-Runners",
+		Labels: []Label{{Value: "Ubuntu-Latest"}},
+	}
+	tests := []struct {
+		labels []string
+		want   bool
+	}{
+		{[]string{"ubuntu-latest"}, true},
+		{[]string{"large-runners"}, true},
+		{[]string{" UBUNTU-LATEST "}, true},
+		{[]string{"windows-latest"}, false},
+		{nil, false},
+	}
+	for _, tt := range tests {
+		if got := runsOn.Matches(tt.labels); got != tt.want {
+			t.Errorf("Matches(%v) = %v, want %v", tt.labels, got, tt.want)
+		}
+	}
+}
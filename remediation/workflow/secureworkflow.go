@@ -6,6 +6,8 @@ import (
 	"strings"
 
 	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/step-security/secure-repo/remediation/registry"
+	"github.com/step-security/secure-repo/remediation/workflow/deprecatedactions"
 	"github.com/step-security/secure-repo/remediation/workflow/hardenrunner"
 	"github.com/step-security/secure-repo/remediation/workflow/maintainedactions"
 	"github.com/step-security/secure-repo/remediation/workflow/permissions"
@@ -25,10 +27,26 @@ func SecureWorkflow(queryStringParams map[string]string, inputYaml string, svc d
 	ignoreMissingKBs := false
 	enableLogging := false
 	addEmptyTopLevelPermissions := false
+	denyByDefaultPermissions := false
 	skipHardenRunnerForContainers := false
 	replaceActionByMajorTag := false
+	checkActionInputs := false
+	replaceDeprecatedActions, replacedDeprecatedActions, deprecatedActionsFailed := false, false, false
+	var deprecatedActions []string
+	pinMaintainedActionsToSHA := false
+	verifyPinnedActions := false
+	checkVersionComments, fixVersionComments := false, false
+	checkNodeRuntimes, fixNodeRuntimes := false, false
+	updatePins := false
 	exemptedActions, pinToImmutable, maintainedActionsMap, actionCommitMap, runnerLabelMap := []string{}, false, map[string]string{}, map[string]string{}, map[string]string{}
 	hardenRunnerConfig := hardenrunner.HardenRunnerConfig{}
+	updatePinsConfig := pin.UpdatePinsConfig{}
+	var runnerLabelRules []runnerlabel.LabelRule
+	dryRunRunnerLabels := false
+	var maintainedActionsCatalog *maintainedactions.Catalog
+	maintainedActionsPolicy := maintainedactions.CatalogPolicy{}
+	verifyImages := false
+	var verificationPolicy *registry.VerificationPolicy
 
 	if len(params) > 0 {
 		if v, ok := params[0].([]string); ok {
@@ -60,6 +78,31 @@ func SecureWorkflow(queryStringParams map[string]string, inputYaml string, svc d
 			hardenRunnerConfig = v
 		}
 	}
+	if len(params) > 6 {
+		if v, ok := params[6].(pin.UpdatePinsConfig); ok {
+			updatePinsConfig = v
+		}
+	}
+	if len(params) > 7 {
+		if v, ok := params[7].([]runnerlabel.LabelRule); ok {
+			runnerLabelRules = v
+		}
+	}
+	if len(params) > 8 {
+		if v, ok := params[8].(*maintainedactions.Catalog); ok {
+			maintainedActionsCatalog = v
+		}
+	}
+	if len(params) > 9 {
+		if v, ok := params[9].(maintainedactions.CatalogPolicy); ok {
+			maintainedActionsPolicy = v
+		}
+	}
+	if len(params) > 10 {
+		if v, ok := params[10].(*registry.VerificationPolicy); ok {
+			verificationPolicy = v
+		}
+	}
 	if queryStringParams["pinActions"] == "false" {
 		pinActions = false
 	}
@@ -80,14 +123,18 @@ func SecureWorkflow(queryStringParams map[string]string, inputYaml string, svc d
 		addProjectComment = false
 	}
 
-	if len(maintainedActionsMap) > 0 {
+	if len(maintainedActionsMap) > 0 || maintainedActionsCatalog != nil {
 		replaceMaintainedActions = true
 	}
 
-	if len(runnerLabelMap) > 0 {
+	if len(runnerLabelMap) > 0 || len(runnerLabelRules) > 0 {
 		replaceRunnerLabels = true
 	}
 
+	if queryStringParams["dryRunRunnerLabels"] == "true" {
+		dryRunRunnerLabels = true
+	}
+
 	if queryStringParams["enableLogging"] == "true" {
 		enableLogging = true
 	}
@@ -96,14 +143,64 @@ func SecureWorkflow(queryStringParams map[string]string, inputYaml string, svc d
 		addEmptyTopLevelPermissions = true
 	}
 
+	if queryStringParams["denyByDefaultPermissions"] == "true" {
+		denyByDefaultPermissions = true
+	}
+
 	if queryStringParams["skipHardenRunnerForContainers"] == "true" {
 		skipHardenRunnerForContainers = true
 	}
 
+	if queryStringParams["blockEgress"] == "true" {
+		hardenRunnerConfig.BlockEgress = true
+	}
+
 	if queryStringParams["replaceActionByMajorTag"] == "true" {
 		replaceActionByMajorTag = true
 	}
 
+	if queryStringParams["replaceDeprecatedActions"] == "true" {
+		replaceDeprecatedActions = true
+	}
+
+	if queryStringParams["checkActionInputs"] == "true" {
+		checkActionInputs = true
+	}
+
+	if queryStringParams["pinMaintainedActionsToSHA"] == "true" {
+		pinMaintainedActionsToSHA = true
+	}
+
+	if queryStringParams["verifyPinnedActions"] == "true" {
+		verifyPinnedActions = true
+	}
+
+	if queryStringParams["updatePins"] == "true" {
+		updatePins = true
+	}
+
+	if queryStringParams["checkVersionComments"] == "true" {
+		checkVersionComments = true
+	}
+
+	if queryStringParams["fixVersionComments"] == "true" {
+		checkVersionComments = true
+		fixVersionComments = true
+	}
+
+	if queryStringParams["checkNodeRuntimes"] == "true" {
+		checkNodeRuntimes = true
+	}
+
+	if queryStringParams["fixNodeRuntimes"] == "true" {
+		checkNodeRuntimes = true
+		fixNodeRuntimes = true
+	}
+
+	if queryStringParams["verifyImages"] == "true" {
+		verifyImages = true
+	}
+
 	if enableLogging {
 		// Log query parameters
 		paramsJSON, _ := json.MarshalIndent(queryStringParams, "", "  ")
@@ -115,7 +212,46 @@ func SecureWorkflow(queryStringParams map[string]string, inputYaml string, svc d
 
 	secureWorkflowReponse := &permissions.SecureWorkflowReponse{FinalOutput: inputYaml, OriginalInput: inputYaml}
 	var err error
-	if addPermissions {
+
+	if replaceDeprecatedActions {
+		if enableLogging {
+			log.Printf("Replacing deprecated actions")
+		}
+		// runs first, so permissions, maintained actions and pinning apply to the successors.
+		// The results are set at the end, as adding permissions creates a new response.
+		deprecatedResponse, err := deprecatedactions.ReplaceDeprecatedActions(secureWorkflowReponse.FinalOutput)
+		if err != nil {
+			log.Printf("Error replacing deprecated actions: %v", err)
+			deprecatedActionsFailed = true
+		} else {
+			secureWorkflowReponse.FinalOutput = deprecatedResponse.FinalOutput
+			replacedDeprecatedActions = deprecatedResponse.IsChanged
+			for _, step := range deprecatedResponse.Steps {
+				deprecatedActions = append(deprecatedActions, step.String())
+			}
+		}
+	}
+
+	if addPermissions && denyByDefaultPermissions {
+		if enableLogging {
+			log.Printf("Setting deny-by-default permissions")
+		}
+		secureWorkflowReponse, err = permissions.SetDenyByDefaultPermissions(secureWorkflowReponse.FinalOutput, addProjectComment)
+		if err != nil {
+			if enableLogging {
+				log.Printf("Error setting deny-by-default permissions: %v", err)
+			}
+			return nil, err
+		}
+		secureWorkflowReponse.OriginalInput = inputYaml
+		if len(secureWorkflowReponse.MissingActions) > 0 && !ignoreMissingKBs {
+			if enableLogging {
+				log.Printf("Storing missing actions: %v", secureWorkflowReponse.MissingActions)
+			}
+			StoreMissingActions(secureWorkflowReponse.MissingActions, svc)
+		}
+		addedPermissions = secureWorkflowReponse.IsChanged
+	} else if addPermissions {
 		if enableLogging {
 			log.Printf("Adding job level permissions")
 		}
@@ -160,13 +296,27 @@ func SecureWorkflow(queryStringParams map[string]string, inputYaml string, svc d
 		// Only take the stage's output on success — on error (e.g. a parse
 		// failure returning "") keep the last good FinalOutput so a single
 		// failing stage can never blank the workflow file.
-		maintainedOutput, replaced, err := maintainedactions.ReplaceActions(secureWorkflowReponse.FinalOutput, maintainedActionsMap, replaceActionByMajorTag)
+		replaceConfig := maintainedactions.ReplaceActionsConfig{
+			ReplaceByMajorTag: replaceActionByMajorTag,
+			CheckInputs:       checkActionInputs,
+			SkipIncompatible:  checkActionInputs,
+			PinToSHA:          pinMaintainedActionsToSHA,
+			Catalog:           maintainedActionsCatalog,
+			Policy:            maintainedActionsPolicy,
+		}
+		maintainedResponse, err := maintainedactions.ReplaceActionsWithConfig(secureWorkflowReponse.FinalOutput, maintainedActionsMap, replaceConfig)
 		if err != nil {
 			log.Printf("Error replacing maintained actions: %v", err)
 			secureWorkflowReponse.HasErrors = true
 		} else {
-			secureWorkflowReponse.FinalOutput = maintainedOutput
-			replacedMaintainedActions = replaced
+			secureWorkflowReponse.FinalOutput = maintainedResponse.FinalOutput
+			replacedMaintainedActions = maintainedResponse.IsChanged
+			for _, incompatible := range maintainedResponse.Incompatible {
+				secureWorkflowReponse.IncompatibleMaintainedActions = append(secureWorkflowReponse.IncompatibleMaintainedActions, incompatible.String())
+			}
+			for _, replacement := range maintainedResponse.Replacements {
+				secureWorkflowReponse.MaintainedActionReplacements = append(secureWorkflowReponse.MaintainedActionReplacements, replacement.String())
+			}
 		}
 	}
 
@@ -174,13 +324,19 @@ func SecureWorkflow(queryStringParams map[string]string, inputYaml string, svc d
 		if enableLogging {
 			log.Printf("Replacing runner labels")
 		}
-		relabeledOutput, relabeled, err := runnerlabel.ReplaceRunnerLabels(secureWorkflowReponse.FinalOutput, runnerLabelMap)
+		// rules come first, the exact map applies to labels no rule matched
+		rules := append(append([]runnerlabel.LabelRule{}, runnerLabelRules...), runnerlabel.RulesFromMap(runnerLabelMap)...)
+		relabelResponse, err := runnerlabel.ReplaceRunnerLabelsWithRules(secureWorkflowReponse.FinalOutput, queryStringParams["path"], rules, dryRunRunnerLabels)
 		if err != nil {
 			log.Printf("Error replacing runner labels: %v", err)
 			secureWorkflowReponse.HasErrors = true
 		} else {
-			secureWorkflowReponse.FinalOutput = relabeledOutput
-			replacedRunnerLabels = relabeled
+			secureWorkflowReponse.FinalOutput = relabelResponse.FinalOutput
+			replacedRunnerLabels = relabelResponse.IsChanged
+			secureWorkflowReponse.UnresolvedRunnerLabels = relabelResponse.Unresolved
+			for _, jobLabels := range relabelResponse.Jobs {
+				secureWorkflowReponse.RunnerLabelChanges = append(secureWorkflowReponse.RunnerLabelChanges, jobLabels.String())
+			}
 		}
 		if enableLogging {
 			log.Printf("Replaced runner labels: %v", replacedRunnerLabels)
@@ -199,13 +355,112 @@ func SecureWorkflow(queryStringParams map[string]string, inputYaml string, svc d
 			}
 			return secureWorkflowReponse, err
 		}
-		secureWorkflowReponse.FinalOutput, pinnedDocker, _ = pin.PinDocker(secureWorkflowReponse.FinalOutput)
+		if verifyImages {
+			if verificationPolicy == nil {
+				verificationPolicy = &registry.VerificationPolicy{}
+				if policyJSON := queryStringParams["verificationPolicy"]; policyJSON != "" {
+					verificationPolicy, err = registry.ParseVerificationPolicy(policyJSON)
+					if err != nil {
+						return secureWorkflowReponse, err
+					}
+				}
+			}
+			secureWorkflowReponse.FinalOutput, pinnedDocker, secureWorkflowReponse.UnresolvedImages, secureWorkflowReponse.ImageVerifications, err = pin.PinDockerAndVerify(secureWorkflowReponse.FinalOutput, *verificationPolicy)
+		} else {
+			secureWorkflowReponse.FinalOutput, pinnedDocker, secureWorkflowReponse.UnresolvedImages, err = pin.PinDockerWithReport(secureWorkflowReponse.FinalOutput)
+		}
+		if err != nil {
+			if enableLogging {
+				log.Printf("Error pinning docker images: %v", err)
+			}
+			return secureWorkflowReponse, err
+		}
 		pinnedActions = pinnedAction || pinnedDocker
 		if enableLogging {
 			log.Printf("Pinned actions: %v, Pinned docker: %v", pinnedAction, pinnedDocker)
 		}
 	}
 
+	if updatePins {
+		if enableLogging {
+			log.Printf("Updating pinned actions")
+		}
+		updatedOutput, updated, pinUpdates, err := pin.UpdatePins(secureWorkflowReponse.FinalOutput, exemptedActions, updatePinsConfig)
+		if err != nil {
+			log.Printf("Error updating pinned actions: %v", err)
+			secureWorkflowReponse.HasErrors = true
+		} else {
+			secureWorkflowReponse.FinalOutput = updatedOutput
+			secureWorkflowReponse.UpdatedPins = updated
+			for _, pinUpdate := range pinUpdates {
+				secureWorkflowReponse.PinUpdates = append(secureWorkflowReponse.PinUpdates, pinUpdate.String())
+			}
+		}
+		if enableLogging {
+			log.Printf("Pin updates: %v", secureWorkflowReponse.PinUpdates)
+		}
+	}
+
+	if checkNodeRuntimes {
+		if enableLogging {
+			log.Printf("Checking Node runtimes of actions")
+		}
+		runtimeOutput, fixed, findings, err := pin.CheckNodeRuntimes(secureWorkflowReponse.FinalOutput, fixNodeRuntimes)
+		if err != nil {
+			log.Printf("Error checking Node runtimes: %v", err)
+			secureWorkflowReponse.HasErrors = true
+		} else {
+			secureWorkflowReponse.FinalOutput = runtimeOutput
+			secureWorkflowReponse.FixedNodeRuntimes = fixed
+			for _, finding := range findings {
+				secureWorkflowReponse.NodeRuntimeFindings = append(secureWorkflowReponse.NodeRuntimeFindings, finding.String())
+				if finding.Error != "" {
+					secureWorkflowReponse.HasErrors = true
+				}
+			}
+		}
+		if enableLogging {
+			log.Printf("Node runtime findings: %v", secureWorkflowReponse.NodeRuntimeFindings)
+		}
+	}
+
+	if checkVersionComments {
+		if enableLogging {
+			log.Printf("Checking version comments of pinned actions")
+		}
+		commentedOutput, fixed, mismatches, err := pin.UpdateVersionComments(secureWorkflowReponse.FinalOutput, fixVersionComments)
+		if err != nil {
+			log.Printf("Error checking version comments: %v", err)
+			secureWorkflowReponse.HasErrors = true
+		} else {
+			secureWorkflowReponse.FinalOutput = commentedOutput
+			secureWorkflowReponse.FixedVersionComments = fixed
+			for _, mismatch := range mismatches {
+				secureWorkflowReponse.VersionCommentMismatches = append(secureWorkflowReponse.VersionCommentMismatches, mismatch.String())
+			}
+		}
+		if enableLogging {
+			log.Printf("Version comment mismatches: %v", secureWorkflowReponse.VersionCommentMismatches)
+		}
+	}
+
+	if verifyPinnedActions {
+		if enableLogging {
+			log.Printf("Verifying pinned actions")
+		}
+		// Checks both SHAs that were already pinned and SHAs pinned above.
+		impostorCommits, err := pin.VerifyPinnedActions(secureWorkflowReponse.FinalOutput)
+		if err != nil {
+			log.Printf("Error verifying pinned actions: %v", err)
+			secureWorkflowReponse.HasErrors = true
+		} else {
+			secureWorkflowReponse.ImpostorCommits = impostorCommits
+		}
+		if enableLogging {
+			log.Printf("Impostor commits: %v", secureWorkflowReponse.ImpostorCommits)
+		}
+	}
+
 	if addHardenRunner {
 		if enableLogging {
 			log.Printf("Adding harden runner action")
@@ -221,13 +476,16 @@ func SecureWorkflow(queryStringParams map[string]string, inputYaml string, svc d
 		// Do not discard AddAction's error: a parse failure used to silently
 		// blank FinalOutput here, wiping the customer's workflow file in the
 		// generated PR. On error, keep the last good FinalOutput.
-		hardenedOutput, added, err := hardenrunner.AddAction(secureWorkflowReponse.FinalOutput, hardenRunnerConfig, pinHardenRunner, pinToImmutable, skipHardenRunnerForContainers)
+		hardenedOutput, added, policies, err := hardenrunner.AddActionWithReport(secureWorkflowReponse.FinalOutput, hardenRunnerConfig, pinHardenRunner, pinToImmutable, skipHardenRunnerForContainers)
 		if err != nil {
 			log.Printf("Error adding harden runner action: %v", err)
 			secureWorkflowReponse.HasErrors = true
 		} else {
 			secureWorkflowReponse.FinalOutput = hardenedOutput
 			addedHardenRunner = added
+			for _, policy := range policies {
+				secureWorkflowReponse.HardenRunnerPolicies = append(secureWorkflowReponse.HardenRunnerPolicies, policy.String())
+			}
 		}
 		if enableLogging {
 			log.Printf("Added harden runner: %v", addedHardenRunner)
@@ -248,6 +506,11 @@ func SecureWorkflow(queryStringParams map[string]string, inputYaml string, svc d
 	secureWorkflowReponse.AddedPermissions = addedPermissions
 	secureWorkflowReponse.AddedMaintainedActions = replacedMaintainedActions
 	secureWorkflowReponse.ReplacedRunnerLabels = replacedRunnerLabels
+	secureWorkflowReponse.ReplacedDeprecatedActions = replacedDeprecatedActions
+	secureWorkflowReponse.DeprecatedActions = deprecatedActions
+	if deprecatedActionsFailed {
+		secureWorkflowReponse.HasErrors = true
+	}
 	secureWorkflowReponse.UsingSecureRepoPAT = pin.UsingSecureRepoPAT()
 
 	if enableLogging {
@@ -1,6 +1,8 @@
 package workflow
 
 import (
+	"encoding/base64"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
@@ -9,9 +11,11 @@ import (
 	"testing"
 
 	"github.com/jarcoal/httpmock"
+	"github.com/step-security/secure-repo/remediation/workflow/hardenrunner"
 	"github.com/step-security/secure-repo/remediation/workflow/maintainedactions"
 	metadata "github.com/step-security/secure-repo/remediation/workflow/metadata"
 	"github.com/step-security/secure-repo/remediation/workflow/permissions"
+	"github.com/step-security/secure-repo/remediation/workflow/pin"
 	"gopkg.in/yaml.v3"
 )
 
@@ -581,6 +585,91 @@ func TestSecureWorkflowRunnerLabels(t *testing.T) {
 	}
 }
 
+func TestSecureWorkflowDeprecatedActions(t *testing.T) {
+	const inputDirectory = "../../testfiles/deprecatedActions/input"
+	const outputDirectory = "../../testfiles/deprecatedActions/output"
+
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	httpmock.RegisterResponder("GET", "https://api.github.com/repos/actions-rust-lang/setup-rust-toolchain/commits/v1",
+		httpmock.NewStringResponder(200, `aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa`))
+	httpmock.RegisterResponder("GET", "https://api.github.com/repos/actions-rust-lang/setup-rust-toolchain/git/matching-refs/tags/v1.",
+		httpmock.NewStringResponder(200, `[{"ref":"refs/tags/v1.10.1","object":{"sha":"aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa","type":"commit"}}]`))
+
+	input, err := ioutil.ReadFile(path.Join(inputDirectory, "release.yml"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	queryParams := make(map[string]string)
+	queryParams["addHardenRunner"] = "false"
+	queryParams["pinActions"] = "false"
+	queryParams["addPermissions"] = "false"
+	queryParams["addProjectComment"] = "false"
+	queryParams["replaceDeprecatedActions"] = "true"
+
+	output, err := SecureWorkflow(queryParams, string(input), &mockDynamoDBClient{})
+	if err != nil {
+		t.Errorf("Error not expected: %v", err)
+	}
+
+	expectedOutput, err := ioutil.ReadFile(path.Join(outputDirectory, "release.yml"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if output.FinalOutput != string(expectedOutput) {
+		t.Errorf("test failed release.yml did not match expected output\nExpected:\n%s\n\nGot:\n%s",
+			string(expectedOutput), output.FinalOutput)
+	}
+	if !output.ReplacedDeprecatedActions {
+		t.Errorf("Expected ReplacedDeprecatedActions to be true, got false")
+	}
+	if len(output.DeprecatedActions) != 5 {
+		t.Errorf("Expected 5 deprecated actions to be reported, got %v", output.DeprecatedActions)
+	}
+}
+
+func TestSecureWorkflowDenyByDefaultPermissions(t *testing.T) {
+	const inputDirectory = "../../testfiles/denybydefaultperms/input"
+	const outputDirectory = "../../testfiles/denybydefaultperms/output"
+
+	os.Setenv("KBFolder", "../../knowledge-base/actions")
+
+	input, err := ioutil.ReadFile(path.Join(inputDirectory, "top-level-grants.yml"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	queryParams := make(map[string]string)
+	queryParams["addHardenRunner"] = "false"
+	queryParams["pinActions"] = "false"
+	queryParams["addProjectComment"] = "false"
+	queryParams["denyByDefaultPermissions"] = "true"
+
+	output, err := SecureWorkflow(queryParams, string(input), &mockDynamoDBClient{})
+	if err != nil {
+		t.Errorf("Error not expected: %v", err)
+	}
+
+	expectedOutput, err := ioutil.ReadFile(path.Join(outputDirectory, "top-level-grants.yml"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if output.FinalOutput != string(expectedOutput) {
+		t.Errorf("test failed top-level-grants.yml did not match expected output\nExpected:\n%s\n\nGot:\n%s",
+			string(expectedOutput), output.FinalOutput)
+	}
+	if !output.AddedPermissions {
+		t.Errorf("Expected AddedPermissions to be true, got false")
+	}
+	if len(output.PermissionChanges) != 8 {
+		t.Errorf("Expected 8 permission changes to be reported, got %v", output.PermissionChanges)
+	}
+}
+
 // Regression: a workflow using YAML anchors/aliases on steps must never come
 // back empty (an empty FinalOutput was previously committed as a wiped
 // workflow file in policy-driven PRs).
@@ -642,3 +731,203 @@ jobs:
 		}
 	}
 }
+
+func TestSecureWorkflowVerifyPinnedActions(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	input := `name: ci
+on: push
+jobs:
+  build:
+    runs-on: ubuntu-latest
+    steps:
+      - uses: actions/checkout@0000000000000000000000000000000000000001 # v4.1.1
+`
+	httpmock.RegisterResponder("GET", "https://api.github.com/repos/actions/checkout",
+		httpmock.NewStringResponder(200, `{"default_branch": "main"}`))
+	httpmock.RegisterResponder("GET", "https://api.github.com/repos/actions/checkout/compare/main...0000000000000000000000000000000000000001",
+		httpmock.NewStringResponder(200, `{"status": "diverged"}`))
+	httpmock.RegisterResponder("GET", "https://api.github.com/repos/actions/checkout/compare/v4.1.1...0000000000000000000000000000000000000001",
+		httpmock.NewStringResponder(200, `{"status": "diverged"}`))
+	httpmock.RegisterResponder("GET", "https://api.github.com/repos/actions/checkout/releases",
+		httpmock.NewStringResponder(200, `[]`))
+
+	queryParams := map[string]string{
+		"addHardenRunner":     "false",
+		"addPermissions":      "false",
+		"verifyPinnedActions": "true",
+	}
+	output, err := SecureWorkflow(queryParams, input, &mockDynamoDBClient{})
+	if err != nil {
+		t.Fatalf("Error not expected: %v", err)
+	}
+	if output.FinalOutput != input {
+		t.Errorf("verifying pinned actions should not modify the workflow, got:\n%s", output.FinalOutput)
+	}
+	if len(output.ImpostorCommits) != 1 || output.ImpostorCommits[0] != "actions/checkout@0000000000000000000000000000000000000001" {
+		t.Errorf("ImpostorCommits = %v, want [actions/checkout@0000000000000000000000000000000000000001]", output.ImpostorCommits)
+	}
+}
+
+func TestSecureWorkflowUpdatePins(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	input := `name: ci
+on: push
+jobs:
+  build:
+    runs-on: ubuntu-latest
+    steps:
+      - uses: actions/checkout@8ade135a41bc03ea155e62e844d188df1ea18608 # v4.1.0
+      - uses: actions/cache@704facf57e6136b1bc63b828d79edcd491f0ee84 # v3.3.2
+`
+	expected := `name: ci
+on: push
+jobs:
+  build:
+    runs-on: ubuntu-latest
+    steps:
+      - uses: actions/checkout@b4ffde65f46336ab88eb53be808477a3936bae11 # v4.1.1
+      - uses: actions/cache@704facf57e6136b1bc63b828d79edcd491f0ee84 # v3.3.2
+`
+	httpmock.RegisterResponder("GET", "https://api.github.com/repos/actions/checkout/git/matching-refs/tags/v4.",
+		httpmock.NewStringResponder(200, `[{"ref": "refs/tags/v4.1.0", "object": {"sha": "8ade135a41bc03ea155e62e844d188df1ea18608", "type": "commit"}}]`))
+	httpmock.RegisterResponder("GET", "https://api.github.com/repos/actions/checkout/releases",
+		httpmock.NewStringResponder(200, `[{"tag_name": "v4.1.1", "published_at": "2023-10-17T00:00:00Z"}, {"tag_name": "v4.1.0", "published_at": "2023-10-01T00:00:00Z"}]`))
+	httpmock.RegisterResponder("GET", "https://api.github.com/repos/actions/checkout/commits/v4.1.1",
+		httpmock.NewStringResponder(200, `b4ffde65f46336ab88eb53be808477a3936bae11`))
+
+	queryParams := map[string]string{
+		"addHardenRunner": "false",
+		"addPermissions":  "false",
+		"pinActions":      "false",
+		"updatePins":      "true",
+	}
+	// actions/cache is exempted, so it is not looked up
+	output, err := SecureWorkflow(queryParams, input, &mockDynamoDBClient{}, []string{"actions/cache"}, false, map[string]string{}, map[string]string{}, map[string]string{},
+		hardenrunner.HardenRunnerConfig{}, pin.UpdatePinsConfig{DefaultPolicy: pin.UpdatePolicy{Level: pin.UpdateLevelPatch}})
+	if err != nil {
+		t.Fatalf("Error not expected: %v", err)
+	}
+	if output.FinalOutput != expected {
+		t.Errorf("test failed, output did not match expected output\nExpected:\n%s\n\nGot:\n%s", expected, output.FinalOutput)
+	}
+	if !output.UpdatedPins || output.HasErrors {
+		t.Errorf("UpdatedPins = %v, HasErrors = %v, want true, false", output.UpdatedPins, output.HasErrors)
+	}
+	if len(output.PinUpdates) != 1 || output.PinUpdates[0] != "actions/checkout v4.1.0 -> v4.1.1 (https://github.com/actions/checkout/compare/v4.1.0...v4.1.1)" {
+		t.Errorf("PinUpdates = %v", output.PinUpdates)
+	}
+}
+
+func TestSecureWorkflowNodeRuntimes(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	input := `name: ci
+on: push
+jobs:
+  build:
+    runs-on: ubuntu-latest
+    steps:
+      - uses: actions/checkout@ee0669bd1cc54295c223e0bb666b733df41de1c5 # v2.7.0
+      - uses: actions/setup-node@v4
+`
+	expected := `name: ci
+on: push
+jobs:
+  build:
+    runs-on: ubuntu-latest
+    steps:
+      - uses: actions/checkout@08c6903cd8c0fde910a37f88322edcfb5dd907a8 # v5.0.0
+      - uses: actions/setup-node@v4
+`
+	actionYml := func(using string) httpmock.Responder {
+		content := fmt.Sprintf("name: action\nruns:\n  using: '%s'\n  main: dist/index.js\n", using)
+		return httpmock.NewStringResponder(200, fmt.Sprintf(`{"type":"file","encoding":"base64","content":"%s"}`, base64.StdEncoding.EncodeToString([]byte(content))))
+	}
+	httpmock.RegisterResponder("GET", "https://api.github.com/repos/actions/checkout/contents/action.yml?ref=ee0669bd1cc54295c223e0bb666b733df41de1c5", actionYml("node12"))
+	httpmock.RegisterResponder("GET", "https://api.github.com/repos/actions/checkout/releases",
+		httpmock.NewStringResponder(200, `[{"tag_name": "v5.0.0"}, {"tag_name": "v4.0.0"}, {"tag_name": "v2.7.0"}]`))
+	httpmock.RegisterResponder("GET", "https://api.github.com/repos/actions/checkout/contents/action.yml?ref=v4.0.0", actionYml("node20"))
+	httpmock.RegisterResponder("GET", "https://api.github.com/repos/actions/checkout/contents/action.yml?ref=v5.0.0", actionYml("node24"))
+	httpmock.RegisterResponder("GET", "https://api.github.com/repos/actions/checkout/commits/v5.0.0",
+		httpmock.NewStringResponder(200, `08c6903cd8c0fde910a37f88322edcfb5dd907a8`))
+	// the releases of setup-node can not be listed, which is reported without stopping the checkout fix
+	httpmock.RegisterResponder("GET", "https://api.github.com/repos/actions/setup-node/contents/action.yml?ref=v4", actionYml("node20"))
+	httpmock.RegisterResponder("GET", "https://api.github.com/repos/actions/setup-node/releases",
+		httpmock.NewStringResponder(500, `{"message":"Server Error"}`))
+
+	queryParams := map[string]string{
+		"addHardenRunner": "false",
+		"addPermissions":  "false",
+		"pinActions":      "false",
+		"fixNodeRuntimes": "true",
+	}
+	output, err := SecureWorkflow(queryParams, input, &mockDynamoDBClient{})
+	if err != nil {
+		t.Fatalf("Error not expected: %v", err)
+	}
+	if output.FinalOutput != expected {
+		t.Errorf("test failed, output did not match expected output\nExpected:\n%s\n\nGot:\n%s", expected, output.FinalOutput)
+	}
+	if !output.FixedNodeRuntimes || !output.HasErrors {
+		t.Errorf("FixedNodeRuntimes = %v, HasErrors = %v, want true, true", output.FixedNodeRuntimes, output.HasErrors)
+	}
+	want := []string{
+		"actions/checkout@ee0669bd1cc54295c223e0bb666b733df41de1c5: node12 is retired, v5.0.0 uses a current runtime",
+		"actions/setup-node@v4: node20 is deprecated, unable to fix: GET https://api.github.com/repos/actions/setup-node/releases?per_page=100: 500 Server Error []",
+	}
+	if strings.Join(output.NodeRuntimeFindings, "\n") != strings.Join(want, "\n") {
+		t.Errorf("NodeRuntimeFindings = %v, want %v", output.NodeRuntimeFindings, want)
+	}
+}
+
+func TestSecureWorkflowVerifyImages(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	saveTr := pin.Tr
+	defer func() { pin.Tr = saveTr }()
+	pin.Tr = httpmock.DefaultTransport
+
+	input := `name: ci
+on: push
+jobs:
+  build:
+    runs-on: ubuntu-latest
+    container: ghcr.io/step-security/app@sha256:1efef3bbdd297d1b321b9b4559092d3131961913bc68b7c92b681b4783d563f0 # 1.0
+    steps:
+      - run: make
+`
+	httpmock.RegisterResponder("GET", "https://ghcr.io/v2/",
+		httpmock.NewStringResponder(200, `{
+	}`))
+	// no .sig tag for the digest
+	httpmock.RegisterNoResponder(httpmock.NewStringResponder(404, `{"errors":[{"code":"MANIFEST_UNKNOWN"}]}`))
+
+	queryParams := map[string]string{
+		"addHardenRunner":    "false",
+		"addPermissions":     "false",
+		"verifyImages":       "true",
+		"verificationPolicy": `{"identities":[{"name":"release workflow","issuer":"https://token.actions.githubusercontent.com","subjectRegExp":"^https://github\\.com/step-security/"}]}`,
+	}
+	output, err := SecureWorkflow(queryParams, input, &mockDynamoDBClient{})
+	if err != nil {
+		t.Fatalf("Error not expected: %v", err)
+	}
+	if output.FinalOutput != input {
+		t.Errorf("verifying images should not modify the workflow, got:\n%s", output.FinalOutput)
+	}
+	want := "ghcr.io/step-security/app@sha256:1efef3bbdd297d1b321b9b4559092d3131961913bc68b7c92b681b4783d563f0: image is not signed"
+	if len(output.ImageVerifications) != 1 || output.ImageVerifications[0].Verified || output.ImageVerifications[0].String() != want {
+		t.Errorf("ImageVerifications = %v, want [%s]", output.ImageVerifications, want)
+	}
+
+	queryParams["verificationPolicy"] = "{"
+	if _, err := SecureWorkflow(queryParams, input, &mockDynamoDBClient{}); err == nil {
+		t.Errorf("expected an error for an invalid verification policy")
+	}
+}